@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+type subjectKey struct{}
+
+// subjectFromContext returns the authenticated subject stored by requireJWT or
+// requireAPIKey, or "" for anonymous requests.
+func subjectFromContext(ctx context.Context) string {
+	sub, _ := ctx.Value(subjectKey{}).(string)
+
+	return sub
+}
+
+// writeClaims are the claims requireJWT accepts. Scope is a space-separated
+// list, as in OAuth 2.0.
+type writeClaims struct {
+	Scope string `json:"scope"`
+	jwt.RegisteredClaims
+}
+
+func (c writeClaims) hasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireJWT rejects write requests that don't carry a valid HS256 bearer
+// token with an exp claim and the given scope. GET, HEAD and OPTIONS requests
+// pass through unauthenticated, as do requests requireAPIKey has already
+// authenticated. With an empty secret every write is rejected, since an
+// empty HMAC key would accept tokens anyone can sign.
+func requireJWT(secret []byte, scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			if subjectFromContext(r.Context()) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			claims, err := parseBearer(r, secret)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="bookstore"`)
+				RespondError(w, 401, err.Error())
+				return
+			}
+			if !claims.hasScope(scope) {
+				RespondError(w, 403, "token is missing the "+scope+" scope")
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), subjectKey{}, claims.Subject)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func parseBearer(r *http.Request, secret []byte) (*writeClaims, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("invalid bearer token")
+	}
+
+	var claims writeClaims
+
+	_, err := jwt.ParseWithClaims(token, &claims, func(*jwt.Token) (any, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired())
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, errors.New("bearer token has expired")
+	}
+	if err != nil {
+		return nil, errors.New("invalid bearer token")
+	}
+
+	return &claims, nil
+}
+
+// apiKeys holds the SHA-256 hashes of the accepted X-API-Key values, so the
+// keys themselves never need to be stored in Vault or config.
+type apiKeys [][]byte
+
+// parseAPIKeyHashes decodes comma-separated hex SHA-256 hashes.
+func parseAPIKeyHashes(s string) (apiKeys, error) {
+	var keys apiKeys
+
+	for _, h := range splitList(s) {
+		sum, err := hex.DecodeString(h)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid API key hash %q: must be a hex SHA-256 digest", h)
+		}
+		keys = append(keys, sum)
+	}
+
+	return keys, nil
+}
+
+// match returns the hash of key if it is accepted. Every stored hash is
+// compared in constant time, so the response time doesn't reveal how close
+// a guess was or which entry it matched.
+func (keys apiKeys) match(key string) ([]byte, bool) {
+	sum := sha256.Sum256([]byte(key))
+
+	var found []byte
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(sum[:], k) == 1 {
+			found = k
+		}
+	}
+
+	return found, found != nil
+}
+
+// requireAPIKey authenticates requests to the routes in protected, given as
+// "METHOD /path/template" entries ("*" matches any method), with the
+// X-API-Key header instead of a bearer token. Other routes pass through.
+func requireAPIKey(keys apiKeys, protected []string) func(http.Handler) http.Handler {
+	routes := map[string]bool{}
+	for _, p := range protected {
+		method, tmpl, _ := strings.Cut(p, " ")
+		routes[strings.ToUpper(method)+" "+strings.TrimSpace(tmpl)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := mux.CurrentRoute(r)
+			if route == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			tmpl, _ := route.GetPathTemplate()
+			if !routes[r.Method+" "+tmpl] && !routes["* "+tmpl] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			sum, ok := keys.match(r.Header.Get("X-API-Key"))
+			if !ok {
+				RespondError(w, 401, "missing or invalid API key")
+				return
+			}
+
+			// Name the caller by a short prefix of its key hash for logs.
+			ctx := context.WithValue(r.Context(), subjectKey{}, "api-key:"+hex.EncodeToString(sum[:4]))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+func signToken(t *testing.T, secret string, claims jwt.Claims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "Bearer " + token
+}
+
+func TestRequireJWT(t *testing.T) {
+	const secret = "s3cret"
+
+	claims := func(scope string, exp time.Duration) writeClaims {
+		return writeClaims{
+			Scope: scope,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "alice",
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(exp)),
+			},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		auth    string
+		code    int
+		subject string
+	}{
+		{"valid token", "POST", signToken(t, secret, claims("books:read books:write", time.Hour)), 200, "alice"},
+		{"expired token", "POST", signToken(t, secret, claims("books:write", -time.Hour)), 401, ""},
+		{"missing token", "DELETE", "", 401, ""},
+		{"wrong secret", "PUT", signToken(t, "other", claims("books:write", time.Hour)), 401, ""},
+		{"no exp", "PUT", signToken(t, secret, writeClaims{Scope: "books:write"}), 401, ""},
+		{"missing scope", "PATCH", signToken(t, secret, claims("books:read", time.Hour)), 403, ""},
+		{"public read", "GET", "", 200, ""},
+	}
+
+	for _, tt := range tests {
+		var subject string
+
+		h := requireJWT([]byte(secret), "books:write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			subject = subjectFromContext(r.Context())
+		}))
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, "/v1/books", nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if subject != tt.subject {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.subject, subject)
+		}
+	}
+}
+
+func TestRequireJWTEmptySecret(t *testing.T) {
+	h := requireJWT(nil, "books:write")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books", nil)
+	req.Header.Set("Authorization", signToken(t, "", writeClaims{
+		Scope:            "books:write",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}))
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 401 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 401, rec.Code)
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	sum := sha256.Sum256([]byte("test-key-1"))
+	keys, err := parseAPIKeyHashes(hex.EncodeToString(sum[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		key    string
+		code   int
+	}{
+		{"valid key", "POST", "/v1/books/batch", "test-key-1", 200},
+		{"missing key", "POST", "/v1/books/batch", "", 401},
+		// Same length and prefix as the real key; only the last byte differs.
+		{"wrong key", "POST", "/v1/books/batch", "test-key-2", 401},
+		{"unprotected route", "POST", "/v1/books", "", 200},
+		{"wildcard method", "DELETE", "/v1/books/978-1505255607", "test-key-1", 200},
+		{"wildcard method without key", "GET", "/v1/books/978-1505255607", "", 401},
+	}
+
+	for _, tt := range tests {
+		var subject string
+
+		router := mux.NewRouter()
+		router.Use(requireAPIKey(keys, []string{"post /v1/books/batch", "* /v1/books/{isbn}"}))
+		v1 := router.PathPrefix("/v1").Subrouter()
+		for _, path := range []string{"/books", "/books/batch", "/books/{isbn}"} {
+			v1.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+				subject = subjectFromContext(r.Context())
+			})
+		}
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.key == "test-key-1" && subject != "api-key:"+hex.EncodeToString(sum[:4]) {
+			t.Errorf("%s: unexpected subject %q", tt.name, subject)
+		}
+	}
+}
+
+func TestParseAPIKeyHashes(t *testing.T) {
+	if _, err := parseAPIKeyHashes("not-a-hash"); err == nil {
+		t.Error("expected an error for an invalid hash")
+	}
+
+	keys, err := parseAPIKeyHashes("")
+	if err != nil || len(keys) != 0 {
+		t.Errorf("expected no keys, obtained %v %v", keys, err)
+	}
+}
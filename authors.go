@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// AuthorCount is an author in the catalogue and how many books they have.
+type AuthorCount struct {
+	Author string `json:"author"`
+	Books  int    `json:"books"`
+}
+
+// AuthorPage is the envelope returned by the author list endpoint.
+type AuthorPage struct {
+	Authors []AuthorCount `json:"authors"`
+	Total   int           `json:"total"`
+	Limit   int           `json:"limit"`
+	Offset  int           `json:"offset"`
+}
+
+// Authors returns a page of the distinct authors in alphabetical order,
+// each with their number of books, along with the number of authors across
+// all pages.
+func (m BookModel) Authors(ctx context.Context, limit, offset int) (_ []AuthorCount, _ int, err error) {
+	ctx, done := m.instrument(ctx, "Authors", "SELECT")
+	defer func() { done(err) }()
+
+	var (
+		authors []AuthorCount
+		total   int
+	)
+
+	err = m.Retry.do(ctx, func() error {
+		authors = nil
+
+		if err := m.reader().QueryRowContext(ctx, logSQL(ctx, "SELECT COUNT(DISTINCT author) FROM books;")).Scan(&total); err != nil {
+			return err
+		}
+
+		rows, err := m.reader().QueryContext(ctx,
+			logSQL(ctx, "SELECT author, COUNT(*) FROM books GROUP BY author ORDER BY author LIMIT $1 OFFSET $2;"), limit, offset)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var a AuthorCount
+			if err := rows.Scan(&a.Author, &a.Books); err != nil {
+				return err
+			}
+			authors = append(authors, a)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return authors, total, nil
+}
+
+// authorsIndex lists the catalogue's authors with their book counts, paged
+// by limit and offset like the book list, for browsing by author.
+func (env *Env) authorsIndex(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r.URL.Query())
+	if err != nil {
+		RespondError(w, 400, err.Error())
+		return
+	}
+
+	authors, total, err := env.books.Authors(r.Context(), limit, offset)
+	if err != nil {
+		respondServerError(w, r, err)
+		return
+	}
+	if authors == nil {
+		authors = []AuthorCount{}
+	}
+
+	setPaginationLinks(w, r, limit, offset, total)
+	RespondJSON(w, 200, AuthorPage{Authors: authors, Total: total, Limit: limit, Offset: offset})
+}
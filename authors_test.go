@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestAuthorsIndex(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		code     int
+		expected string
+	}{
+		{
+			name:     "first page",
+			code:     200,
+			expected: `{"authors":[{"author":"H. G. Wells","books":1},{"author":"Jayne Austen","books":2}],"total":2,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			name:     "limit and offset",
+			query:    "?limit=1&offset=1",
+			code:     200,
+			expected: `{"authors":[{"author":"Jayne Austen","books":2}],"total":2,"limit":1,"offset":1}` + "\n",
+		},
+		{
+			name:     "past the end",
+			query:    "?offset=5",
+			code:     200,
+			expected: `{"authors":[],"total":2,"limit":20,"offset":5}` + "\n",
+		},
+		{
+			name:     "invalid limit",
+			query:    "?limit=0",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"limit must be a positive integer"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/authors"+tt.query, nil)
+
+		http.HandlerFunc(env.authorsIndex).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestAuthorsQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(DISTINCT author) FROM books;")).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT author, COUNT(*) FROM books GROUP BY author ORDER BY author LIMIT $1 OFFSET $2;")).
+		WithArgs(2, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"author", "count"}).
+			AddRow("H. G. Wells", 3).
+			AddRow("Jayne Austen", 6))
+
+	authors, total, err := BookModel{DB: db}.Authors(context.Background(), 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []AuthorCount{{Author: "H. G. Wells", Books: 3}, {Author: "Jayne Austen", Books: 6}}
+	if !reflect.DeepEqual(expected, authors) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, authors)
+	}
+	if total != 3 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 3, total)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
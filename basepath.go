@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// parseBasePath cleans a BASE_PATH value into "" or a prefix such as
+// "/api/bookstore", with a leading slash and no trailing one.
+func parseBasePath(s string) (string, error) {
+	s = strings.TrimRight(strings.TrimSpace(s), "/")
+	if s == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(s, "/") {
+		s = "/" + s
+	}
+	if strings.ContainsAny(s, "{}?#") {
+		return "", fmt.Errorf("%s %q must be a plain path", BASE_PATH, s)
+	}
+
+	return s, nil
+}
+
+// mountBasePath returns the router to register routes on: router itself
+// without a base path, or a subrouter under it. Middleware added to router
+// still applies to routes on the subrouter.
+func mountBasePath(router *mux.Router, base string) *mux.Router {
+	if base == "" {
+		return router
+	}
+
+	return router.PathPrefix(base).Subrouter()
+}
+
+// prefixRoutes adds base to the path of each "METHOD /path" route, so
+// API_KEY_ROUTES can be written without the base path and still match the
+// route templates mux reports.
+func prefixRoutes(base string, routes []string) []string {
+	prefixed := make([]string, len(routes))
+	for i, route := range routes {
+		method, tmpl, _ := strings.Cut(route, " ")
+		prefixed[i] = method + " " + base + strings.TrimSpace(tmpl)
+	}
+
+	return prefixed
+}
+
+// specWithBasePath sets the spec's servers to base, so the documented paths
+// resolve under it.
+func specWithBasePath(spec []byte, base string) ([]byte, error) {
+	if base == "" {
+		return spec, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, err
+	}
+
+	servers, err := json.Marshal([]map[string]string{{"url": base}})
+	if err != nil {
+		return nil, err
+	}
+	doc["servers"] = servers
+
+	return json.MarshalIndent(doc, "", "  ")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestParseBasePath(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+		err      bool
+	}{
+		{in: "", expected: ""},
+		{in: "/", expected: ""},
+		{in: "/api/bookstore", expected: "/api/bookstore"},
+		{in: "api/bookstore/", expected: "/api/bookstore"},
+		{in: "/api/{tenant}", err: true},
+	}
+
+	for _, tt := range tests {
+		base, err := parseBasePath(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.in, err)
+		}
+		if base != tt.expected {
+			t.Errorf("%q:\n...expected = %v\n...obtained = %v", tt.in, tt.expected, base)
+		}
+	}
+}
+
+func TestPrefixRoutes(t *testing.T) {
+	expected := []string{"POST /api/bookstore/v1/books/batch", "* /api/bookstore/v1/books/import"}
+	obtained := prefixRoutes("/api/bookstore", []string{"POST /v1/books/batch", "* /v1/books/import"})
+
+	if !reflect.DeepEqual(expected, obtained) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, obtained)
+	}
+}
+
+func TestBasePathRoutes(t *testing.T) {
+	const base = "/api/bookstore"
+
+	spec, err := specWithBasePath(openAPISpec, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := Env{books: &mockBookModel{}}
+	router := mux.NewRouter().StrictSlash(true)
+	root := mountBasePath(router, base)
+	root.HandleFunc("/openapi.json", serveOpenAPI(spec)).Methods("GET")
+	env.registerV1(root.PathPrefix("/v1").Subrouter())
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		code   int
+	}{
+		{method: "GET", target: base + "/v1/books/978-1505255607", code: 200},
+		{method: "GET", target: "/v1/books/978-1505255607", code: 404},
+		{method: "GET", target: base + "/openapi.json", code: 200},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, tt.target, nil)
+
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s %s:\n...expected = %v\n...obtained = %v", tt.method, tt.target, tt.code, rec.Code)
+		}
+	}
+
+	// Location points back under the base path.
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99"}`)
+	req, _ := http.NewRequest("POST", base+"/v1/books", body)
+
+	router.ServeHTTP(rec, req)
+
+	if rec.Code != 201 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 201, rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != base+"/v1/books/978-1503290334" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", base+"/v1/books/978-1503290334", loc)
+	}
+
+	// The spec names the base path as its server.
+	var doc struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Servers) != 1 || doc.Servers[0].URL != base {
+		t.Errorf("unexpected servers: %+v", doc.Servers)
+	}
+	if _, ok := doc.Paths["/v1/books"]; !ok {
+		t.Error("spec lost its paths")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// breakerState is where a circuitBreaker is in its cycle. The values are
+// what db_circuit_breaker_state reports.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+
+	return "open"
+}
+
+// circuitBreaker stops a pool connecting to a database that is down, so
+// requests fail at once with ErrDBUnavailable instead of each waiting out
+// the connection timeout. It opens after threshold consecutive failed
+// connection attempts. Once cooldown has passed it lets a single attempt
+// through as a probe, closing again if the probe connects and reopening if
+// it doesn't.
+//
+// A nil *circuitBreaker lets everything through.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// newCircuitBreaker returns a breaker for the pool called name, or nil,
+// which never opens, when threshold is less than 1.
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold < 1 {
+		return nil
+	}
+
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a connection attempt may go ahead. Each attempt it
+// allows must be followed by a call to record.
+func (b *circuitBreaker) allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+	default:
+		return true
+	}
+
+	b.probing = true
+
+	return true
+}
+
+// record counts the outcome of an attempt allow let through. An attempt
+// abandoned because its caller went away says nothing about the database,
+// so it only frees the probe slot.
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := b.probing
+	b.probing = false
+
+	switch {
+	case err == nil:
+		b.failures = 0
+		b.setState(breakerClosed)
+	case errors.Is(err, context.Canceled):
+	case b.state == breakerHalfOpen && probe:
+		b.open()
+	case b.state == breakerClosed:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open()
+		}
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	b.setState(breakerOpen)
+}
+
+// setState moves the breaker to s, logging the change. b.mu must be held.
+func (b *circuitBreaker) setState(s breakerState) {
+	if b.state == s {
+		return
+	}
+
+	level := slog.LevelInfo
+	if s == breakerOpen {
+		level = slog.LevelWarn
+	}
+	slog.Log(context.Background(), level, "database circuit breaker "+s.String(), "pool", b.name, "failures", b.failures)
+
+	b.state = s
+}
+
+// State returns the breaker's current state; a nil breaker is always
+// closed.
+func (b *circuitBreaker) State() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// breakerCollector exports the state of each pool's circuit breaker as
+// db_circuit_breaker_state, labelled with the pool's name. It fetches the
+// breakers on every scrape, so after a reload it reports the new pool's
+// breaker rather than the closed one's.
+type breakerCollector struct {
+	breakers func() []*circuitBreaker
+}
+
+var breakerStateDesc = prometheus.NewDesc("db_circuit_breaker_state",
+	"State of the database circuit breaker: 0 closed, 1 half-open, 2 open.", []string{"pool"}, nil)
+
+func (c breakerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- breakerStateDesc
+}
+
+func (c breakerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, b := range c.breakers() {
+		if b != nil {
+			ch <- prometheus.MustNewConstMetric(breakerStateDesc, prometheus.GaugeValue, float64(b.State()), b.name)
+		}
+	}
+}
+
+// breakerConnector opens connections through a circuit breaker. Pooled
+// connections are reused as usual; it is new ones, which is all a pool
+// makes once the database has gone, that fail fast while the breaker is
+// open.
+type breakerConnector struct {
+	driver.Connector
+	breaker *circuitBreaker
+}
+
+func (c breakerConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	if !c.breaker.allow() {
+		return nil, ErrDBUnavailable
+	}
+
+	conn, err := c.Connector.Connect(ctx)
+	c.breaker.record(err)
+
+	return conn, err
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker("primary", 3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	refused := syscall.ECONNREFUSED
+
+	steps := []struct {
+		name    string
+		advance time.Duration
+		err     error
+		allowed bool
+		state   breakerState
+	}{
+		{name: "first failure", err: refused, allowed: true, state: breakerClosed},
+		{name: "success resets the count", err: nil, allowed: true, state: breakerClosed},
+		{name: "failure 1", err: refused, allowed: true, state: breakerClosed},
+		{name: "failure 2", err: refused, allowed: true, state: breakerClosed},
+		{name: "failure 3 opens", err: refused, allowed: true, state: breakerOpen},
+		{name: "open fails fast", allowed: false, state: breakerOpen},
+		{name: "still cooling down", advance: 59 * time.Second, allowed: false, state: breakerOpen},
+		{name: "failed probe reopens", advance: time.Second, err: refused, allowed: true, state: breakerOpen},
+		{name: "reopened fails fast", advance: 30 * time.Second, allowed: false, state: breakerOpen},
+		{name: "abandoned probe", advance: 30 * time.Second, err: context.Canceled, allowed: true, state: breakerHalfOpen},
+		{name: "successful probe closes", err: nil, allowed: true, state: breakerClosed},
+		{name: "closed again", err: refused, allowed: true, state: breakerClosed},
+	}
+
+	for _, step := range steps {
+		now = now.Add(step.advance)
+
+		allowed := b.allow()
+		if allowed {
+			b.record(step.err)
+		}
+
+		if step.allowed != allowed {
+			t.Errorf("%s: allowed\n...expected = %v\n...obtained = %v", step.name, step.allowed, allowed)
+		}
+		if state := b.State(); step.state != state {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", step.name, step.state, state)
+		}
+	}
+}
+
+func TestCircuitBreakerSingleProbe(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker("primary", 1, time.Second)
+	b.now = func() time.Time { return now }
+
+	b.allow()
+	b.record(syscall.ECONNREFUSED)
+	now = now.Add(time.Second)
+
+	if !b.allow() {
+		t.Fatal("expected the probe to be allowed")
+	}
+	// Other attempts wait for the probe's outcome.
+	if b.allow() {
+		t.Error("expected a second attempt to be refused while probing")
+	}
+
+	b.record(nil)
+	if !b.allow() {
+		t.Error("expected attempts to be allowed once the probe succeeded")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker("primary", 0, time.Second)
+	if b != nil {
+		t.Fatalf("expected no breaker, obtained %+v", b)
+	}
+
+	for i := 0; i < 10; i++ {
+		if !b.allow() {
+			t.Fatal("a nil breaker refused an attempt")
+		}
+		b.record(syscall.ECONNREFUSED)
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("\n...expected = %v\n...obtained = %v", breakerClosed, b.State())
+	}
+}
+
+// fakeConnector fails every connection attempt with err, counting them.
+type fakeConnector struct {
+	err   error
+	calls int
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	c.calls++
+	return nil, c.err
+}
+
+func (c *fakeConnector) Driver() driver.Driver { return unavailableDriver{} }
+
+func TestBreakerConnector(t *testing.T) {
+	now := time.Unix(0, 0)
+	breaker := newCircuitBreaker("primary", 2, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	inner := &fakeConnector{err: syscall.ECONNREFUSED}
+	db := sql.OpenDB(breakerConnector{Connector: inner, breaker: breaker})
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := db.PingContext(context.Background()); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Errorf("\n...expected = %v\n...obtained = %v", syscall.ECONNREFUSED, err)
+		}
+	}
+
+	// Open, the breaker answers without trying to connect, with the error
+	// handlers turn into a 503.
+	err := db.PingContext(context.Background())
+	if !errors.Is(err, ErrDBUnavailable) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", ErrDBUnavailable, err)
+	}
+	if inner.calls != 2 {
+		t.Errorf("\n...expected = %v connection attempts\n...obtained = %v", 2, inner.calls)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v1/books", nil)
+	respondServerError(rec, req, err)
+	if rec.Code != 503 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 503, rec.Code)
+	}
+
+	// After the cooldown a probe gets through, and fails here, so the
+	// breaker stays open.
+	now = now.Add(time.Minute)
+	if err := db.PingContext(context.Background()); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", syscall.ECONNREFUSED, err)
+	}
+	if inner.calls != 3 {
+		t.Errorf("\n...expected = %v connection attempts\n...obtained = %v", 3, inner.calls)
+	}
+	if breaker.State() != breakerOpen {
+		t.Errorf("\n...expected = %v\n...obtained = %v", breakerOpen, breaker.State())
+	}
+}
+
+func TestBreakerCollector(t *testing.T) {
+	b := newCircuitBreaker("primary", 1, time.Minute)
+	current := b
+	collector := breakerCollector{breakers: func() []*circuitBreaker { return []*circuitBreaker{current} }}
+
+	if v := testutil.ToFloat64(collector); v != 0 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 0, v)
+	}
+
+	b.allow()
+	b.record(syscall.ECONNREFUSED)
+
+	if v := testutil.ToFloat64(collector); v != 2 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 2, v)
+	}
+
+	// After a reload the gauge follows the new pool's breaker.
+	current = newCircuitBreaker("primary", 1, time.Minute)
+
+	if v := testutil.ToFloat64(collector); v != 0 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 0, v)
+	}
+
+	// A disabled breaker reports nothing.
+	current = nil
+
+	if n := testutil.CollectAndCount(collector); n != 0 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 0, n)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// BookCache caches books by ISBN in front of BookModel.Get. BookModel evicts
+// an ISBN whenever it writes to that book, so a cache only has to bound how
+// long entries live.
+//
+// A cache never fails a request: implementations backed by another service
+// treat errors as misses and log them.
+type BookCache interface {
+	Get(ctx context.Context, isbn string) (Book, bool)
+	Set(ctx context.Context, isbn string, bk Book)
+	Delete(ctx context.Context, isbn string)
+}
+
+// lruCache is an in-memory BookCache holding at most size books, each for at
+// most ttl. It is local to the process, so with several replicas a write
+// through one of them can leave the others serving the old book until ttl
+// passes.
+type lruCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu    sync.Mutex
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	isbn    string
+	book    Book
+	expires time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+		order: list.New(),
+		items: map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) Get(_ context.Context, isbn string) (Book, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[isbn]
+	if !ok {
+		return Book{}, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return Book{}, false
+	}
+	c.order.MoveToFront(el)
+
+	return e.book, true
+}
+
+func (c *lruCache) Set(_ context.Context, isbn string, bk Book) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(c.ttl)
+
+	if el, ok := c.items[isbn]; ok {
+		el.Value = &cacheEntry{isbn: isbn, book: bk, expires: expires}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[isbn] = c.order.PushFront(&cacheEntry{isbn: isbn, book: bk, expires: expires})
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *lruCache) Delete(_ context.Context, isbn string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[isbn]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *lruCache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).isbn)
+}
+
+// redisCache is a BookCache shared by every replica, storing each book as
+// JSON under "bookstore:book:<isbn>" with an expiry of ttl. When Redis is
+// unreachable reads fall through to the database; a failed eviction leaves
+// the old book cached until ttl passes.
+type redisCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func newRedisCache(client *redis.Client, ttl time.Duration) redisCache {
+	return redisCache{client: client, ttl: ttl}
+}
+
+func (c redisCache) key(isbn string) string {
+	return "bookstore:book:" + isbn
+}
+
+func (c redisCache) Get(ctx context.Context, isbn string) (Book, bool) {
+	var bk Book
+
+	data, err := c.client.Get(ctx, c.key(isbn)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return bk, false
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &bk)
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "cache get failed", "isbn", isbn, "error", err)
+		return bk, false
+	}
+
+	return bk, true
+}
+
+func (c redisCache) Set(ctx context.Context, isbn string, bk Book) {
+	data, err := json.Marshal(bk)
+	if err == nil {
+		err = c.client.Set(ctx, c.key(isbn), data, c.ttl).Err()
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "cache set failed", "isbn", isbn, "error", err)
+	}
+}
+
+func (c redisCache) Delete(ctx context.Context, isbn string) {
+	// Evict even if the request was cancelled, since the write may still
+	// have committed.
+	err := c.client.Del(context.WithoutCancel(ctx), c.key(isbn)).Err()
+	if err != nil {
+		slog.WarnContext(ctx, "cache delete failed", "isbn", isbn, "error", err)
+	}
+}
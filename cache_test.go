@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLRUCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	c := newLRUCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Set(ctx, "978-1505255607", Book{Title: "The Time Machine"})
+	c.Set(ctx, "978-1503261969", Book{Title: "Emma"})
+
+	// Reading The Time Machine makes Emma the least recently used.
+	if _, ok := c.Get(ctx, "978-1505255607"); !ok {
+		t.Fatal("expected a cached book")
+	}
+	c.Set(ctx, "978-1503379572", Book{Title: "Moby Dick"})
+
+	tests := []struct {
+		isbn string
+		ok   bool
+	}{
+		{isbn: "978-1505255607", ok: true},
+		{isbn: "978-1503261969", ok: false},
+		{isbn: "978-1503379572", ok: true},
+	}
+
+	for _, tt := range tests {
+		if _, ok := c.Get(ctx, tt.isbn); ok != tt.ok {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.isbn, tt.ok, ok)
+		}
+	}
+
+	c.Delete(ctx, "978-1503379572")
+	if _, ok := c.Get(ctx, "978-1503379572"); ok {
+		t.Error("expected a deleted book to be evicted")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get(ctx, "978-1505255607"); ok {
+		t.Error("expected an expired book to be evicted")
+	}
+}
+
+func TestGetCached(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	expectGet := func(title string) {
+		mock.ExpectPrepare("SELECT isbn, title, author, genre, price, quantity, published_year, version FROM books WHERE isbn").
+			ExpectQuery().
+			WithArgs("978-1505255607").
+			WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+				AddRow("978-1505255607", title, "H. G. Wells", "Science Fiction", "5.99", 2, 1895, 1))
+	}
+
+	m := BookModel{DB: db, Cache: newLRUCache(10, time.Minute)}
+	ctx := context.Background()
+
+	// The second Get is served from the cache, so only one query is expected.
+	expectGet("The Time Machine")
+	for i := 0; i < 2; i++ {
+		bk, err := m.Get(ctx, "978-1505255607")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bk.Title != "The Time Machine" {
+			t.Errorf("\n...expected = %v\n...obtained = %v", "The Time Machine", bk.Title)
+		}
+	}
+
+	// Updating the book evicts it, so the next Get queries again.
+	mock.ExpectPrepare("UPDATE books SET").
+		ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(2, 2))
+	expectGet("The Time Machine (Revised)")
+
+	err = m.Update(ctx, "978-1505255607", &Book{Isbn: "978-1505255607", Title: "The Time Machine (Revised)", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bk, err := m.Get(ctx, "978-1505255607")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bk.Title != "The Time Machine (Revised)" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "The Time Machine (Revised)", bk.Title)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	s := miniredis.RunT(t)
+	c := newRedisCache(redis.NewClient(&redis.Options{Addr: s.Addr()}), time.Minute)
+	ctx := context.Background()
+
+	want := Book{Isbn: "978-1505255607", Title: "The Time Machine", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599, Quantity: 2}
+
+	if _, ok := c.Get(ctx, want.Isbn); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+
+	c.Set(ctx, want.Isbn, want)
+	if ttl := s.TTL("bookstore:book:" + want.Isbn); ttl != time.Minute {
+		t.Errorf("\n...expected = %v\n...obtained = %v", time.Minute, ttl)
+	}
+
+	bk, ok := c.Get(ctx, want.Isbn)
+	if !ok || bk != want {
+		t.Errorf("\n...expected = %v\n...obtained = %v", want, bk)
+	}
+
+	c.Delete(ctx, want.Isbn)
+	if _, ok := c.Get(ctx, want.Isbn); ok {
+		t.Error("expected a deleted book to be evicted")
+	}
+
+	c.Set(ctx, want.Isbn, want)
+	s.FastForward(time.Minute)
+	if _, ok := c.Get(ctx, want.Isbn); ok {
+		t.Error("expected an expired book to be evicted")
+	}
+}
+
+func TestGetRedisUnreachable(t *testing.T) {
+	s := miniredis.RunT(t)
+	cache := newRedisCache(redis.NewClient(&redis.Options{Addr: s.Addr(), MaxRetries: -1}), time.Minute)
+	s.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectPrepare("SELECT isbn, title, author, genre, price, quantity, published_year, version FROM books WHERE isbn").
+		ExpectQuery().
+		WithArgs("978-1505255607").
+		WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+			AddRow("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 2, 1895, 1))
+
+	m := BookModel{DB: db, Cache: cache}
+
+	bk, err := m.Get(context.Background(), "978-1505255607")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bk.Title != "The Time Machine" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "The Time Machine", bk.Title)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
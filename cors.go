@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultCORSMethods = "GET,POST,PUT,PATCH,DELETE"
+	defaultCORSHeaders = "Content-Type,Authorization"
+	defaultCORSMaxAge  = 10 * time.Minute
+)
+
+// cors adds CORS headers for requests whose Origin is in origins ("*" allows
+// any origin) and answers preflight OPTIONS requests with a 204. Requests from
+// other origins are passed through without CORS headers, so browsers block
+// them. Preflight responses let browsers cache them for maxAge, in whole
+// seconds, unless it is 0. It wraps the whole router rather than being
+// registered with Use, because mux only runs middleware for matched routes
+// and preflights match none.
+func cors(origins, methods, headers []string, maxAge time.Duration) func(http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	seconds := strconv.Itoa(int(maxAge.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" || !(allowed["*"] || allowed[origin]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+				if maxAge >= time.Second {
+					w.Header().Set("Access-Control-Max-Age", seconds)
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseMaxAge parses CORS_MAX_AGE: a duration such as 10m, or a bare number
+// of seconds, the unit of Access-Control-Max-Age itself. A duration must be
+// 0 or at least a second, the header's smallest step.
+func parseMaxAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d != 0 && d < time.Second {
+		return 0, fmt.Errorf("invalid %s %q: must be a number of seconds or a duration such as 10m", CORS_MAX_AGE, s)
+	}
+
+	return d, nil
+}
+
+// splitList splits a comma-separated config value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	handler := cors([]string{"https://shop.example.com"}, []string{"GET", "POST"}, []string{"Content-Type"}, 10*time.Minute)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		code        int
+		allowOrigin string
+	}{
+		{"allowed origin", "GET", "https://shop.example.com", false, 200, "https://shop.example.com"},
+		{"other origin", "GET", "https://evil.example.com", false, 200, ""},
+		{"no origin", "GET", "", false, 200, ""},
+		{"preflight", "OPTIONS", "https://shop.example.com", true, 204, "https://shop.example.com"},
+		{"preflight other origin", "OPTIONS", "https://evil.example.com", true, 200, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/books", nil)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			if test.preflight {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != test.code {
+				t.Errorf("\n...expected = %v\n...obtained = %v", test.code, rec.Code)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+				t.Errorf("\n...expected = %v\n...obtained = %v", test.allowOrigin, got)
+			}
+			if test.code == 204 {
+				if got := rec.Header().Get("Access-Control-Allow-Methods"); got != "GET, POST" {
+					t.Errorf("\n...expected = %v\n...obtained = %v", "GET, POST", got)
+				}
+			}
+
+			// Only preflight responses are cached, so only they carry a max-age.
+			maxAge := ""
+			if test.code == 204 {
+				maxAge = "600"
+			}
+			if got := rec.Header().Get("Access-Control-Max-Age"); got != maxAge {
+				t.Errorf("\n...expected = %q\n...obtained = %q", maxAge, got)
+			}
+		})
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	handler := cors([]string{"*"}, nil, nil, 0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest("GET", "/books", nil)
+	req.Header.Set("Origin", "http://localhost:3000")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "http://localhost:3000" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "http://localhost:3000", got)
+	}
+}
+
+func TestCORSMaxAge(t *testing.T) {
+	tests := []struct {
+		maxAge   time.Duration
+		expected string
+	}{
+		{maxAge: 10 * time.Minute, expected: "600"},
+		{maxAge: 90 * time.Second, expected: "90"},
+		{maxAge: 0, expected: ""},
+	}
+
+	for _, tt := range tests {
+		handler := cors([]string{"*"}, []string{"GET"}, nil, tt.maxAge)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		req := httptest.NewRequest("OPTIONS", "/books", nil)
+		req.Header.Set("Origin", "http://localhost:3000")
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Access-Control-Max-Age"); got != tt.expected {
+			t.Errorf("%v:\n...expected = %q\n...obtained = %q", tt.maxAge, tt.expected, got)
+		}
+	}
+}
+
+func TestParseMaxAge(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+		err      bool
+	}{
+		{value: "600", expected: 10 * time.Minute},
+		{value: "0", expected: 0},
+		{value: "10m", expected: 10 * time.Minute},
+		{value: "10m0s", expected: 10 * time.Minute},
+		{value: "1.5s", expected: 1500 * time.Millisecond},
+		{value: "0s", expected: 0},
+		{value: "500ms", err: true},
+		{value: "-1", err: true},
+		{value: "ten", err: true},
+	}
+
+	for _, tt := range tests {
+		maxAge, err := parseMaxAge(tt.value)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.value, err)
+		}
+		if !tt.err && maxAge != tt.expected {
+			t.Errorf("%q:\n...expected = %v\n...obtained = %v", tt.value, tt.expected, maxAge)
+		}
+	}
+}
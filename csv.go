@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportCSVRoute names the CSV export route so the timeout middleware can
+// let it stream.
+const exportCSVRoute = "exportCSV"
+
+// importCSVRoute names the CSV import route so requireJSON lets it take CSV
+// and multipart bodies.
+const importCSVRoute = "importCSV"
+
+// csvHeader lists the export columns. An import may leave off the trailing
+// optional ones.
+var csvHeader = []string{"ISBN", "Title", "Author", "Genre", "Price", "Quantity", "PublishedYear"}
+
+// csvOptional is how many of the trailing csvHeader columns are optional.
+const csvOptional = 2
+
+// exportCSV streams the whole catalogue as CSV, one row per book.
+func (env *Env) exportCSV(w http.ResponseWriter, r *http.Request) {
+	// A large catalogue can take longer than SERVER_WRITE_TIMEOUT to send,
+	// so the export runs without a write deadline, as it does without the
+	// request timeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	cw := csv.NewWriter(w)
+	started := false
+
+	start := func() {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="books.csv"`)
+		cw.Write(csvHeader)
+		started = true
+	}
+
+	err := env.books.ForEach(r.Context(), func(bk Book) error {
+		if !started {
+			start()
+		}
+
+		return cw.Write(bookRecord(bk))
+	})
+	if err != nil {
+		if !started {
+			respondServerError(w, r, err)
+			return
+		}
+		logError(r, err)
+
+		// Part of the file has been sent with a 200; drop the connection so
+		// the client sees a failed download rather than a short catalogue.
+		panic(http.ErrAbortHandler)
+	}
+
+	if !started {
+		start()
+	}
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		logError(r, err)
+	}
+}
+
+func bookRecord(bk Book) []string {
+	return []string{
+		bk.Isbn,
+		csvSafe(bk.Title),
+		csvSafe(bk.Author),
+		csvSafe(bk.Genre),
+		bk.Price.String(),
+		strconv.Itoa(bk.Quantity),
+		publishedYear(bk.PublishedYear),
+	}
+}
+
+// publishedYear formats an unknown year as an empty field.
+func publishedYear(year int) string {
+	if year == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(year)
+}
+
+// csvSafe stops spreadsheet applications from evaluating a text field as a
+// formula by prefixing it with a quote when it starts with a formula
+// character.
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+
+	return s
+}
+
+// maxImportBytes caps the size of CSV uploads.
+const maxImportBytes = 10 << 20
+
+// importRow reports the outcome for one data row of an import, numbered by
+// its line in the file.
+type importRow struct {
+	Row    int    `json:"row"`
+	Isbn   string `json:"isbn,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type importReport struct {
+	Inserted int         `json:"inserted"`
+	Failed   int         `json:"failed"`
+	Rows     []importRow `json:"rows"`
+}
+
+// importCSV bulk-loads books from a CSV upload in the export format, sent
+// either as text/csv or as the "file" field of a multipart form. Valid rows
+// are inserted in one transaction; invalid rows, ISBNs that already exist and,
+// with STRICT_DEDUP, duplicate titles and authors are reported as failed
+// without affecting the rest.
+func (env *Env) importCSV(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+
+	var src io.Reader
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		src = r.Body
+	case "multipart/form-data":
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			RespondError(w, 400, `multipart upload must include a "file" field`)
+			return
+		}
+		defer file.Close()
+		src = file
+	default:
+		RespondError(w, 415, "request body must be text/csv or multipart/form-data")
+		return
+	}
+
+	bks, rows, err := parseImport(src)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		RespondError(w, 413, fmt.Sprintf("request body must not be larger than %d bytes", maxBytesErr.Limit))
+		return
+	}
+	if err != nil {
+		RespondError(w, 400, err.Error())
+		return
+	}
+
+	var skipped []error
+	if len(bks) > 0 {
+		skipped, err = env.books.Import(r.Context(), bks)
+		if err != nil {
+			respondServerError(w, r, err)
+			return
+		}
+	}
+
+	report := importReport{Rows: rows}
+	next := 0
+	for i := range report.Rows {
+		row := &report.Rows[i]
+		if row.Status == "" {
+			if skipped[next] == nil {
+				row.Status = "inserted"
+			} else {
+				row.Status = "failed"
+				row.Error = skipped[next].Error()
+			}
+			next++
+		}
+		if row.Status == "inserted" {
+			report.Inserted++
+		} else {
+			report.Failed++
+		}
+	}
+
+	RespondJSON(w, 200, report)
+}
+
+// parseImport reads the CSV header and rows. It returns the valid books, in
+// order, and a report entry for every row; entries for valid rows have an
+// empty Status until the insert decides it. Malformed CSV or an unexpected
+// header is an error.
+func parseImport(src io.Reader) ([]Book, []importRow, error) {
+	cr := csv.NewReader(src)
+	cr.FieldsPerRecord = -1
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, nil, errors.New("CSV must start with a header row")
+	}
+	if err != nil {
+		return nil, nil, csvError(err)
+	}
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	if !validImportHeader(header) {
+		return nil, nil, fmt.Errorf("CSV header must be %s, with Quantity and PublishedYear optional", strings.Join(csvHeader, ","))
+	}
+
+	var bks []Book
+	rows := []importRow{}
+
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, csvError(err)
+		}
+		line, _ := cr.FieldPos(0)
+
+		bk, err := parseImportRecord(record, len(header))
+		if err != nil {
+			rows = append(rows, importRow{Row: line, Isbn: record[0], Status: "failed", Error: err.Error()})
+			continue
+		}
+
+		bks = append(bks, bk)
+		rows = append(rows, importRow{Row: line, Isbn: bk.Isbn})
+	}
+
+	return bks, rows, nil
+}
+
+func csvError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+
+	return fmt.Errorf("request body contains malformed CSV: %v", err)
+}
+
+func validImportHeader(header []string) bool {
+	if len(header) < len(csvHeader)-csvOptional || len(header) > len(csvHeader) {
+		return false
+	}
+	for i, h := range header {
+		if !strings.EqualFold(strings.TrimSpace(h), csvHeader[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseImportRecord(record []string, columns int) (Book, error) {
+	if len(record) != columns {
+		return Book{}, fmt.Errorf("expected %d fields, found %d", columns, len(record))
+	}
+
+	bk := Book{
+		Isbn:   strings.TrimSpace(record[0]),
+		Title:  csvUnsafe(record[1]),
+		Author: csvUnsafe(record[2]),
+		Genre:  csvUnsafe(record[3]),
+	}
+
+	price, err := ParsePrice(strings.TrimSpace(record[4]))
+	if err != nil {
+		return Book{}, errors.New("price must be a decimal with at most two fractional digits")
+	}
+	bk.Price = price
+
+	if columns > 5 && strings.TrimSpace(record[5]) != "" {
+		qty, err := strconv.Atoi(strings.TrimSpace(record[5]))
+		if err != nil || qty < 0 {
+			return Book{}, errors.New("quantity must be a non-negative integer")
+		}
+		bk.Quantity = qty
+	}
+
+	if columns > 6 && strings.TrimSpace(record[6]) != "" {
+		year, err := strconv.Atoi(strings.TrimSpace(record[6]))
+		if err != nil {
+			return Book{}, errors.New("published year must be an integer")
+		}
+		bk.PublishedYear = year
+	}
+
+	if err := validateBook(&bk); err != nil {
+		return Book{}, err
+	}
+
+	return bk, nil
+}
+
+// csvUnsafe undoes csvSafe, so exported files import unchanged.
+func csvUnsafe(s string) string {
+	if len(s) > 1 && s[0] == '\'' && strings.ContainsRune("=+-@\t\r", rune(s[1])) {
+		return s[1:]
+	}
+
+	return s
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestExportCSV(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books.csv", nil)
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.exportCSV).ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "text/csv; charset=utf-8", got)
+	}
+
+	expected := "ISBN,Title,Author,Genre,Price,Quantity,PublishedYear\n" +
+		"978-1503261969,Emma,Jayne Austen,Romance,9.44,0,\n" +
+		"978-1505255607,The Time Machine,H. G. Wells,Science Fiction,5.99,0,\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+type failingCSVBooks struct {
+	mockBookModel
+}
+
+func (m *failingCSVBooks) ForEach(ctx context.Context, fn func(Book) error) error {
+	return errors.New("connection refused")
+}
+
+func TestExportCSVError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books.csv", nil)
+
+	env := Env{books: &failingCSVBooks{}}
+
+	http.HandlerFunc(env.exportCSV).ServeHTTP(rec, req)
+
+	if rec.Code != 500 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 500, rec.Code)
+	}
+}
+
+func TestBookRecord(t *testing.T) {
+	bk := Book{Isbn: "978-1503261969", Title: `=HYPERLINK("x")`, Author: "Austen, Jane", Genre: "Romance", Price: 944, Quantity: 3}
+
+	expected := []string{"978-1503261969", `'=HYPERLINK("x")`, "Austen, Jane", "Romance", "9.44", "3"}
+	got := bookRecord(bk)
+
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("\n...expected = %v\n...obtained = %v", expected[i], got[i])
+		}
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	body := "ISBN,Title,Author,Genre,Price,Quantity,PublishedYear\n" +
+		"978-1503379640,The Prince,Niccolò Machiavelli,Philosophy,6.99,4,1532\n" +
+		"978-1505255600,Bad Checksum,Nobody,Fiction,1.00,1,\n" +
+		"978-1505255607,The Time Machine,H. G. Wells,Science Fiction,5.99,2,1895\n" +
+		"978-0141439518,Pride and Prejudice,Jane Austen,Romance,cheap,1,\n" +
+		"0-306-40615-2,'=Formula,Someone,Fiction,10,,\n" +
+		"978-0141439600,Too Few Fields\n" +
+		"978-0141441146,Jane Eyre,Charlotte Brontë,,7.99,1,\n" +
+		"978-0141439846,Middlemarch,George Eliot,Fiction,8.99,1,3000\n"
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.importCSV).ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("\n...expected = %v\n...obtained = %v\n%s", 200, rec.Code, rec.Body.String())
+	}
+
+	expected := `{"inserted":2,"failed":6,"rows":[` +
+		`{"row":2,"isbn":"978-1503379640","status":"inserted"},` +
+		`{"row":3,"isbn":"978-1505255600","status":"failed","error":"ISBN: invalid checksum"},` +
+		`{"row":4,"isbn":"978-1505255607","status":"failed","error":"a book with this ISBN already exists"},` +
+		`{"row":5,"isbn":"978-0141439518","status":"failed","error":"price must be a decimal with at most two fractional digits"},` +
+		`{"row":6,"isbn":"978-0306406157","status":"inserted"},` +
+		`{"row":7,"isbn":"978-0141439600","status":"failed","error":"expected 7 fields, found 2"},` +
+		`{"row":8,"isbn":"978-0141441146","status":"failed","error":"Genre: must not be empty"},` +
+		`{"row":9,"isbn":"978-0141439846","status":"failed","error":"PublishedYear: must not be later than ` + strconv.Itoa(time.Now().Year()+1) + `"}]}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestImportCSVMultipart(t *testing.T) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "books.csv")
+	io.WriteString(fw, "isbn,title,author,genre,price\n978-1503379640,The Prince,Niccolò Machiavelli,Philosophy,6.99\n")
+	mw.Close()
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books/import", &buf)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.importCSV).ServeHTTP(rec, req)
+
+	expected := `{"inserted":1,"failed":0,"rows":[{"row":2,"isbn":"978-1503379640","status":"inserted"}]}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestImportCSVBadRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		code        int
+		message     string
+	}{
+		{"wrong header", "text/csv", "ISBN,Name,Price\n", 400, "CSV header must be ISBN,Title,Author,Genre,Price,Quantity,PublishedYear, with Quantity and PublishedYear optional"},
+		{"empty body", "text/csv", "", 400, "CSV must start with a header row"},
+		{"malformed CSV", "text/csv", "ISBN,Title,Author,Genre,Price\n978-1503379640,\"The Prince,x,y,1\n", 400, ""},
+		{"JSON body", "application/json", "[]", 415, "request body must be text/csv or multipart/form-data"},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/books/import", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+
+		http.HandlerFunc(env.importCSV).ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.message != "" && !strings.Contains(rec.Body.String(), tt.message) {
+			t.Errorf("%s: expected message %q, obtained %s", tt.name, tt.message, rec.Body.String())
+		}
+	}
+}
+
+func TestImportQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare("INSERT INTO books .* ON CONFLICT \\(isbn\\) DO NOTHING")
+	prep.ExpectExec().WithArgs("978-1503379640", "The Prince", "Niccolò Machiavelli", "Philosophy", Price(699), 4, 1532).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", Price(599), 0, 0).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	skipped, err := BookModel{DB: db}.Import(context.Background(), []Book{
+		{Isbn: "978-1503379640", Title: "The Prince", Author: "Niccolò Machiavelli", Genre: "Philosophy", Price: 699, Quantity: 4, PublishedYear: 1532},
+		{Isbn: "978-1505255607", Title: "The Time Machine", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 2 || skipped[0] != nil || skipped[1] != ErrBookExists {
+		t.Errorf("unexpected result: %v", skipped)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImportCSVStrictDedup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dedup := regexp.QuoteMeta("SELECT isbn FROM books WHERE LOWER(title)=LOWER($1) AND LOWER(author)=LOWER($2) LIMIT 1;")
+
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare("INSERT INTO books")
+	mock.ExpectQuery(dedup).WithArgs("The Prince", "Niccolò Machiavelli").WillReturnRows(sqlmock.NewRows([]string{"isbn"}))
+	prep.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(dedup).WithArgs("the time machine", "H. G. Wells").
+		WillReturnRows(sqlmock.NewRows([]string{"isbn"}).AddRow("978-1505255607"))
+	mock.ExpectQuery(dedup).WithArgs("The Time Machine", "H. G. Wells").
+		WillReturnRows(sqlmock.NewRows([]string{"isbn"}).AddRow("978-1505255607"))
+	mock.ExpectCommit()
+
+	body := "ISBN,Title,Author,Genre,Price\n" +
+		"978-1503379640,The Prince,Niccolò Machiavelli,Philosophy,6.99\n" +
+		"978-0000000002,the time machine,H. G. Wells,Science Fiction,5.99\n" +
+		"978-1505255607,The Time Machine,H. G. Wells,Science Fiction,5.99\n"
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/v1/books/import", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+
+	env := Env{books: BookModel{DB: db, StrictDedup: true}}
+
+	http.HandlerFunc(env.importCSV).ServeHTTP(rec, req)
+
+	expected := `{"inserted":1,"failed":2,"rows":[` +
+		`{"row":2,"isbn":"978-1503379640","status":"inserted"},` +
+		`{"row":3,"isbn":"978-0000000002","status":"failed","error":"a book with the same title and author exists with ISBN 978-1505255607"},` +
+		`{"row":4,"isbn":"978-1505255607","status":"failed","error":"a book with this ISBN already exists"}]}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
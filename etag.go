@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// etag returns a strong entity tag for a serialized representation.
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatch reports whether an If-None-Match header value matches tag. Weak
+// comparison is used, as RFC 9110 requires for If-None-Match.
+func etagMatch(header, tag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ifMatchVersion returns the book version an update requires, from an
+// If-Match header holding a version such as "3", or from the version in the
+// request body. 0 means either version will do. A header and a body that
+// both name a version must agree.
+//
+// An If-Match header holding an entity tag other than a version, such as
+// the ETag a GET sent, is returned as tag for the caller to resolve with
+// taggedVersion.
+func ifMatchVersion(header string, body int) (version int, tag string, err error) {
+	if body < 0 {
+		return 0, "", errors.New("version must be a positive integer")
+	}
+
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return body, "", nil
+	}
+
+	v, err := strconv.Atoi(strings.Trim(header, `"`))
+	if err != nil && strings.HasPrefix(header, `"`) && strings.HasSuffix(header, `"`) && strings.Count(header, `"`) == 2 {
+		return body, header, nil
+	}
+	if err != nil || v < 1 {
+		return 0, "", errors.New(`If-Match must be a book version, such as "3", or the book's ETag`)
+	}
+	if body != 0 && body != v {
+		return 0, "", errors.New("If-Match and version name different versions")
+	}
+
+	return v, "", nil
+}
+
+// bookETags returns the entity tags a GET may send for bk, one for each
+// representation it negotiates.
+func bookETags(bk *Book) ([]string, error) {
+	var tags []string
+	for _, f := range []struct {
+		mediaType string
+		pretty    bool
+	}{
+		{"application/json", false},
+		{"application/json", true},
+		{"application/xml", false},
+	} {
+		body, _, err := encodeEntity(bk, f.mediaType, f.pretty)
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, etag(body))
+	}
+
+	return tags, nil
+}
+
+// taggedVersion returns the version of the book isbn if tag is one of its
+// current entity tags, so an If-Match holding the ETag from a GET protects
+// an update as a version would. A tag that is no longer current, or a body
+// version other than the book's, means the book has changed since it was
+// fetched: ErrVersionConflict.
+func (env *Env) taggedVersion(ctx context.Context, isbn, tag string, body int) (int, error) {
+	bk, err := env.books.Get(readPrimary(ctx), isbn)
+	if err != nil {
+		return 0, err
+	}
+
+	tags, err := bookETags(bk)
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Contains(tags, tag) || body != 0 && body != bk.Version {
+		return 0, ErrVersionConflict
+	}
+
+	return bk.Version, nil
+}
+
+// conflictMessage explains a 409 for an update that required version, or
+// the entity tag tag.
+func conflictMessage(version int, tag string) string {
+	if tag != "" {
+		return fmt.Sprintf("the book has changed since ETag %s", tag)
+	}
+
+	return fmt.Sprintf("the book has changed since version %d", version)
+}
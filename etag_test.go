@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBookByISBNConditional(t *testing.T) {
+	env := Env{books: &mockBookModel{}}
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books/978-1505255607", nil)
+		req = mux.SetURLVars(req, map[string]string{"isbn": "978-1505255607"})
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+
+		http.HandlerFunc(env.bookByISBN).ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	first := get("")
+	tag := first.Header().Get("ETag")
+	if first.Code != 200 || tag == "" {
+		t.Fatalf("expected 200 with an ETag, obtained %v %q", first.Code, tag)
+	}
+
+	second := get(tag)
+	if second.Code != http.StatusNotModified {
+		t.Errorf("\n...expected = %v\n...obtained = %v", http.StatusNotModified, second.Code)
+	}
+	if second.Body.Len() != 0 {
+		t.Errorf("expected an empty body, obtained %q", second.Body.String())
+	}
+	if got := second.Header().Get("ETag"); got != tag {
+		t.Errorf("\n...expected = %v\n...obtained = %v", tag, got)
+	}
+
+	stale := get(`"0000"`)
+	if stale.Code != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, stale.Code)
+	}
+}
+
+func TestBookETags(t *testing.T) {
+	env := Env{books: &mockBookModel{}}
+	bk, _ := env.books.Get(context.Background(), "978-1505255607")
+
+	tags, err := bookETags(bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Whichever representation a GET negotiates, its ETag is one an update
+	// accepts in If-Match.
+	for _, url := range []string{"/v1/books/978-1505255607", "/v1/books/978-1505255607?pretty=true"} {
+		for _, accept := range []string{"", "application/xml"} {
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", url, nil)
+			req = mux.SetURLVars(req, map[string]string{"isbn": "978-1505255607"})
+			req.Header.Set("Accept", accept)
+
+			http.HandlerFunc(env.bookByISBN).ServeHTTP(rec, req)
+
+			if tag := rec.Header().Get("ETag"); !slices.Contains(tags, tag) {
+				t.Errorf("%s, %q: ETag %s is not in %v", url, accept, tag, tags)
+			}
+		}
+	}
+}
+
+func TestETagMatch(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected bool
+	}{
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`*`, true},
+		{`"xyz"`, false},
+		{``, false},
+	}
+
+	for _, tt := range tests {
+		if got := etagMatch(tt.header, `"abc"`); got != tt.expected {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.header, tt.expected, got)
+		}
+	}
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		header   string
+		body     int
+		expected int
+		tag      string
+		err      bool
+	}{
+		{header: "", body: 0, expected: 0},
+		{header: "", body: 3, expected: 3},
+		{header: `"3"`, body: 0, expected: 3},
+		{header: "3", body: 3, expected: 3},
+		{header: "*", body: 0, expected: 0},
+		{header: `"9f86d081884c7d65"`, body: 0, tag: `"9f86d081884c7d65"`},
+		{header: `"9f86d081884c7d65"`, body: 3, expected: 3, tag: `"9f86d081884c7d65"`},
+		{header: `"3"`, body: 4, err: true},
+		{header: `W/"3"`, err: true},
+		{header: `W/"9f86d081884c7d65"`, err: true},
+		{header: `"a", "b"`, err: true},
+		{header: "abc", err: true},
+		{header: `"0"`, err: true},
+		{header: "", body: -1, err: true},
+	}
+
+	for _, tt := range tests {
+		version, tag, err := ifMatchVersion(tt.header, tt.body)
+		if (err != nil) != tt.err {
+			t.Errorf("%q, %d: unexpected error %v", tt.header, tt.body, err)
+		}
+		if !tt.err && (version != tt.expected || tag != tt.tag) {
+			t.Errorf("%q, %d:\n...expected = %v %v\n...obtained = %v %v", tt.header, tt.body, tt.expected, tt.tag, version, tag)
+		}
+	}
+}
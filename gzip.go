@@ -0,0 +1,142 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// gzipMinSize is the smallest response body worth compressing; below it the
+// gzip framing outweighs the savings.
+const gzipMinSize = 1024
+
+// gzipResponse compresses response bodies for clients that send
+// Accept-Encoding: gzip. Bodies under gzipMinSize and responses that already
+// carry a Content-Encoding (such as /metrics) are sent as is.
+func gzipResponse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(gw, r)
+
+		// Not deferred: after a panic, flushing would send a 200 before
+		// recoverPanic can answer with a 500.
+		gw.Close()
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gzipWriter buffers the start of the body until it knows whether the
+// response is large enough to compress.
+type gzipWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	started bool
+	gz      *gzip.Writer
+}
+
+// SetWriteDeadline passes http.ResponseController deadlines through. It has
+// no Unwrap, which would let a Flush bypass the buffer and send the header
+// before the encoding is chosen.
+func (gw *gzipWriter) SetWriteDeadline(t time.Time) error {
+	return http.NewResponseController(gw.ResponseWriter).SetWriteDeadline(t)
+}
+
+// FlushError sends what has been compressed so far, for streamed responses.
+// Until the encoding is chosen there is nothing to send.
+func (gw *gzipWriter) FlushError() error {
+	if !gw.started {
+		return nil
+	}
+	if gw.gz != nil {
+		if err := gw.gz.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+func (gw *gzipWriter) WriteHeader(code int) {
+	if !gw.started {
+		gw.status = code
+	}
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if gw.started {
+		if gw.gz != nil {
+			return gw.gz.Write(p)
+		}
+		return gw.ResponseWriter.Write(p)
+	}
+
+	gw.buf = append(gw.buf, p...)
+	if len(gw.buf) >= gzipMinSize {
+		if err := gw.start(true); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// start sends the header and any buffered body, compressed if compress is
+// set and the response isn't already encoded.
+func (gw *gzipWriter) start(compress bool) error {
+	gw.started = true
+
+	h := gw.Header()
+	if compress && h.Get("Content-Encoding") == "" {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+
+	gw.ResponseWriter.WriteHeader(gw.status)
+	if len(gw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(gw.buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(gw.buf)
+	}
+	gw.buf = nil
+
+	return err
+}
+
+// Close flushes a body that never reached gzipMinSize, uncompressed, or
+// finishes the gzip stream.
+func (gw *gzipWriter) Close() error {
+	if !gw.started {
+		return gw.start(false)
+	}
+	if gw.gz != nil {
+		return gw.gz.Close()
+	}
+
+	return nil
+}
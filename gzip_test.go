@@ -0,0 +1,135 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGzipResponse(t *testing.T) {
+	large := strings.Repeat(`{"ISBN":"978-1503261969","Title":"Emma"},`, 100)
+
+	tests := []struct {
+		name            string
+		acceptEncoding  string
+		body            string
+		encoding        string
+		handlerEncoding string
+	}{
+		{"large body", "gzip, deflate", large, "gzip", ""},
+		{"small body", "gzip", `{"ISBN":"978-1503261969"}`, "", ""},
+		{"no gzip support", "", large, "", ""},
+		{"gzip refused", "gzip;q=0", large, "", ""},
+		{"already encoded", "gzip", large, "br", "br"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := gzipResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.handlerEncoding != "" {
+					w.Header().Set("Content-Encoding", test.handlerEncoding)
+				}
+				w.WriteHeader(http.StatusCreated)
+				io.WriteString(w, test.body[:10])
+				io.WriteString(w, test.body[10:])
+			}))
+
+			req := httptest.NewRequest("GET", "/books", nil)
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusCreated {
+				t.Errorf("\n...expected = %v\n...obtained = %v", http.StatusCreated, rec.Code)
+			}
+			if got := rec.Header().Get("Content-Encoding"); got != test.encoding {
+				t.Errorf("\n...expected = %v\n...obtained = %v", test.encoding, got)
+			}
+
+			body := rec.Body.String()
+			if test.encoding == "gzip" {
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(data)
+			}
+			if body != test.body {
+				t.Errorf("\n...expected = %v\n...obtained = %v", test.body, body)
+			}
+		})
+	}
+}
+
+// deadlineWriter records the write deadline set through it.
+type deadlineWriter struct {
+	*httptest.ResponseRecorder
+	deadline *time.Time
+}
+
+func (w deadlineWriter) SetWriteDeadline(t time.Time) error {
+	*w.deadline = t
+	return nil
+}
+
+func TestWriteDeadlineThroughWrappers(t *testing.T) {
+	deadline := time.Now()
+	var w http.ResponseWriter = deadlineWriter{httptest.NewRecorder(), &deadline}
+	w = &gzipWriter{ResponseWriter: w, status: http.StatusOK}
+	w = &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if !deadline.IsZero() {
+		t.Errorf("\n...expected = no deadline\n...obtained = %v", deadline)
+	}
+}
+
+func TestGzipFlush(t *testing.T) {
+	chunk := strings.Repeat("x", gzipMinSize)
+
+	handler := gzipResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+
+		// Nothing to send before the encoding is chosen.
+		if err := rc.Flush(); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+
+		w.Write([]byte(chunk))
+		if err := rc.Flush(); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	}))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books.json", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	handler.ServeHTTP(rec, req)
+
+	if !rec.Flushed {
+		t.Error("expected the compressed body to be flushed")
+	}
+
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(zr)
+	if string(body) != chunk {
+		t.Errorf("\n...expected = %v bytes\n...obtained = %v bytes", len(chunk), len(body))
+	}
+}
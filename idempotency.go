@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxIdempotencyKeyLen matches the width of idempotency_keys.key.
+const maxIdempotencyKeyLen = 255
+
+// storedResponse is a response saved under an idempotency key, along with a
+// fingerprint of the request that produced it.
+type storedResponse struct {
+	Fingerprint []byte
+	Status      int
+	ContentType string
+	Location    string
+	Body        []byte
+}
+
+// IdempotencyStore keeps responses in the idempotency_keys table for TTL, so
+// every replica can replay them. Keys are scoped to the authenticated
+// subject, so two clients can't collide on, or read, each other's keys.
+// Handle, if set, overrides DB.
+type IdempotencyStore struct {
+	DB     *sql.DB
+	Handle *DBHandle
+	TTL    time.Duration
+}
+
+// Lookup returns the response saved under key, or nil if there is none or it
+// has expired.
+func (s IdempotencyStore) Lookup(ctx context.Context, subject, key string) (*storedResponse, error) {
+	var resp storedResponse
+
+	err := s.Handle.primary(s.DB).QueryRowContext(ctx,
+		"SELECT fingerprint, status, content_type, location, body FROM idempotency_keys WHERE subject=$1 AND key=$2 AND created_at > $3;",
+		subject, key, time.Now().Add(-s.TTL),
+	).Scan(&resp.Fingerprint, &resp.Status, &resp.ContentType, &resp.Location, &resp.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// Save stores resp under key, replacing an expired entry but never a live
+// one: when two requests race, the first response saved is the one replayed.
+func (s IdempotencyStore) Save(ctx context.Context, subject, key string, resp storedResponse) error {
+	now := time.Now()
+
+	_, err := s.Handle.primary(s.DB).ExecContext(ctx, `INSERT INTO idempotency_keys (subject, key, fingerprint, status, content_type, location, body, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (subject, key) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint,
+			status = EXCLUDED.status,
+			content_type = EXCLUDED.content_type,
+			location = EXCLUDED.location,
+			body = EXCLUDED.body,
+			created_at = EXCLUDED.created_at
+		WHERE idempotency_keys.created_at <= $9;`,
+		subject, key, resp.Fingerprint, resp.Status, resp.ContentType, resp.Location, resp.Body, now, now.Add(-s.TTL))
+
+	return err
+}
+
+// run deletes expired keys every interval until ctx is done.
+func (s IdempotencyStore) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			_, err := s.Handle.primary(s.DB).ExecContext(ctx, "DELETE FROM idempotency_keys WHERE created_at <= $1;", now.Add(-s.TTL))
+			if err != nil {
+				slog.ErrorContext(ctx, "purging idempotency keys failed", "error", err)
+			}
+		}
+	}
+}
+
+// idempotencyStore is implemented by IdempotencyStore.
+type idempotencyStore interface {
+	Lookup(ctx context.Context, subject, key string) (*storedResponse, error)
+	Save(ctx context.Context, subject, key string, resp storedResponse) error
+}
+
+// idempotent replays the saved response when a request repeats an
+// Idempotency-Key, instead of running the handler again. Reusing a key for a
+// different request is a 422. Requests without the header, and all requests
+// when store is nil, run as usual.
+//
+// 5xx responses aren't saved, so the client can retry them under the same
+// key. Two concurrent requests with one key both run; the handler must cope
+// with that on its own, as createBook does by rejecting the duplicate ISBN.
+func idempotent(store idempotencyStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" || store == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLen {
+				RespondError(w, 400, "Idempotency-Key must be at most "+strconv.Itoa(maxIdempotencyKeyLen)+" characters")
+				return
+			}
+
+			// Read one byte past the limit so decodeJSON still sees, and
+			// rejects, an oversized body.
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+			if err != nil {
+				RespondError(w, 400, "unable to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			// The query is part of the request too: a dry run mustn't replay
+			// in place of the real thing.
+			target := r.URL.Path
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			sum := sha256.Sum256([]byte(r.Method + " " + target + "\n" + string(body)))
+			subject := subjectFromContext(r.Context())
+
+			saved, err := store.Lookup(r.Context(), subject, key)
+			if err != nil {
+				respondServerError(w, r, err, "idempotency_key", key)
+				return
+			}
+			if saved != nil {
+				if !bytes.Equal(saved.Fingerprint, sum[:]) {
+					RespondError(w, 422, "Idempotency-Key has already been used for a different request")
+					return
+				}
+
+				w.Header().Set("Content-Type", saved.ContentType)
+				if saved.Location != "" {
+					w.Header().Set("Location", saved.Location)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(saved.Status)
+				w.Write(saved.Body)
+				return
+			}
+
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			if rec.status >= 500 {
+				return
+			}
+
+			// Save even if the client has gone away, since its retry is
+			// exactly the request the key exists for.
+			err = store.Save(context.WithoutCancel(r.Context()), subject, key, storedResponse{
+				Fingerprint: sum[:],
+				Status:      rec.status,
+				ContentType: w.Header().Get("Content-Type"),
+				Location:    w.Header().Get("Location"),
+				Body:        rec.body.Bytes(),
+			})
+			if err != nil {
+				logError(r, err, "idempotency_key", key)
+			}
+		})
+	}
+}
+
+// responseRecorder keeps a copy of the status and body written through it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+type mapIdempotencyStore map[string]storedResponse
+
+func (s mapIdempotencyStore) Lookup(ctx context.Context, subject, key string) (*storedResponse, error) {
+	resp, ok := s[subject+" "+key]
+	if !ok {
+		return nil, nil
+	}
+
+	return &resp, nil
+}
+
+func (s mapIdempotencyStore) Save(ctx context.Context, subject, key string, resp storedResponse) error {
+	s[subject+" "+key] = resp
+
+	return nil
+}
+
+// countingBookModel counts Create calls, failing once the ISBN exists, as
+// the database would.
+type countingBookModel struct {
+	mockBookModel
+	created map[string]int
+}
+
+func (m *countingBookModel) Create(ctx context.Context, bk *Book) error {
+	m.created[bk.Isbn]++
+	if m.created[bk.Isbn] > 1 {
+		return &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}
+	}
+
+	return nil
+}
+
+func TestIdempotentCreate(t *testing.T) {
+	const book = `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99"}`
+	const created = `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99","Quantity":0}` + "\n"
+
+	tests := []struct {
+		name     string
+		key      string
+		query    string
+		body     string
+		code     int
+		expected string
+		replayed bool
+	}{
+		{name: "first request", key: "k1", body: book, code: 201, expected: created},
+		{name: "replay", key: "k1", body: book, code: 201, expected: created, replayed: true},
+		{name: "key reused", key: "k1", body: strings.Replace(book, "6.99", "7.99", 1), code: 422, expected: `{"error":{"code":422,"message":"Idempotency-Key has already been used for a different request"}}` + "\n"},
+		{name: "key reused for a dry run", key: "k1", query: "?dry_run=true", body: book, code: 422, expected: `{"error":{"code":422,"message":"Idempotency-Key has already been used for a different request"}}` + "\n"},
+		{name: "new key", key: "k2", body: book, code: 409, expected: `{"error":{"code":409,"message":"a book with ISBN 978-1503290334 already exists"}}` + "\n"},
+		{name: "new key replay", key: "k2", body: book, code: 409, expected: `{"error":{"code":409,"message":"a book with ISBN 978-1503290334 already exists"}}` + "\n", replayed: true},
+	}
+
+	books := &countingBookModel{created: map[string]int{}}
+	env := Env{books: books, idempotency: mapIdempotencyStore{}}
+	h := idempotent(env.idempotency)(http.HandlerFunc(env.createBook))
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/books"+tt.query, strings.NewReader(tt.body))
+		req.Header.Set("Idempotency-Key", tt.key)
+
+		h.ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Body.String())
+		}
+		if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+			t.Errorf("%s: replayed\n...expected = %v\n...obtained = %v", tt.name, tt.replayed, replayed)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, "application/json", ct)
+		}
+		if tt.code == 201 {
+			if loc := rec.Header().Get("Location"); loc != "/v1/books/978-1503290334" {
+				t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, "/v1/books/978-1503290334", loc)
+			}
+		}
+	}
+
+	// Only the first request and the one under a new key reached the model.
+	if n := books.created["978-1503290334"]; n != 2 {
+		t.Errorf("\n...expected = %v creates\n...obtained = %v creates", 2, n)
+	}
+}
+
+func TestIdempotentWithoutKey(t *testing.T) {
+	store := mapIdempotencyStore{}
+	calls := 0
+	h := idempotent(store)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", "/v1/books", strings.NewReader("{}"))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if calls != 2 || len(store) != 0 {
+		t.Errorf("expected both requests to run unrecorded, obtained %d calls and %d saved", calls, len(store))
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := IdempotencyStore{DB: db, TTL: time.Hour}
+	ctx := context.Background()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT fingerprint, status, content_type, location, body FROM idempotency_keys WHERE subject=$1 AND key=$2 AND created_at > $3;")).
+		WithArgs("alice", "k1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"fingerprint", "status", "content_type", "location", "body"}))
+	mock.ExpectExec(regexp.QuoteMeta("ON CONFLICT (subject, key) DO UPDATE SET")).
+		WithArgs("alice", "k1", []byte("sum"), 201, "application/json", "/v1/books/1", []byte("{}"), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT fingerprint").
+		WithArgs("alice", "k1", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"fingerprint", "status", "content_type", "location", "body"}).
+			AddRow([]byte("sum"), 201, "application/json", "/v1/books/1", []byte("{}")))
+
+	resp, err := s.Lookup(ctx, "alice", "k1")
+	if err != nil || resp != nil {
+		t.Fatalf("expected no saved response, obtained %v, %v", resp, err)
+	}
+
+	err = s.Save(ctx, "alice", "k1", storedResponse{Fingerprint: []byte("sum"), Status: 201, ContentType: "application/json", Location: "/v1/books/1", Body: []byte("{}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err = s.Lookup(ctx, "alice", "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp == nil || resp.Status != 201 || resp.Location != "/v1/books/1" || string(resp.Body) != "{}" {
+		t.Errorf("unexpected saved response: %v", resp)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// bookKeys maps Book's JSON keys, lowercased and without underscores, to the
+// keys Book is encoded with. Decoding a book accepts any of "ISBN", "isbn",
+// "PublishedYear", "publishedYear" or "published_year", and so on, while
+// responses keep the original keys.
+var bookKeys = map[string]string{
+	"isbn":          "ISBN",
+	"title":         "Title",
+	"author":        "Author",
+	"genre":         "Genre",
+	"price":         "Price",
+	"quantity":      "Quantity",
+	"publishedyear": "PublishedYear",
+	"version":       "Version",
+}
+
+// canonicalKeys rewrites the keys of the JSON object in data to their
+// bookKeys names. Unrecognized keys are left alone, so a strict decoder
+// still rejects them, and two keys naming the same field are an error
+// rather than one silently winning.
+func canonicalKeys(data []byte) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil || raw == nil {
+		return data, err
+	}
+
+	out := make(map[string]json.RawMessage, len(raw))
+	seen := make(map[string]string, len(raw))
+	for key, v := range raw {
+		name := key
+		if canonical, ok := bookKeys[strings.ToLower(strings.ReplaceAll(key, "_", ""))]; ok {
+			name = canonical
+		}
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("fields %q and %q both set %s", other, key, name)
+		}
+		seen[name] = key
+		out[name] = v
+	}
+
+	return json.Marshal(out)
+}
+
+// decodeStrict decodes data into v, rejecting unknown fields. A custom
+// UnmarshalJSON doesn't inherit DisallowUnknownFields from the decoder that
+// calls it, so it has to ask again.
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode(v)
+}
+
+// UnmarshalJSON accepts the aliases in bookKeys.
+func (bk *Book) UnmarshalJSON(data []byte) error {
+	data, err := canonicalKeys(data)
+	if err != nil {
+		return err
+	}
+
+	// plain has Book's fields but not this method, so decoding into it
+	// doesn't recurse.
+	type plain Book
+
+	return decodeStrict(data, (*plain)(bk))
+}
+
+// UnmarshalJSON accepts the aliases in bookKeys.
+func (p *bookPatch) UnmarshalJSON(data []byte) error {
+	data, err := canonicalKeys(data)
+	if err != nil {
+		return err
+	}
+
+	type plain bookPatch
+
+	return decodeStrict(data, (*plain)(p))
+}
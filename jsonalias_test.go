@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBookJSONAliases(t *testing.T) {
+	expected := Book{Isbn: "978-1503261969", Title: "Emma", Author: "Jane Austen", Genre: "Romance", Price: 944, Quantity: 2, PublishedYear: 1815}
+
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{name: "PascalCase", in: `{"ISBN":"978-1503261969","Title":"Emma","Author":"Jane Austen","Genre":"Romance","Price":"9.44","Quantity":2,"PublishedYear":1815}`},
+		{name: "camelCase", in: `{"isbn":"978-1503261969","title":"Emma","author":"Jane Austen","genre":"Romance","price":"9.44","quantity":2,"publishedYear":1815}`},
+		{name: "snake_case", in: `{"isbn":"978-1503261969","title":"Emma","author":"Jane Austen","genre":"Romance","price":9.44,"quantity":2,"published_year":1815}`},
+	}
+
+	for _, tt := range tests {
+		var bk Book
+
+		if err := json.Unmarshal([]byte(tt.in), &bk); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if bk != expected {
+			t.Errorf("%s:\n...expected = %+v\n...obtained = %+v", tt.name, expected, bk)
+		}
+
+		// Output keeps the original keys whatever the input used.
+		out, _ := json.Marshal(bk)
+		if !strings.Contains(string(out), `"ISBN":"978-1503261969"`) || !strings.Contains(string(out), `"PublishedYear":1815`) {
+			t.Errorf("%s: unexpected output %s", tt.name, out)
+		}
+	}
+}
+
+func TestBookJSONAliasErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		message string
+	}{
+		{name: "unknown field", in: `{"isbn":"978-1503261969","titel":"Emma"}`, message: `unknown field "titel"`},
+		{name: "duplicate field", in: `{"published_year":1815,"PublishedYear":1816}`, message: "both set PublishedYear"},
+	}
+
+	for _, tt := range tests {
+		var bk Book
+
+		err := json.Unmarshal([]byte(tt.in), &bk)
+		if err == nil || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.message, err)
+		}
+	}
+}
+
+func TestBookPatchJSONAliases(t *testing.T) {
+	var patch bookPatch
+
+	if err := json.Unmarshal([]byte(`{"title":"Emma","published_year":0}`), &patch); err != nil {
+		t.Fatal(err)
+	}
+	if patch.Title == nil || *patch.Title != "Emma" || patch.PublishedYear == nil || *patch.PublishedYear != 0 {
+		t.Errorf("unexpected patch: %+v", patch)
+	}
+	if patch.Author != nil || patch.Price != nil {
+		t.Errorf("unexpected patch: %+v", patch)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// setPaginationLinks adds an RFC 8288 Link header with the first, prev, next
+// and last pages of a listing, for clients that page by following headers
+// rather than reading the envelope. The URLs are absolute and keep the
+// request's path, base path included, and its other query parameters.
+func setPaginationLinks(w http.ResponseWriter, r *http.Request, limit, offset, total int) {
+	last := 0
+	if total > 0 {
+		last = (total - 1) / limit * limit
+	}
+
+	links := []string{pageLink(r, "first", limit, 0)}
+	if offset > 0 {
+		links = append(links, pageLink(r, "prev", limit, max(offset-limit, 0)))
+	}
+	if offset+limit < total {
+		links = append(links, pageLink(r, "next", limit, offset+limit))
+	}
+	links = append(links, pageLink(r, "last", limit, last))
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// setCursorLinks is setPaginationLinks for ?after= listings, which only know
+// the first page and, unless this is the last one, the next.
+func setCursorLinks(w http.ResponseWriter, r *http.Request, limit int, next string) {
+	links := []string{cursorLink(r, "first", limit, "")}
+	if next != "" {
+		links = append(links, cursorLink(r, "next", limit, next))
+	}
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+func pageLink(r *http.Request, rel string, limit, offset int) string {
+	q := r.URL.Query()
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("offset", strconv.Itoa(offset))
+
+	return link(r, rel, q)
+}
+
+func cursorLink(r *http.Request, rel string, limit int, after string) string {
+	q := r.URL.Query()
+	q.Set("limit", strconv.Itoa(limit))
+	q.Set("after", after)
+
+	return link(r, rel, q)
+}
+
+func link(r *http.Request, rel string, q url.Values) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawQuery: q.Encode()}
+
+	return fmt.Sprintf("<%s>; rel=%q", u.String(), rel)
+}
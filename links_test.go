@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPaginationLinks(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "?limit=1",
+			expected: `<http://bookstore.test/api/bookstore/v1/books?limit=1&offset=0>; rel="first", <http://bookstore.test/api/bookstore/v1/books?limit=1&offset=1>; rel="next", <http://bookstore.test/api/bookstore/v1/books?limit=1&offset=1>; rel="last"`,
+		},
+		{
+			query:    "?limit=1&offset=1&sort=-title",
+			expected: `<http://bookstore.test/api/bookstore/v1/books?limit=1&offset=0&sort=-title>; rel="first", <http://bookstore.test/api/bookstore/v1/books?limit=1&offset=0&sort=-title>; rel="prev", <http://bookstore.test/api/bookstore/v1/books?limit=1&offset=1&sort=-title>; rel="last"`,
+		},
+		{
+			query:    "?genre=Horror",
+			expected: `<http://bookstore.test/api/bookstore/v1/books?genre=Horror&limit=20&offset=0>; rel="first", <http://bookstore.test/api/bookstore/v1/books?genre=Horror&limit=20&offset=0>; rel="last"`,
+		},
+		{
+			query:    "?after=&limit=1",
+			expected: `<http://bookstore.test/api/bookstore/v1/books?after=&limit=1>; rel="first", <http://bookstore.test/api/bookstore/v1/books?after=978-1503261969&limit=1>; rel="next"`,
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "http://bookstore.test/api/bookstore/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if link := rec.Header().Get("Link"); tt.expected != link {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.query, tt.expected, link)
+		}
+	}
+}
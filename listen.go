@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// listen opens the server's listener: a Unix socket at socketPath when it is
+// set, for sidecars on the same host, otherwise TCP on addr.
+//
+// A socket file left behind by a process that died is removed first. Closing
+// the listener, as srv.Shutdown does, removes the file again.
+func listen(socketPath, addr string) (net.Listener, error) {
+	if socketPath == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	err := removeStaleSocket(socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.Listen("unix", socketPath)
+}
+
+// removeStaleSocket deletes the socket at path unless something is still
+// listening on it. Anything at path that isn't a socket is left alone, and
+// Listen then fails on it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return nil
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+
+	return os.Remove(path)
+}
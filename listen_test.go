@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// socketPath returns a path for a Unix socket in a fresh directory. It avoids
+// t.TempDir, whose paths can exceed the 108-byte limit on socket names.
+func socketPath(t *testing.T) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "bookstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return filepath.Join(dir, "api.sock")
+}
+
+func TestListenSocket(t *testing.T) {
+	path := socketPath(t)
+
+	// A socket file left behind by a previous process.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go serve(srv, ln, "", "")
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://bookstore/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, resp.StatusCode)
+	}
+
+	// A second server can't take over a socket that is in use.
+	if _, err := listen(path, ""); err == nil {
+		t.Error("expected listening on a socket in use to fail")
+	}
+
+	err = srv.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the socket to be removed on shutdown, obtained %v", err)
+	}
+}
+
+func TestListenTCP(t *testing.T) {
+	ln, err := listen("", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	if ln.Addr().Network() != "tcp" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "tcp", ln.Addr().Network())
+	}
+}
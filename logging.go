@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// logLevel is the level of the default logger. It is a LevelVar because the
+// logger is needed before LOG_LEVEL has been read.
+var logLevel = new(slog.LevelVar)
+
+// parseLogLevel reads a LOG_LEVEL value: debug, info, warn or error, in any
+// case. Empty means info.
+func parseLogLevel(s string) (slog.Level, error) {
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be debug, info, warn or error", LOG_LEVEL, s)
+	}
+
+	return level, nil
+}
+
+// sensitiveKeys are substrings of JSON keys, lowercased without underscores
+// or dashes, whose values are never logged.
+var sensitiveKeys = []string{"pass", "secret", "token", "apikey", "authorization"}
+
+// redactJSON returns body for a debug log with the values of sensitive keys,
+// at any depth, replaced. A body that isn't JSON is summarized by its size
+// instead, since there is no telling what it holds.
+func redactJSON(body []byte) string {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Sprintf("[%d bytes, not JSON]", len(body))
+	}
+
+	b, _ := json.Marshal(redactValue(v))
+
+	return string(b)
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, val := range v {
+			if isSensitiveKey(key) {
+				v[key] = "[REDACTED]"
+			} else {
+				v[key] = redactValue(val)
+			}
+		}
+	case []any:
+		for i, val := range v {
+			v[i] = redactValue(val)
+		}
+	}
+
+	return v
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(key))
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// logConfig logs the configuration in effect, after the Vault secret has
+// been merged in, as one line, so a misconfigured deployment shows what it
+// actually read. Secrets are only reported as set or not.
+func logConfig(logger *slog.Logger, c *viper.Viper) {
+	logger.Info("configuration",
+		"port", c.GetString(PORT),
+		"listen_socket", c.GetString(LISTEN_SOCKET),
+		"base_path", c.GetString(BASE_PATH),
+		"log_level", c.GetString(LOG_LEVEL),
+		"read_only", c.GetBool(READ_ONLY),
+		"vault_enabled", c.GetBool(VAULT_ENABLED),
+		"vault_auth_method", c.GetString(VAULT_AUTH_METHOD),
+		"vault_approle_secret_id", maskSecret(c.GetString(VAULT_APPROLE_SECRET_ID)),
+		"vault_kv_version", c.GetInt(VAULT_KV_VERSION),
+		"vault_secret_loaded", vaultSecretReadAt.Load() > 0,
+		"db_host", c.GetString(DB_HOST),
+		"db_port", c.GetString(DB_PORT),
+		"db_name", c.GetString(DB_NAME),
+		"db_user", c.GetString(DB_USER),
+		"db_pass", maskSecret(c.GetString(DB_PASS)),
+		"db_ssl", c.GetString(DB_SSL),
+		"db_read_hosts", c.GetString(DB_READ_HOSTS),
+		"db_max_open", c.GetInt(DB_MAX_OPEN),
+		"db_max_idle", c.GetInt(DB_MAX_IDLE),
+		"db_conn_max_lifetime", c.GetDuration(DB_CONN_MAX_LIFETIME).String(),
+		"db_statement_timeout", c.GetDuration(DB_STATEMENT_TIMEOUT).String(),
+		"db_breaker_threshold", c.GetInt(DB_BREAKER_THRESHOLD),
+		"db_breaker_cooldown", c.GetDuration(DB_BREAKER_COOLDOWN).String(),
+		"cache_backend", c.GetString(CACHE_BACKEND),
+		"redis_password", maskSecret(c.GetString(REDIS_PASSWORD)),
+		"jwt_secret", maskSecret(c.GetString(JWT_SECRET)),
+		"api_key_hashes", maskSecret(c.GetString(API_KEY_HASHES)),
+	)
+}
+
+// maskSecret stands in for a secret in logs: "[REDACTED]" when it is set,
+// empty when it isn't.
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+
+	return "[REDACTED]"
+}
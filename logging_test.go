@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/spf13/viper"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected slog.Level
+		err      bool
+	}{
+		{in: "", expected: slog.LevelInfo},
+		{in: "debug", expected: slog.LevelDebug},
+		{in: "INFO", expected: slog.LevelInfo},
+		{in: "warn", expected: slog.LevelWarn},
+		{in: "error", expected: slog.LevelError},
+		{in: "verbose", err: true},
+	}
+
+	for _, tt := range tests {
+		level, err := parseLogLevel(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: unexpected error %v", tt.in, err)
+		}
+		if !tt.err && level != tt.expected {
+			t.Errorf("%q:\n...expected = %v\n...obtained = %v", tt.in, tt.expected, level)
+		}
+	}
+}
+
+func TestLogLevelSuppressesDebug(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))
+
+	logger.Debug("query", "op", "Get")
+	logger.Info("request")
+	if out := buf.String(); strings.Contains(out, `"msg":"query"`) || !strings.Contains(out, `"msg":"request"`) {
+		t.Errorf("unexpected output at info level: %s", out)
+	}
+
+	buf.Reset()
+	level.Set(slog.LevelDebug)
+
+	logger.Debug("query", "op", "Get")
+	if out := buf.String(); !strings.Contains(out, `"msg":"query"`) {
+		t.Errorf("unexpected output at debug level: %s", out)
+	}
+}
+
+func TestDebugRequestBody(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level})))
+	defer slog.SetDefault(prev)
+
+	decode := func() {
+		body := `{"quantity":2,"token":"abc123","nested":{"DB_PASS":"hunter2"}}`
+		req, _ := http.NewRequest("POST", "/v1/books/978-1505255607/purchase", strings.NewReader(body))
+
+		var dst map[string]any
+		if _, err := decodeJSON(httptest.NewRecorder(), req, &dst); err != nil {
+			t.Fatal(err)
+		}
+		if dst["token"] != "abc123" {
+			t.Errorf("logging changed the decoded body: %v", dst)
+		}
+	}
+
+	// Nothing is logged at info level.
+	decode()
+	if buf.Len() != 0 {
+		t.Errorf("unexpected output at info level: %s", buf.String())
+	}
+
+	level.Set(slog.LevelDebug)
+	decode()
+
+	out := buf.String()
+	if !strings.Contains(out, `"msg":"request body"`) || !strings.Contains(out, `\"quantity\":2`) {
+		t.Errorf("request body not logged: %s", out)
+	}
+	if strings.Contains(out, "abc123") || strings.Contains(out, "hunter2") {
+		t.Errorf("sensitive value logged: %s", out)
+	}
+}
+
+func TestDebugQueryLog(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	m := BookModel{Log: slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: level}))}
+
+	_, done := m.instrument(context.Background(), "Get", "SELECT")
+	done(nil)
+	if buf.Len() != 0 {
+		t.Errorf("unexpected output at info level: %s", buf.String())
+	}
+
+	level.Set(slog.LevelDebug)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	m.DB = db
+
+	mock.ExpectPrepare("SELECT").ExpectQuery().WithArgs("978-1505255607").WillReturnError(sql.ErrNoRows)
+	m.Get(context.Background(), "978-1505255607")
+
+	// The statement is logged without the arguments it ran with.
+	out := buf.String()
+	for _, expected := range []string{
+		`"op":"Get"`,
+		`"verb":"SELECT"`,
+		`"sql":"SELECT ` + bookColumns + ` FROM books WHERE isbn=$1"`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %s at debug level, obtained %s", expected, out)
+		}
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{in: `{"Title":"Emma","api_key":"k"}`, expected: `{"Title":"Emma","api_key":"[REDACTED]"}`},
+		{in: `[{"Password":"p"}]`, expected: `[{"Password":"[REDACTED]"}]`},
+		{in: `not json`, expected: `[8 bytes, not JSON]`},
+	}
+
+	for _, tt := range tests {
+		if got := redactJSON([]byte(tt.in)); got != tt.expected {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.in, tt.expected, got)
+		}
+	}
+}
+
+func TestLogConfigMasksSecrets(t *testing.T) {
+	c := viper.New()
+	c.Set(DB_HOST, "db.internal")
+	c.Set(DB_NAME, "bookstore")
+	c.Set(DB_PASS, "bookstorepassword")
+	c.Set(DB_MAX_OPEN, 20)
+
+	var buf bytes.Buffer
+	logConfig(slog.New(slog.NewJSONHandler(&buf, nil)), c)
+
+	out := buf.String()
+	if strings.Contains(out, "bookstorepassword") {
+		t.Errorf("expected DB_PASS to be masked, obtained %s", out)
+	}
+	for _, expected := range []string{`"db_pass":"[REDACTED]"`, `"db_host":"db.internal"`, `"db_name":"bookstore"`, `"db_max_open":20`, `"jwt_secret":""`} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected %s in %s", expected, out)
+		}
+	}
+	if n := strings.Count(out, "\n"); n != 1 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 1, n)
+	}
+}
@@ -1,311 +1,2445 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	vault "github.com/hashicorp/vault/api"
-	auth "github.com/hashicorp/vault/api/auth/kubernetes"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 	"github.com/spf13/viper"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/time/rate"
 )
 
 const (
-	PORT = "PORT"
+	PORT             = "PORT"
+	LISTEN_SOCKET    = "LISTEN_SOCKET"
+	SHUTDOWN_TIMEOUT = "SHUTDOWN_TIMEOUT"
+	REQUEST_TIMEOUT  = "REQUEST_TIMEOUT"
+	RUN_MIGRATIONS   = "RUN_MIGRATIONS"
+	READ_ONLY        = "READ_ONLY"
+	LOG_LEVEL        = "LOG_LEVEL"
+	BASE_PATH        = "BASE_PATH"
 
+	SERVER_READ_TIMEOUT        = "SERVER_READ_TIMEOUT"
+	SERVER_READ_HEADER_TIMEOUT = "SERVER_READ_HEADER_TIMEOUT"
+	SERVER_WRITE_TIMEOUT       = "SERVER_WRITE_TIMEOUT"
+	SERVER_IDLE_TIMEOUT        = "SERVER_IDLE_TIMEOUT"
+
+	TLS_CERT_FILE     = "TLS_CERT_FILE"
+	TLS_KEY_FILE      = "TLS_KEY_FILE"
+	TLS_REDIRECT_PORT = "TLS_REDIRECT_PORT"
+
+	OTEL_EXPORTER_OTLP_ENDPOINT = "OTEL_EXPORTER_OTLP_ENDPOINT"
+
+	JWT_SECRET  = "JWT_SECRET"
+	JWT_SCOPE   = "JWT_SCOPE"
+	ADMIN_SCOPE = "ADMIN_SCOPE"
+
+	RATE_LIMIT       = "RATE_LIMIT"
+	RATE_LIMIT_BURST = "RATE_LIMIT_BURST"
+
+	API_KEY_HASHES = "API_KEY_HASHES"
+	API_KEY_ROUTES = "API_KEY_ROUTES"
+
+	CORS_ALLOWED_ORIGINS = "CORS_ALLOWED_ORIGINS"
+	CORS_ALLOWED_METHODS = "CORS_ALLOWED_METHODS"
+	CORS_ALLOWED_HEADERS = "CORS_ALLOWED_HEADERS"
+	CORS_MAX_AGE         = "CORS_MAX_AGE"
+
+	VAULT_ENABLED       = "VAULT_ENABLED"
+	VAULT_REQUIRED      = "VAULT_REQUIRED"
 	VAULT_ADDR          = "VAULT_ADDR"
+	VAULT_AUTH_METHOD   = "VAULT_AUTH_METHOD"
 	VAULT_ROLE          = "VAULT_ROLE"
 	VAULT_KV_MOUNT      = "VAULT_KV_MOUNT"
+	VAULT_KV_VERSION    = "VAULT_KV_VERSION"
 	VAULT_BOOKSTORE_ENV = "VAULT_BOOKSTORE_ENV"
+	VAULT_CACHE_FILE    = "VAULT_CACHE_FILE"
 
 	KUBE_SVC_ACCT_TOKEN = "KUBE_SVC_ACCT_TOKEN"
 
+	VAULT_APPROLE_ROLE_ID   = "VAULT_APPROLE_ROLE_ID"
+	VAULT_APPROLE_SECRET_ID = "VAULT_APPROLE_SECRET_ID"
+
 	DB_HOST = "DB_HOST"
 	DB_PORT = "DB_PORT"
 	DB_NAME = "DB_NAME"
 	DB_USER = "DB_USER"
 	DB_PASS = "DB_PASS"
 	DB_SSL  = "DB_SSL"
+
+	DB_READ_HOSTS = "DB_READ_HOSTS"
+
+	DB_MAX_OPEN          = "DB_MAX_OPEN"
+	DB_MAX_IDLE          = "DB_MAX_IDLE"
+	DB_CONN_MAX_LIFETIME = "DB_CONN_MAX_LIFETIME"
+	DB_STATEMENT_TIMEOUT = "DB_STATEMENT_TIMEOUT"
+
+	DB_STARTUP_TIMEOUT = "DB_STARTUP_TIMEOUT"
+
+	DB_RETRY_ATTEMPTS   = "DB_RETRY_ATTEMPTS"
+	DB_RETRY_BASE_DELAY = "DB_RETRY_BASE_DELAY"
+
+	DB_BREAKER_THRESHOLD = "DB_BREAKER_THRESHOLD"
+	DB_BREAKER_COOLDOWN  = "DB_BREAKER_COOLDOWN"
+
+	SLOW_QUERY_MS = "SLOW_QUERY_MS"
+	STRICT_DEDUP  = "STRICT_DEDUP"
+
+	IDEMPOTENCY_TTL = "IDEMPOTENCY_TTL"
+
+	CACHE_BACKEND  = "CACHE_BACKEND"
+	CACHE_SIZE     = "CACHE_SIZE"
+	CACHE_TTL      = "CACHE_TTL"
+	REDIS_ADDR     = "REDIS_ADDR"
+	REDIS_PASSWORD = "REDIS_PASSWORD"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+
+	// dbPingTimeout bounds each startup connectivity check, and
+	// dbStartupDelay is the pause after the first one fails.
+	dbPingTimeout  = 5 * time.Second
+	dbStartupDelay = 250 * time.Millisecond
 )
 
 var (
 	conf *viper.Viper
 )
 
-func init() {
-	conf = viper.New()
-	conf.AutomaticEnv()
+// loadConfig builds the service configuration from the environment and, when
+// VAULT_ENABLED is set, merges in the bookstore secret read from Vault.
+func loadConfig() (*viper.Viper, error) {
+	c := defaultConfig()
+	if !c.GetBool(VAULT_ENABLED) {
+		return c, nil
+	}
 
-	kvMount := conf.GetString(VAULT_KV_MOUNT)
-	bookstoreEnv := conf.GetString(VAULT_BOOKSTORE_ENV)
+	if v := c.GetInt(VAULT_KV_VERSION); v != 1 && v != 2 {
+		return nil, fmt.Errorf("invalid %s %d: must be 1 or 2", VAULT_KV_VERSION, v)
+	}
+	if m := c.GetString(VAULT_AUTH_METHOD); vaultAuthMethods[strings.ToLower(m)] == nil {
+		return nil, fmt.Errorf("invalid %s %q: must be kubernetes or approle", VAULT_AUTH_METHOD, m)
+	}
 
 	client, err := vault.NewClient(vault.DefaultConfig())
 	if err != nil {
-		log.Fatalf("unable to initialize Vault client: %v", err)
+		return nil, fmt.Errorf("unable to initialize Vault client: %w", err)
 	}
+	vaultClient = client
 
-	err = loginVaultKubernetes(client)
+	vaultAuth, err = loginVault(context.Background(), client, c)
 	if err != nil {
-		log.Println("vault login failed: %w", err)
+		slog.Warn("vault login failed", "error", err)
 	}
 
-	secret, err := client.KVv2(kvMount).Get(context.Background(), bookstoreEnv)
+	err = mergeVaultSecret(context.Background(), c, func(ctx context.Context) error {
+		return refreshVaultSecret(ctx, client, c)
+	})
 	if err != nil {
-		log.Fatalf("unable to read secret: %v", err)
+		return nil, err
 	}
 
-	err = conf.MergeConfigMap(secret.Data)
+	return c, nil
+}
+
+// reloadConfig reads the configuration again for /admin/reload. Unlike
+// loadConfig it doesn't log in to Vault: it reads the secret with client,
+// logged in at startup and kept renewed by the renewer, which is nil when
+// Vault is disabled.
+func reloadConfig(client *vault.Client) (*viper.Viper, error) {
+	c := defaultConfig()
+	if client == nil {
+		return c, nil
+	}
+
+	err := mergeVaultSecret(context.Background(), c, func(ctx context.Context) error {
+		return refreshVaultSecret(ctx, client, c)
+	})
 	if err != nil {
-		log.Fatalf("unable to merge secret: %v", err)
+		return nil, err
 	}
+
+	return c, nil
+}
+
+// defaultConfig returns the configuration from the environment, with
+// defaults for what isn't set.
+func defaultConfig() *viper.Viper {
+	c := viper.New()
+	c.AutomaticEnv()
+
+	c.SetDefault(SHUTDOWN_TIMEOUT, 15*time.Second)
+	c.SetDefault(REQUEST_TIMEOUT, 10*time.Second)
+
+	// Connection timeouts, so slow or idle clients can't hold connections
+	// open indefinitely. Headers must arrive within 5s, and a whole body,
+	// up to a 10MB CSV import, within 30s. The write timeout leaves room
+	// past REQUEST_TIMEOUT for the 503 the timeout middleware sends, and
+	// keep-alive connections are closed after two idle minutes.
+	c.SetDefault(SERVER_READ_TIMEOUT, 30*time.Second)
+	c.SetDefault(SERVER_READ_HEADER_TIMEOUT, 5*time.Second)
+	c.SetDefault(SERVER_WRITE_TIMEOUT, 30*time.Second)
+	c.SetDefault(SERVER_IDLE_TIMEOUT, 2*time.Minute)
+
+	// Pool defaults: cap open connections well below Postgres' default
+	// max_connections of 100 so several replicas fit, keep half of them warm,
+	// and recycle connections periodically so load balancer or failover
+	// changes are picked up.
+	c.SetDefault(DB_MAX_OPEN, 20)
+	c.SetDefault(DB_MAX_IDLE, 10)
+	c.SetDefault(DB_CONN_MAX_LIFETIME, 30*time.Minute)
+
+	// Postgres cancels any statement running longer than this, as a backstop
+	// for queries that outlive their request's context.
+	c.SetDefault(DB_STATEMENT_TIMEOUT, 5*time.Second)
+
+	c.SetDefault(DB_STARTUP_TIMEOUT, time.Minute)
+	c.SetDefault(DB_RETRY_ATTEMPTS, 3)
+	c.SetDefault(DB_RETRY_BASE_DELAY, 50*time.Millisecond)
+	c.SetDefault(DB_BREAKER_THRESHOLD, 5)
+	c.SetDefault(DB_BREAKER_COOLDOWN, 10*time.Second)
+	c.SetDefault(SLOW_QUERY_MS, 500)
+	c.SetDefault(STRICT_DEDUP, false)
+	c.SetDefault(IDEMPOTENCY_TTL, 24*time.Hour)
+	c.SetDefault(CACHE_BACKEND, "memory")
+	c.SetDefault(CACHE_SIZE, 1000)
+	c.SetDefault(CACHE_TTL, 30*time.Second)
+
+	c.SetDefault(JWT_SCOPE, "books:write")
+	c.SetDefault(ADMIN_SCOPE, "admin")
+
+	c.SetDefault(RATE_LIMIT_BURST, 20)
+
+	c.SetDefault(CORS_ALLOWED_METHODS, defaultCORSMethods)
+	c.SetDefault(CORS_ALLOWED_HEADERS, defaultCORSHeaders)
+	c.SetDefault(CORS_MAX_AGE, defaultCORSMaxAge.String())
+
+	// With Vault disabled the DB_* settings come straight from the
+	// environment, which is enough to run against a local Postgres.
+	c.SetDefault(VAULT_ENABLED, true)
+	c.SetDefault(VAULT_KV_VERSION, 2)
+	c.SetDefault(VAULT_AUTH_METHOD, "kubernetes")
+
+	return c
 }
 
 func main() {
+	slog.SetDefault(slog.New(requestIDHandler{slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})}))
+
+	var err error
+	conf, err = loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	level, err := parseLogLevel(conf.GetString(LOG_LEVEL))
+	if err != nil {
+		log.Fatal(err)
+	}
+	logLevel.Set(level)
+	logConfig(slog.Default(), conf)
+
 	port := conf.GetString(PORT)
 
-	dbUser := conf.GetString(DB_USER)
-	dbPass := conf.GetString(DB_PASS)
 	dbHost := conf.GetString(DB_HOST)
 	dbPort := conf.GetString(DB_PORT)
-	dbName := conf.GetString(DB_NAME)
-	dbSSL := conf.GetString(DB_SSL)
 
-	dataSourceName := fmt.Sprintf(
-		"postgres://%s:%s@%s:%s/%s?sslmode=%s", dbUser, dbPass, dbHost, dbPort, dbName, dbSSL)
+	// Each pool has its own circuit breaker, so a replica that is down
+	// doesn't fail requests the primary could serve.
+	openDB := func(dsn, name string) (*sql.DB, *circuitBreaker) {
+		db, breaker, err := openPool(conf, dsn, name)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return db, breaker
+	}
+
+	// The primary pool sits behind a handle so /admin/reload can replace
+	// it; db is the pool the startup tasks use.
+	dsn := dataSourceName(conf, dbHost, dbPort)
+	db, breaker := openDB(dsn, "primary")
+	handle := newDBHandle(db, dsn, breaker)
+	defer func() { handle.Get().Close() }()
 
-	db, err := sql.Open("postgres", dataSourceName)
+	// Replicas share the primary's credentials and database name.
+	replicas := &ReplicaPool{}
+	for _, addr := range replicaAddrs(conf) {
+		host, port, _ := net.SplitHostPort(addr)
+		dsn := dataSourceName(conf, host, port)
+		replica, breaker := openDB(dsn, addr)
+		replicas.dbs = append(replicas.dbs, replica)
+		replicas.dsns = append(replicas.dsns, dsn)
+		replicas.breakers = append(replicas.breakers, breaker)
+	}
+	defer replicas.close()
+
+	shutdownTracing, err := setupTracing(context.Background(), conf.GetString(OTEL_EXPORTER_OTLP_ENDPOINT))
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer shutdownTracing(context.Background())
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	metrics := NewMetrics(reg)
+	if vaultClient != nil {
+		reg.MustRegister(vaultSecretAge())
+	}
+	reg.MustRegister(breakerCollector{breakers: func() []*circuitBreaker {
+		return append([]*circuitBreaker{handle.Breaker()}, replicas.Breakers()...)
+	}})
+
+	books := BookModel{
+		Handle:  handle,
+		Metrics: metrics,
+		Retry: RetryPolicy{
+			Attempts:  conf.GetInt(DB_RETRY_ATTEMPTS),
+			BaseDelay: conf.GetDuration(DB_RETRY_BASE_DELAY),
+		},
+		Replicas:    replicas,
+		SlowQuery:   time.Duration(conf.GetInt(SLOW_QUERY_MS)) * time.Millisecond,
+		StrictDedup: conf.GetBool(STRICT_DEDUP),
+	}
+	switch backend := conf.GetString(CACHE_BACKEND); backend {
+	case "memory":
+		if size := conf.GetInt(CACHE_SIZE); size > 0 {
+			books.Cache = newLRUCache(size, conf.GetDuration(CACHE_TTL))
+		}
+	case "redis":
+		rdb := redis.NewClient(&redis.Options{
+			Addr:         conf.GetString(REDIS_ADDR),
+			Password:     conf.GetString(REDIS_PASSWORD),
+			DialTimeout:  time.Second,
+			ReadTimeout:  200 * time.Millisecond,
+			WriteTimeout: 200 * time.Millisecond,
+		})
+		defer rdb.Close()
+		books.Cache = newRedisCache(rdb, conf.GetDuration(CACHE_TTL))
+	case "none":
+	default:
+		log.Fatalf("unknown %s %q: must be memory, redis or none", CACHE_BACKEND, backend)
+	}
+
+	idempotency := IdempotencyStore{Handle: handle, TTL: conf.GetDuration(IDEMPOTENCY_TTL)}
+	go idempotency.run(context.Background(), time.Hour)
 
 	env := &Env{
-		books: BookModel{DB: db},
-		app:   App{DB: db},
+		books:       books,
+		app:         App{Handle: handle, Vault: vaultClient},
+		idempotency: idempotency,
 	}
+	env.readOnly.Store(conf.GetBool(READ_ONLY))
+
+	readOnlySigs := make(chan os.Signal, 1)
+	signal.Notify(readOnlySigs, syscall.SIGUSR1)
+	go env.toggleReadOnly(readOnlySigs)
 
+	// Requests pass through the middleware in this order:
+	//
+	//  1. recoverPanic, outermost, so a panic anywhere turns into a 500.
+	//  2. requestID, so every log line below carries the request's ID.
+	//  3. requestLogger, which also sees requests the router doesn't match.
+	//  4. cors, answering preflights before routing.
+	//  5. metrics, gzip, timeout and prettyJSON, inside the router since
+	//     metrics labels requests with the matched route.
+	//  6. the read-only check, rate limiting, authentication and the JSON
+	//     Content-Type check, on /v1 only.
 	router := mux.NewRouter().StrictSlash(true)
+	router.MethodNotAllowedHandler = methodNotAllowed(router)
+	router.Use(metrics.Middleware)
+	router.Use(gzipResponse)
+	router.Use(timeout(conf.GetDuration(REQUEST_TIMEOUT), exportCSVRoute, exportJSONRoute))
+	router.Use(prettyJSON)
+
+	// Every route lives under BASE_PATH, for ingresses that forward a
+	// subpath without stripping it.
+	basePath, err := parseBasePath(conf.GetString(BASE_PATH))
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec, err := specWithBasePath(openAPISpec, basePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	root := mountBasePath(router, basePath)
+
+	root.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{})).Methods("GET")
+
+	root.HandleFunc("/healthz", env.appHealth).Methods("GET")
+	root.HandleFunc("/readyz", env.appReady).Methods("GET")
+	root.HandleFunc("/version", serveVersion).Methods("GET")
+	root.HandleFunc("/maintenance", env.serveMaintenance).Methods("GET")
+
+	root.HandleFunc("/openapi.json", serveOpenAPI(spec)).Methods("GET")
+	root.HandleFunc("/docs", serveDocs).Methods("GET")
+
+	jwtSecret := conf.GetString(JWT_SECRET)
+	if jwtSecret == "" {
+		slog.Warn("JWT_SECRET is not set, write requests will be rejected")
+	}
+
+	apiKeys, err := parseAPIKeyHashes(conf.GetString(API_KEY_HASHES))
+	if err != nil {
+		log.Fatal(err)
+	}
+	apiKeyRoutes := prefixRoutes(basePath, splitList(conf.GetString(API_KEY_ROUTES)))
+
+	v1 := root.PathPrefix("/v1").Subrouter()
+	v1.Use(env.rejectWrites)
+	if limit := conf.GetFloat64(RATE_LIMIT); limit > 0 {
+		limiter := newRateLimiter(rate.Limit(limit), conf.GetInt(RATE_LIMIT_BURST), apiKeys)
+		// Behind a socket every client shares the proxy's address, so the
+		// proxy's X-Forwarded-For names the client instead.
+		limiter.forwarded = conf.GetString(LISTEN_SOCKET) != ""
+		go limiter.run(context.Background(), 10*time.Minute)
+		v1.Use(limiter.Middleware)
+	}
+	v1.Use(requireAPIKey(apiKeys, apiKeyRoutes))
+	v1.Use(requireJWT([]byte(jwtSecret), conf.GetString(JWT_SCOPE)))
+	v1.Use(requireJSON(importCSVRoute))
+	env.registerV1(v1)
+
+	// Admin routes take their own scope, so a books:write token can't
+	// reload the service.
+	reload := &reloader{
+		load:     func() (*viper.Viper, error) { return reloadConfig(vaultClient) },
+		open:     openPool,
+		ping:     func(ctx context.Context, db *sql.DB) error { return db.PingContext(ctx) },
+		db:       handle,
+		replicas: replicas,
+		grace:    conf.GetDuration(REQUEST_TIMEOUT),
+	}
+	admin := root.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAPIKey(apiKeys, apiKeyRoutes))
+	admin.Use(requireJWT([]byte(jwtSecret), conf.GetString(ADMIN_SCOPE)))
+	admin.HandleFunc("/reload", reload.serveReload).Methods("POST")
+
+	corsMaxAge, err := parseMaxAge(conf.GetString(CORS_MAX_AGE))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	handler := chain(router,
+		recoverPanic(slog.Default()),
+		requestID,
+		requestLogger(slog.Default()),
+		cors(
+			splitList(conf.GetString(CORS_ALLOWED_ORIGINS)),
+			splitList(conf.GetString(CORS_ALLOWED_METHODS)),
+			splitList(conf.GetString(CORS_ALLOWED_HEADERS)),
+			corsMaxAge,
+		),
+	)
+
+	srv := &http.Server{
+		Addr:              fmt.Sprintf(":%s", port),
+		Handler:           otelhttp.NewHandler(handler, "bookstore"),
+		ReadTimeout:       conf.GetDuration(SERVER_READ_TIMEOUT),
+		ReadHeaderTimeout: conf.GetDuration(SERVER_READ_HEADER_TIMEOUT),
+		WriteTimeout:      conf.GetDuration(SERVER_WRITE_TIMEOUT),
+		IdleTimeout:       conf.GetDuration(SERVER_IDLE_TIMEOUT),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if vaultClient != nil {
+		// A reload reads the secret with the same client, so the token
+		// renewed here is the only one the service holds. If the login at
+		// startup failed, vaultAuth is nil and the renewer keeps trying.
+		client, c := vaultClient, conf
+		renewer := &vaultRenewer{
+			newWatcher: func(secret *vault.Secret) (lifetimeWatcher, error) {
+				return client.NewLifetimeWatcher(&vault.LifetimeWatcherInput{Secret: secret})
+			},
+			login: func(ctx context.Context) (*vault.Secret, error) {
+				return loginVault(ctx, client, c)
+			},
+			refresh: func(ctx context.Context) error {
+				return refreshVaultSecret(ctx, client, c)
+			},
+			retryDelay: 10 * time.Second,
+		}
+		go renewer.run(ctx, vaultAuth)
+	}
+
+	certFile, keyFile := conf.GetString(TLS_CERT_FILE), conf.GetString(TLS_KEY_FILE)
+	if (certFile == "") != (keyFile == "") {
+		log.Fatalf("%s and %s must be set together", TLS_CERT_FILE, TLS_KEY_FILE)
+	}
+
+	ln, err := listen(conf.GetString(LISTEN_SOCKET), srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve(srv, ln, certFile, keyFile)
+	}()
+
+	// The server listens while the startup tasks run, so liveness checks
+	// pass, but /readyz answers 503 until they finish.
+	go func() {
+		// sql.Open does not connect, so wait for the database here rather
+		// than failing the first requests, and give up on a bad config.
+		err := waitForDB(context.Background(), db.PingContext, conf.GetDuration(DB_STARTUP_TIMEOUT), dbStartupDelay)
+		if err != nil {
+			log.Fatalf("unable to reach database: %v", err)
+		}
+
+		if conf.GetBool(RUN_MIGRATIONS) {
+			err = runMigrations(context.Background(), db, migrationsFS)
+			if err != nil {
+				log.Fatalf("unable to run migrations: %v", err)
+			}
+		}
+
+		env.started.Store(true)
+		slog.Info("startup complete")
+	}()
+
+	// With TLS on, optionally answer plain HTTP on another port with a
+	// redirect, for clients that still try http:// first.
+	var redirectSrv *http.Server
+	if redirectPort := conf.GetString(TLS_REDIRECT_PORT); certFile != "" && redirectPort != "" {
+		redirectSrv = &http.Server{
+			Addr:              fmt.Sprintf(":%s", redirectPort),
+			Handler:           redirectHTTPS(port),
+			ReadHeaderTimeout: conf.GetDuration(SERVER_READ_HEADER_TIMEOUT),
+			IdleTimeout:       conf.GetDuration(SERVER_IDLE_TIMEOUT),
+		}
+		go func() {
+			errCh <- redirectSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop()
+
+	slog.Info("shutting down, waiting for in-flight requests")
 
-	router.HandleFunc("/healthz", env.appHealth).Methods("GET")
-	router.HandleFunc("/readyz", env.appReady).Methods("GET")
+	// Give in-flight requests the grace period to finish before the
+	// deferred db.Close runs.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.GetDuration(SHUTDOWN_TIMEOUT))
+	defer cancel()
+
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(shutdownCtx)
+	}
 
-	router.HandleFunc("/books", env.booksIndex).Methods("GET")
-	router.HandleFunc("/books", env.createBook).Methods("POST")
-	router.HandleFunc("/books/{isbn}", env.bookByISBN).Methods("GET")
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Error("shutdown failed", "err", err)
+	}
+}
 
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", port), router))
+// registerV1 adds the version 1 book routes to r, which is mounted at /v1.
+// Breaking changes go in a new subrouter rather than here.
+func (env *Env) registerV1(r *mux.Router) {
+	r.HandleFunc("/books", env.booksIndex).Methods("GET")
+	r.Handle("/books", idempotent(env.idempotency)(http.HandlerFunc(env.createBook))).Methods("POST")
+	r.HandleFunc("/books", env.deleteBooks).Methods("DELETE")
+	r.HandleFunc("/books/batch", env.createBooks).Methods("POST")
+	r.HandleFunc("/books.csv", env.exportCSV).Methods("GET").Name(exportCSVRoute)
+	r.HandleFunc("/books.json", env.exportJSON).Methods("GET").Name(exportJSONRoute)
+	r.HandleFunc("/books/import", env.importCSV).Methods("POST").Name(importCSVRoute)
+	r.HandleFunc("/books/{isbn}", env.bookByISBN).Methods("GET", "HEAD")
+	r.HandleFunc("/books/{isbn}", env.updateBook).Methods("PUT")
+	r.HandleFunc("/books/{isbn}", env.patchBook).Methods("PATCH")
+	r.HandleFunc("/books/{isbn}", env.deleteBook).Methods("DELETE")
+	r.HandleFunc("/books/{isbn}/similar", env.similarBooks).Methods("GET")
+	r.HandleFunc("/books/{isbn}/purchase", env.purchaseBook).Methods("POST")
+	r.HandleFunc("/books/{isbn}/stock", env.setStock).Methods("PUT")
+	r.HandleFunc("/genres", env.genresIndex).Methods("GET")
+	r.HandleFunc("/authors", env.authorsIndex).Methods("GET")
+	r.HandleFunc("/stats", env.serveStats).Methods("GET")
 }
 
 type Env struct {
+	// started is set once the database is reachable and migrated; until
+	// then /readyz reports the service as starting.
+	started atomic.Bool
+
+	// readOnly rejects writes with a 503. READ_ONLY sets it at startup and
+	// SIGUSR1 toggles it while running.
+	readOnly atomic.Bool
+
 	app interface {
-		CheckDBConn() error
+		CheckDBConn(ctx context.Context) error
+		CheckVault(ctx context.Context) error
 	}
 	books interface {
-		All() ([]Book, error)
-		Get(isbn string) (*Book, error)
-		Create(book *Book) error
+		List(ctx context.Context, filter BookFilter, limit, offset int, order BookSort) ([]Book, error)
+		ListAfter(ctx context.Context, filter BookFilter, after string, limit int) ([]Book, error)
+		ForEach(ctx context.Context, fn func(Book) error) error
+		Count(ctx context.Context, filter BookFilter) (int, error)
+		Get(ctx context.Context, isbn string) (*Book, error)
+		GetMany(ctx context.Context, isbns []string) ([]Book, error)
+		Exists(ctx context.Context, isbn string) (bool, error)
+		RelatedByAuthor(ctx context.Context, isbn string, limit int) ([]Book, error)
+		Genres(ctx context.Context) ([]string, error)
+		Authors(ctx context.Context, limit, offset int) ([]AuthorCount, int, error)
+		Stats(ctx context.Context) (*BookStats, error)
+		CheckDuplicate(ctx context.Context, book *Book) error
+		Create(ctx context.Context, book *Book) error
+		CreateBatch(ctx context.Context, books []Book) error
+		Import(ctx context.Context, books []Book) ([]error, error)
+		Update(ctx context.Context, isbn string, book *Book) error
+		PartialUpdate(ctx context.Context, isbn string, version int, fields map[string]any) error
+		Purchase(ctx context.Context, isbn string, n int) (int, error)
+		SetStock(ctx context.Context, isbn string, n int) (*Book, error)
+		Delete(ctx context.Context, isbn string) error
+		DeleteMany(ctx context.Context, isbns []string) ([]string, error)
 	}
+	idempotency idempotencyStore
+
+	// stats caches GET /v1/stats for statsTTL.
+	stats statsCache
 }
 
 func (env *Env) appHealth(w http.ResponseWriter, r *http.Request) {
-	err := env.app.CheckDBConn()
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	err := env.app.CheckDBConn(ctx)
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		respondServerError(w, r, err)
+		return
 	}
 
 	Respond(w, http.StatusText(200), 200)
 }
 
+// appReady reports the status of each dependency, responding 503 unless all
+// of them are usable. Vault counts as usable when it is disabled. Until the
+// startup tasks finish it responds 503 without checking anything, so traffic
+// isn't sent to an unmigrated database.
 func (env *Env) appReady(w http.ResponseWriter, r *http.Request) {
-	err := env.app.CheckDBConn()
-	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+	if !env.started.Load() {
+		RespondJSON(w, 503, map[string]string{"reason": "starting"})
+		return
 	}
 
-	Respond(w, http.StatusText(200), 200)
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	code := 200
+	status := map[string]string{"db": "ok", "vault": "ok"}
+
+	if err := env.app.CheckDBConn(ctx); err != nil {
+		logError(r, err, "component", "db")
+		code, status["db"] = 503, "error"
+	}
+
+	err := env.app.CheckVault(ctx)
+	if errors.Is(err, errVaultDisabled) {
+		status["vault"] = "disabled"
+	} else if err != nil {
+		logError(r, err, "component", "vault")
+		code, status["vault"] = 503, "error"
+	}
+
+	RespondJSON(w, code, status)
 }
 
 func (env *Env) booksIndex(w http.ResponseWriter, r *http.Request) {
-	bks, err := env.books.All()
-	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+	if r.URL.Query().Has("isbn") {
+		env.booksByISBNs(w, r)
 		return
 	}
 
-	json.NewEncoder(w).Encode(bks)
-}
+	limit, offset, err := parsePagination(r.URL.Query())
+	if err != nil {
+		RespondError(w, 400, err.Error())
+		return
+	}
 
-func (env *Env) bookByISBN(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	isbn := vars["isbn"]
+	order := parseSort(r.URL.Query().Get("sort"))
 
-	bk, err := env.books.Get(isbn)
+	filter, err := parseFilter(r.URL.Query())
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		RespondError(w, 400, err.Error())
 		return
 	}
 
-	json.NewEncoder(w).Encode(bk)
-}
+	// With ?after= the listing pages by ISBN cursor instead of offset; an
+	// empty value starts from the first book.
+	var bks []Book
+	var next string
 
-func (env *Env) createBook(w http.ResponseWriter, r *http.Request) {
-	var bk Book
+	if r.URL.Query().Has("after") {
+		if r.URL.Query().Has("offset") || r.URL.Query().Has("sort") {
+			RespondError(w, 400, "after cannot be combined with offset or sort")
+			return
+		}
 
-	err := json.NewDecoder(r.Body).Decode(&bk)
+		bks, err = env.books.ListAfter(r.Context(), filter, r.URL.Query().Get("after"), limit)
+		if len(bks) == limit {
+			next = bks[len(bks)-1].Isbn
+		}
+	} else {
+		bks, err = env.books.List(r.Context(), filter, limit, offset, order)
+	}
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(400), 400)
+		respondServerError(w, r, err)
 		return
 	}
 
-	err = env.books.Create(&bk)
+	total, err := env.books.Count(r.Context(), filter)
 	if err != nil {
-		log.Print(err)
-		http.Error(w, http.StatusText(500), 500)
+		respondServerError(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(&bk)
-}
+	if r.URL.Query().Has("after") {
+		setCursorLinks(w, r, limit, next)
+	} else {
+		setPaginationLinks(w, r, limit, offset, total)
+	}
 
-type Book struct {
-	Isbn   string  `json:"ISBN"`
-	Title  string  `json:"Title"`
-	Author string  `json:"Author"`
-	Price  float32 `json:"Price"`
+	writeEntity(w, r, 200, BookPage{Books: bks, Total: total, Limit: limit, Offset: offset, Next: next})
 }
 
-// Create a custom BookModel type which wraps the sql.DB connection pool.
-type BookModel struct {
-	DB *sql.DB
-}
+// booksByISBNs serves ?isbn=a&isbn=b, listing the books with those ISBNs in
+// the order asked for. ISBNs with no book are left out, so the page may be
+// shorter than the list.
+func (env *Env) booksByISBNs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	isbns := q["isbn"]
 
-// Use a method on the custom BookModel type to run the SQL query.
-func (m BookModel) All() ([]Book, error) {
-	stmt, err := m.DB.Prepare("SELECT * FROM books")
-	if err != nil {
-		return nil, err
+	q.Del("pretty")
+	if len(q) > 1 {
+		RespondError(w, 400, "isbn cannot be combined with other parameters")
+		return
+	}
+	if len(isbns) > maxPageLimit {
+		RespondError(w, 400, fmt.Sprintf("at most %d isbn values may be given", maxPageLimit))
+		return
+	}
+
+	for i, isbn := range isbns {
+		isbns[i] = lookupISBN(isbn)
 	}
-	defer stmt.Close()
 
-	rows, err := stmt.Query()
+	bks, err := env.books.GetMany(r.Context(), isbns)
 	if err != nil {
-		return nil, err
+		respondServerError(w, r, err)
+		return
 	}
-	defer rows.Close()
 
-	var bks []Book
+	writeEntity(w, r, 200, BookPage{Books: bks, Total: len(bks), Limit: len(isbns)})
+}
 
-	for rows.Next() {
-		var bk Book
+// parsePagination reads the limit and offset query parameters, applying the
+// default page size and capping the limit at maxPageLimit.
+func parsePagination(q url.Values) (limit, offset int, err error) {
+	limit = defaultPageLimit
 
-		err := rows.Scan(&bk.Isbn, &bk.Title, &bk.Author, &bk.Price)
-		if err != nil {
-			return nil, err
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("limit must be a positive integer")
 		}
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
 
-		bks = append(bks, bk)
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
 	}
-	if err = rows.Err(); err != nil {
-		return nil, err
+
+	return limit, offset, nil
+}
+
+// sortColumns maps the values accepted by the sort query parameter to
+// columns. Column names cannot be parameterized, so only these are allowed.
+var sortColumns = map[string]string{
+	"isbn":   "isbn",
+	"title":  "title",
+	"author": "author",
+	"price":  "price",
+}
+
+// BookSort is a validated ordering for book listings.
+type BookSort struct {
+	Column string
+	Desc   bool
+}
+
+// parseSort parses a sort query parameter such as "price" or "-title" (for
+// descending). Unknown columns fall back to ordering by ISBN ascending.
+func parseSort(v string) BookSort {
+	desc := strings.HasPrefix(v, "-")
+
+	col, ok := sortColumns[strings.TrimPrefix(v, "-")]
+	if !ok {
+		return BookSort{Column: "isbn"}
 	}
 
-	return bks, nil
+	return BookSort{Column: col, Desc: desc}
 }
 
-// Use a method on the custom BookModel type to run the SQL query.
-func (m BookModel) Get(isbn string) (*Book, error) {
-	var bk Book
-	stmt, err := m.DB.Prepare("SELECT * FROM books WHERE isbn=$1;")
-	if err != nil {
-		return nil, err
+// orderBy renders the ORDER BY clause, re-checking the column against the
+// allowlist and breaking ties by ISBN so pages are stable.
+func (s BookSort) orderBy() string {
+	col, ok := sortColumns[s.Column]
+	if !ok {
+		col = "isbn"
 	}
-	defer stmt.Close()
 
-	err = stmt.QueryRow(isbn).Scan(&bk.Isbn, &bk.Title, &bk.Author, &bk.Price)
-	if err != nil {
-		return nil, err
+	dir := "ASC"
+	if s.Desc {
+		dir = "DESC"
 	}
 
-	return &bk, nil
+	if col == "isbn" {
+		return "ORDER BY isbn " + dir
+	}
+
+	return fmt.Sprintf("ORDER BY %s %s, isbn ASC", col, dir)
 }
 
-func (m BookModel) Create(bk *Book) error {
-	stmt, err := m.DB.Prepare("INSERT INTO books (isbn, title, author, price) VALUES ($1, $2, $3, $4);")
-	if err != nil {
-		return err
+// BookFilter narrows a book listing. Empty fields don't filter.
+type BookFilter struct {
+	// Query matches books whose title or author contains it, ignoring case.
+	Query string
+	// Author matches books by this author exactly, ignoring case.
+	Author string
+	// Genre matches books in this genre exactly, ignoring case.
+	Genre string
+	// MinPrice and MaxPrice bound the price, inclusively.
+	MinPrice *Price
+	MaxPrice *Price
+	// YearFrom and YearTo bound the published year, inclusively. Books with
+	// no known year never match.
+	YearFrom int
+	YearTo   int
+}
+
+// parseFilter reads the q, author, min_price and max_price query parameters.
+func parseFilter(q url.Values) (BookFilter, error) {
+	filter := BookFilter{
+		Query:  q.Get("q"),
+		Author: strings.TrimSpace(q.Get("author")),
+		Genre:  strings.TrimSpace(q.Get("genre")),
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(bk.Isbn, bk.Title, bk.Author, bk.Price)
-	if err != nil {
-		return err
+	for _, p := range []struct {
+		name string
+		dst  **Price
+	}{
+		{"min_price", &filter.MinPrice},
+		{"max_price", &filter.MaxPrice},
+	} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+
+		price, err := ParsePrice(v)
+		if err != nil {
+			return BookFilter{}, fmt.Errorf("%s must be a decimal with at most two fractional digits", p.name)
+		}
+		*p.dst = &price
 	}
 
-	return nil
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		return BookFilter{}, errors.New("min_price must not be greater than max_price")
+	}
+
+	for _, p := range []struct {
+		name string
+		dst  *int
+	}{
+		{"year_from", &filter.YearFrom},
+		{"year_to", &filter.YearTo},
+	} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+
+		year, err := strconv.Atoi(v)
+		if err != nil || year < minPublishedYear || year > 9999 {
+			return BookFilter{}, fmt.Errorf("%s must be a four-digit year", p.name)
+		}
+		*p.dst = year
+	}
+
+	if filter.YearFrom != 0 && filter.YearTo != 0 && filter.YearFrom > filter.YearTo {
+		return BookFilter{}, errors.New("year_from must not be greater than year_to")
+	}
+
+	return filter, nil
 }
 
-func loginVaultKubernetes(client *vault.Client) error {
-	vaultRole := conf.GetString(VAULT_ROLE)
-	kubeToken := conf.GetString(KUBE_SVC_ACCT_TOKEN)
+// where renders the WHERE clause for the filter, with placeholders numbered
+// from $1, and the arguments to bind to them.
+func (f BookFilter) where() (string, []any) {
+	var conds []string
+	var args []any
 
-	k8sAuth, err := auth.NewKubernetesAuth(
-		vaultRole,
-		auth.WithServiceAccountTokenPath(kubeToken),
-	)
-	if err != nil {
-		return fmt.Errorf("unable to initialize Kubernetes auth method: %w", err)
+	if f.Query != "" {
+		args = append(args, f.Query)
+		conds = append(conds, fmt.Sprintf("(title ILIKE '%%' || $%[1]d || '%%' OR author ILIKE '%%' || $%[1]d || '%%')", len(args)))
+	}
+	if f.Author != "" {
+		args = append(args, f.Author)
+		conds = append(conds, fmt.Sprintf("lower(author) = lower($%d)", len(args)))
+	}
+	if f.Genre != "" {
+		args = append(args, f.Genre)
+		conds = append(conds, fmt.Sprintf("lower(genre) = lower($%d)", len(args)))
 	}
 
-	authInfo, err := client.Auth().Login(context.Background(), k8sAuth)
-	if err != nil {
-		return fmt.Errorf("unable to log in with Kubernetes auth: %w", err)
+	switch {
+	case f.MinPrice != nil && f.MaxPrice != nil:
+		args = append(args, *f.MinPrice, *f.MaxPrice)
+		conds = append(conds, fmt.Sprintf("price BETWEEN $%d AND $%d", len(args)-1, len(args)))
+	case f.MinPrice != nil:
+		args = append(args, *f.MinPrice)
+		conds = append(conds, fmt.Sprintf("price >= $%d", len(args)))
+	case f.MaxPrice != nil:
+		args = append(args, *f.MaxPrice)
+		conds = append(conds, fmt.Sprintf("price <= $%d", len(args)))
+	}
+
+	switch {
+	case f.YearFrom != 0 && f.YearTo != 0:
+		args = append(args, f.YearFrom, f.YearTo)
+		conds = append(conds, fmt.Sprintf("published_year BETWEEN $%d AND $%d", len(args)-1, len(args)))
+	case f.YearFrom != 0:
+		args = append(args, f.YearFrom)
+		conds = append(conds, fmt.Sprintf("published_year >= $%d", len(args)))
+	case f.YearTo != 0:
+		// Unknown years are stored as 0, so bound from below too.
+		args = append(args, f.YearTo)
+		conds = append(conds, fmt.Sprintf("published_year BETWEEN 1 AND $%d", len(args)))
 	}
-	if authInfo == nil {
-		return fmt.Errorf("no auth info was returned after login")
+
+	if len(conds) == 0 {
+		return "", nil
 	}
 
-	return nil
+	return "WHERE " + strings.Join(conds, " AND "), args
 }
 
-func Respond(w http.ResponseWriter, text string, code int) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(code)
-	fmt.Fprintln(w, text)
+// isbnVar returns the {isbn} path variable in the form books are stored
+// under, so an ISBN-10 or any hyphenation of the ISBN-13 finds the book.
+func isbnVar(r *http.Request) string {
+	return lookupISBN(mux.Vars(r)["isbn"])
 }
 
-type App struct {
-	DB *sql.DB
-}
+func (env *Env) bookByISBN(w http.ResponseWriter, r *http.Request) {
+	isbn := isbnVar(r)
 
-// Use a method on the custom BookModel type to run the SQL query.
-func (a App) CheckDBConn() error {
-	rows, err := a.DB.Query("SELECT 1")
+	// An ISBN that can't exist is the client's mistake, not a missing book,
+	// and needn't cost a query.
+	err := validateISBN(isbn)
 	if err != nil {
-		return err
+		if r.Method == http.MethodHead {
+			w.WriteHeader(400)
+			return
+		}
+		RespondError(w, 400, err.Error())
+		return
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var health any
-
-		err := rows.Scan(&health)
-		if err != nil {
-			return err
+	bk, err := env.books.Get(r.Context(), isbn)
+	if errors.Is(err, ErrBookNotFound) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(404)
+			return
 		}
+		RespondError(w, 404, http.StatusText(404))
+		return
 	}
-	if err = rows.Err(); err != nil {
-		return err
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
 	}
 
-	return nil
+	body, contentType, err := marshalEntity(r, bk)
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
+	}
+
+	tag := etag(body)
+	w.Header().Set("ETag", tag)
+	w.Header().Add("Vary", "Accept")
+
+	if etagMatch(r.Header.Get("If-None-Match"), tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+
+	// HEAD answers with the headers a GET would send, so clients can check
+	// that a book exists and fetch its ETag without the body.
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(200)
+		return
+	}
+
+	w.Write(body)
+}
+
+// similarBooks lists other books by the author of the given ISBN. An unknown
+// ISBN, like an author with a single book, gets an empty list.
+func (env *Env) similarBooks(w http.ResponseWriter, r *http.Request) {
+	isbn := isbnVar(r)
+
+	limit, _, err := parsePagination(r.URL.Query())
+	if err != nil {
+		RespondError(w, 400, err.Error())
+		return
+	}
+
+	bks, err := env.books.RelatedByAuthor(r.Context(), isbn, limit)
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
+	}
+	if bks == nil {
+		bks = []Book{}
+	}
+
+	RespondJSON(w, 200, bks)
+}
+
+// genresIndex lists every genre in the catalogue, in alphabetical order.
+func (env *Env) genresIndex(w http.ResponseWriter, r *http.Request) {
+	genres, err := env.books.Genres(r.Context())
+	if err != nil {
+		respondServerError(w, r, err)
+		return
+	}
+	if genres == nil {
+		genres = []string{}
+	}
+
+	RespondJSON(w, 200, genres)
+}
+
+func (env *Env) createBook(w http.ResponseWriter, r *http.Request) {
+	var dryRun bool
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			RespondError(w, 400, "dry_run must be true or false")
+			return
+		}
+	}
+
+	var bk Book
+
+	code, err := decodeJSON(w, r, &bk)
+	if err != nil {
+		RespondError(w, code, err.Error())
+		return
+	}
+
+	err = validateBook(&bk)
+	if err != nil {
+		RespondJSON(w, 422, err)
+		return
+	}
+
+	exists, err := env.books.Exists(r.Context(), bk.Isbn)
+	if err != nil {
+		respondServerError(w, r, err, "isbn", bk.Isbn)
+		return
+	}
+
+	if exists {
+		RespondError(w, 409, fmt.Sprintf("a book with ISBN %s already exists", bk.Isbn))
+		return
+	}
+
+	// A dry run stops short of the insert and shows the book as it would
+	// be saved, so integrators can check payloads against the real rules.
+	if dryRun {
+		err = env.books.CheckDuplicate(r.Context(), &bk)
+		var dup *DuplicateBookError
+		if errors.As(err, &dup) {
+			RespondError(w, 409, fmt.Sprintf("a book with this title and author already exists with ISBN %s", dup.Isbn))
+			return
+		}
+		if err != nil {
+			respondServerError(w, r, err, "isbn", bk.Isbn)
+			return
+		}
+
+		bk.Version = 1
+		writeEntity(w, r, 200, &bk)
+		return
+	}
+
+	err = env.books.Create(r.Context(), &bk)
+	// The unique constraint still catches a book created since the check.
+	if isUniqueViolation(err) {
+		RespondError(w, 409, fmt.Sprintf("a book with ISBN %s already exists", bk.Isbn))
+		return
+	}
+	var dup *DuplicateBookError
+	if errors.As(err, &dup) {
+		RespondError(w, 409, fmt.Sprintf("a book with this title and author already exists with ISBN %s", dup.Isbn))
+		return
+	}
+	if err != nil {
+		respondServerError(w, r, err, "isbn", bk.Isbn)
+		return
+	}
+
+	// r.URL.Path keeps the base path and /v1 prefix, so Location stays on the
+	// same mount and version.
+	w.Header().Set("Location", path.Join(r.URL.Path, url.PathEscape(bk.Isbn)))
+	writeEntity(w, r, 201, &bk)
+}
+
+// batchValidationError identifies which book in a batch failed validation.
+type batchValidationError struct {
+	Index int `json:"index"`
+	*ValidationError
+}
+
+func (env *Env) createBooks(w http.ResponseWriter, r *http.Request) {
+	var bks []Book
+
+	code, err := decodeJSON(w, r, &bks)
+	if err != nil {
+		RespondError(w, code, err.Error())
+		return
+	}
+
+	if len(bks) == 0 {
+		RespondError(w, 400, "batch must contain at least one book")
+		return
+	}
+
+	for i := range bks {
+		var verr *ValidationError
+
+		if errors.As(validateBook(&bks[i]), &verr) {
+			RespondJSON(w, 422, batchValidationError{Index: i, ValidationError: verr})
+			return
+		}
+	}
+
+	err = env.books.CreateBatch(r.Context(), bks)
+	if isUniqueViolation(err) {
+		RespondError(w, 409, "one or more books in the batch already exist")
+		return
+	}
+	var dup *DuplicateBookError
+	if errors.As(err, &dup) {
+		RespondError(w, 409, fmt.Sprintf("a book in the batch has the same title and author as ISBN %s", dup.Isbn))
+		return
+	}
+	if err != nil {
+		respondServerError(w, r, err)
+		return
+	}
+
+	RespondJSON(w, 200, struct {
+		Inserted int `json:"inserted"`
+	}{len(bks)})
+}
+
+func (env *Env) updateBook(w http.ResponseWriter, r *http.Request) {
+	isbn := isbnVar(r)
+
+	var bk Book
+
+	code, err := decodeJSON(w, r, &bk)
+	if err != nil {
+		RespondError(w, code, err.Error())
+		return
+	}
+
+	// The path is authoritative; any ISBN in the body is ignored.
+	bk.Isbn = isbn
+
+	err = validateBook(&bk)
+	if err != nil {
+		RespondJSON(w, 422, err)
+		return
+	}
+
+	version, tag, err := ifMatchVersion(r.Header.Get("If-Match"), bk.Version)
+	if err != nil {
+		RespondError(w, 400, err.Error())
+		return
+	}
+
+	if tag != "" {
+		version, err = env.taggedVersion(r.Context(), isbn, tag, version)
+	}
+	if err == nil {
+		bk.Version = version
+		err = env.books.Update(r.Context(), isbn, &bk)
+	}
+	if errors.Is(err, ErrBookNotFound) {
+		RespondError(w, 404, http.StatusText(404))
+		return
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		RespondError(w, 409, conflictMessage(version, tag))
+		return
+	}
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
+	}
+
+	writeEntity(w, r, 200, &bk)
+}
+
+// bookPatch holds the fields a PATCH request may change; nil fields are left
+// untouched.
+type bookPatch struct {
+	Title  *string `json:"Title"`
+	Author *string `json:"Author"`
+	Genre  *string `json:"Genre"`
+	Price  *Price  `json:"Price"`
+	// PublishedYear may be set to 0 to clear the year.
+	PublishedYear *int `json:"PublishedYear"`
+	// Version, if set, must be the book's current version.
+	Version int `json:"Version"`
+}
+
+func (env *Env) patchBook(w http.ResponseWriter, r *http.Request) {
+	isbn := isbnVar(r)
+
+	var patch bookPatch
+
+	code, err := decodeJSON(w, r, &patch)
+	if err != nil {
+		RespondError(w, code, err.Error())
+		return
+	}
+
+	if err := validatePatch(&patch); err != nil {
+		RespondJSON(w, 422, err)
+		return
+	}
+
+	fields := map[string]any{}
+	if patch.Title != nil {
+		fields["title"] = *patch.Title
+	}
+	if patch.Author != nil {
+		fields["author"] = *patch.Author
+	}
+	if patch.Genre != nil {
+		fields["genre"] = *patch.Genre
+	}
+	if patch.Price != nil {
+		fields["price"] = *patch.Price
+	}
+	if patch.PublishedYear != nil {
+		fields["published_year"] = *patch.PublishedYear
+	}
+
+	if len(fields) == 0 {
+		RespondError(w, 400, "patch must set at least one field")
+		return
+	}
+
+	version, tag, err := ifMatchVersion(r.Header.Get("If-Match"), patch.Version)
+	if err != nil {
+		RespondError(w, 400, err.Error())
+		return
+	}
+
+	if tag != "" {
+		version, err = env.taggedVersion(r.Context(), isbn, tag, version)
+	}
+	if err == nil {
+		err = env.books.PartialUpdate(r.Context(), isbn, version, fields)
+	}
+	if errors.Is(err, ErrBookNotFound) {
+		RespondError(w, 404, http.StatusText(404))
+		return
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		RespondError(w, 409, conflictMessage(version, tag))
+		return
+	}
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
+	}
+
+	// Read the patched row back from the primary, as a replica may not have
+	// it yet.
+	bk, err := env.books.Get(readPrimary(r.Context()), isbn)
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
+	}
+
+	writeEntity(w, r, 200, bk)
+}
+
+// deleteBooks deletes the books whose ISBNs are listed in the body, all in
+// one transaction, reporting how many were deleted and how many had no book.
+func (env *Env) deleteBooks(w http.ResponseWriter, r *http.Request) {
+	var isbns []string
+
+	code, err := decodeJSON(w, r, &isbns)
+	if err != nil {
+		RespondError(w, code, err.Error())
+		return
+	}
+
+	if len(isbns) == 0 {
+		RespondError(w, 400, "body must list at least one ISBN")
+		return
+	}
+
+	// A repeated ISBN, in whatever form, is only deleted, or missing, once.
+	unique := make(map[string]bool, len(isbns))
+	for i, isbn := range isbns {
+		isbns[i] = lookupISBN(isbn)
+		unique[isbns[i]] = true
+	}
+
+	deleted, err := env.books.DeleteMany(r.Context(), isbns)
+	if err != nil {
+		respondServerError(w, r, err)
+		return
+	}
+
+	RespondJSON(w, 200, struct {
+		Deleted int `json:"deleted"`
+		Missing int `json:"missing"`
+	}{len(deleted), len(unique) - len(deleted)})
+}
+
+func (env *Env) deleteBook(w http.ResponseWriter, r *http.Request) {
+	isbn := isbnVar(r)
+
+	err := env.books.Delete(r.Context(), isbn)
+	if errors.Is(err, ErrBookNotFound) {
+		RespondError(w, 404, http.StatusText(404))
+		return
+	}
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
+	}
+
+	w.WriteHeader(204)
+}
+
+// purchaseRequest is the body of POST /books/{isbn}/purchase.
+type purchaseRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// purchaseBook sells copies of a book, responding with the stock left. A
+// purchase the stock can't cover is a 409 and leaves the stock untouched.
+func (env *Env) purchaseBook(w http.ResponseWriter, r *http.Request) {
+	isbn := isbnVar(r)
+
+	var req purchaseRequest
+
+	code, err := decodeJSON(w, r, &req)
+	if err != nil {
+		RespondError(w, code, err.Error())
+		return
+	}
+	if req.Quantity < 1 {
+		RespondJSON(w, 422, &FieldError{Field: "quantity", Message: "must be at least 1"})
+		return
+	}
+
+	remaining, err := env.books.Purchase(r.Context(), isbn, req.Quantity)
+	if errors.Is(err, ErrBookNotFound) {
+		RespondError(w, 404, http.StatusText(404))
+		return
+	}
+	if errors.Is(err, ErrInsufficientStock) {
+		RespondError(w, 409, "not enough copies in stock")
+		return
+	}
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
+	}
+
+	RespondJSON(w, 200, map[string]int{"remaining": remaining})
+}
+
+// stockRequest is the body of PUT /books/{isbn}/stock.
+type stockRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+// setStock sets the number of copies in stock, as counted by staff, and
+// responds with the updated book. Unlike a purchase it replaces the quantity
+// outright, so repeating the request is harmless.
+func (env *Env) setStock(w http.ResponseWriter, r *http.Request) {
+	isbn := isbnVar(r)
+
+	var req stockRequest
+
+	code, err := decodeJSON(w, r, &req)
+	if err != nil {
+		RespondError(w, code, err.Error())
+		return
+	}
+	if req.Quantity < 0 {
+		RespondJSON(w, 422, &FieldError{Field: "quantity", Message: "must not be negative"})
+		return
+	}
+
+	bk, err := env.books.SetStock(r.Context(), isbn, req.Quantity)
+	if errors.Is(err, ErrBookNotFound) {
+		RespondError(w, 404, http.StatusText(404))
+		return
+	}
+	if err != nil {
+		respondServerError(w, r, err, "isbn", isbn)
+		return
+	}
+
+	writeEntity(w, r, 200, bk)
+}
+
+// logError logs a failed request with its method and path, plus any extra
+// key/value pairs such as the ISBN.
+func logError(r *http.Request, err error, args ...any) {
+	args = append([]any{"method", r.Method, "path", r.URL.Path, "err", err}, args...)
+	if sub := subjectFromContext(r.Context()); sub != "" {
+		args = append(args, "subject", sub)
+	}
+	slog.ErrorContext(r.Context(), "request failed", args...)
+}
+
+// respondServerError logs err and responds with a 500, or with a 503 when
+// the database is unavailable, since retrying later may then succeed.
+func respondServerError(w http.ResponseWriter, r *http.Request, err error, args ...any) {
+	logError(r, err, args...)
+
+	if errors.Is(err, ErrDBUnavailable) {
+		RespondError(w, 503, ErrDBUnavailable.Error())
+		return
+	}
+	RespondError(w, 500, http.StatusText(500))
+}
+
+// isUniqueViolation reports whether err wraps a Postgres unique_violation,
+// e.g. inserting an ISBN that already exists.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+var (
+	// ErrBookNotFound is returned by BookModel methods when no book matches the ISBN.
+	ErrBookNotFound = errors.New("book not found")
+
+	// ErrBookExists is reported by Import for a book whose ISBN is already
+	// stored.
+	ErrBookExists = errors.New("a book with this ISBN already exists")
+
+	// ErrInsufficientStock is returned when a book has fewer copies in stock
+	// than requested.
+	ErrInsufficientStock = errors.New("insufficient stock")
+
+	// ErrVersionConflict is returned when an update names a version of the
+	// book that is no longer current.
+	ErrVersionConflict = errors.New("version conflict")
+
+	// ErrDBUnavailable is returned when there is no database pool to use,
+	// such as when startup couldn't configure one.
+	ErrDBUnavailable = errors.New("database unavailable")
+)
+
+// DuplicateBookError is returned by Create, with StrictDedup set, when a book
+// with the same title and author is already stored under Isbn.
+type DuplicateBookError struct {
+	Isbn string
+}
+
+func (e *DuplicateBookError) Error() string {
+	return "a book with the same title and author exists with ISBN " + e.Isbn
+}
+
+type Book struct {
+	Isbn     string `json:"ISBN" xml:"ISBN"`
+	Title    string `json:"Title" xml:"Title"`
+	Author   string `json:"Author" xml:"Author"`
+	Genre    string `json:"Genre" xml:"Genre"`
+	Price    Price  `json:"Price" xml:"Price"`
+	Quantity int    `json:"Quantity" xml:"Quantity"`
+	// PublishedYear is 0 when the year is unknown.
+	PublishedYear int `json:"PublishedYear,omitempty" xml:"PublishedYear,omitempty"`
+	// Version starts at 1 and goes up with each PUT or PATCH. Sent back with
+	// an update, it must still be current, so edits can't be lost.
+	Version int `json:"Version,omitempty" xml:"Version,omitempty"`
+}
+
+// BookPage is the envelope returned by the book list endpoint.
+type BookPage struct {
+	Books  []Book `json:"books" xml:"books>Book"`
+	Total  int    `json:"total" xml:"total"`
+	Limit  int    `json:"limit" xml:"limit"`
+	Offset int    `json:"offset" xml:"offset"`
+	// Next is the cursor for the following page in ?after= mode, empty on
+	// the last page.
+	Next string `json:"next,omitempty" xml:"next,omitempty"`
+}
+
+// bookColumns lists the columns every book query selects, in the order
+// queryBooks and Get scan them, so adding a column to the table doesn't
+// break existing reads.
+const bookColumns = "isbn, title, author, genre, price, quantity, published_year, version"
+
+// Create a custom BookModel type which wraps the sql.DB connection pool.
+// Handle, if set, overrides DB so a reload can replace the pool.
+//
+// Cache, if set, serves Get without a query. Every method that writes a book
+// evicts it, whether or not the write succeeds.
+type BookModel struct {
+	DB      *sql.DB
+	Handle  *DBHandle
+	Metrics *Metrics
+	Retry   RetryPolicy
+	Cache   BookCache
+
+	// Replicas serve List, Get and the other reads; writes always go to DB.
+	Replicas *ReplicaPool
+
+	// SlowQuery is how long an operation may take before it's logged as a
+	// warning to Log; zero disables the log.
+	SlowQuery time.Duration
+	Log       *slog.Logger
+
+	// StrictDedup makes Create refuse a book whose title and author, ignoring
+	// case, match one already stored under another ISBN.
+	StrictDedup bool
+}
+
+// primary returns the pool for writes and for reads that must see them.
+func (m BookModel) primary() *sql.DB {
+	return m.Handle.primary(m.DB)
+}
+
+// evict drops isbn from the cache, if there is one.
+func (m BookModel) evict(ctx context.Context, isbn string) {
+	if m.Cache != nil {
+		m.Cache.Delete(ctx, isbn)
+	}
+}
+
+// Use a method on the custom BookModel type to run the SQL query.
+func (m BookModel) List(ctx context.Context, filter BookFilter, limit, offset int, order BookSort) (_ []Book, err error) {
+	ctx, done := m.instrument(ctx, "List", "SELECT")
+	defer func() { done(err) }()
+
+	where, args := filter.where()
+	args = append(args, limit, offset)
+
+	return m.queryBooks(ctx, fmt.Sprintf("SELECT "+bookColumns+" FROM books %s %s LIMIT $%d OFFSET $%d",
+		where, order.orderBy(), len(args)-1, len(args)), args...)
+}
+
+// ListAfter returns up to limit books matching filter with an ISBN after the
+// cursor, in ISBN order. Unlike offsets, the cursor doesn't skip or repeat
+// books when others are inserted between pages.
+func (m BookModel) ListAfter(ctx context.Context, filter BookFilter, after string, limit int) (_ []Book, err error) {
+	ctx, done := m.instrument(ctx, "ListAfter", "SELECT")
+	defer func() { done(err) }()
+
+	where, args := filter.where()
+	args = append(args, after)
+
+	cond := fmt.Sprintf("isbn > $%d", len(args))
+	if where == "" {
+		where = "WHERE " + cond
+	} else {
+		where += " AND " + cond
+	}
+	args = append(args, limit)
+
+	return m.queryBooks(ctx, fmt.Sprintf("SELECT "+bookColumns+" FROM books %s ORDER BY isbn ASC LIMIT $%d", where, len(args)), args...)
+}
+
+// queryBooks runs a query returning whole book rows under the retry policy.
+func (m BookModel) queryBooks(ctx context.Context, query string, args ...any) ([]Book, error) {
+	var bks []Book
+
+	err := m.Retry.do(ctx, func() error {
+		// Start from an empty slice, not nil, so no matches encode as [].
+		bks = []Book{}
+
+		stmt, err := m.reader().PrepareContext(ctx, logSQL(ctx, query))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		rows, err := stmt.QueryContext(ctx, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var bk Book
+
+			err := rows.Scan(&bk.Isbn, &bk.Title, &bk.Author, &bk.Genre, &bk.Price, &bk.Quantity, &bk.PublishedYear, &bk.Version)
+			if err != nil {
+				return err
+			}
+
+			bks = append(bks, bk)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return bks, nil
+}
+
+// ForEach calls fn for every book in ISBN order, reading rows as they arrive
+// rather than loading the catalogue into memory. It stops at the first error
+// from fn.
+//
+// The query runs for as long as the caller takes to consume it, so it is
+// exempt from DB_STATEMENT_TIMEOUT.
+func (m BookModel) ForEach(ctx context.Context, fn func(Book) error) (err error) {
+	ctx, done := m.instrument(ctx, "ForEach", "SELECT")
+	defer func() { done(err) }()
+
+	tx, err := m.reader().BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, logSQL(ctx, "SET LOCAL statement_timeout = 0;"))
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.QueryContext(ctx, logSQL(ctx, "SELECT "+bookColumns+" FROM books ORDER BY isbn ASC;"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bk Book
+
+		err = rows.Scan(&bk.Isbn, &bk.Title, &bk.Author, &bk.Genre, &bk.Price, &bk.Quantity, &bk.PublishedYear, &bk.Version)
+		if err != nil {
+			return err
+		}
+
+		err = fn(bk)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Count returns the number of books matching filter across all pages.
+func (m BookModel) Count(ctx context.Context, filter BookFilter) (_ int, err error) {
+	ctx, done := m.instrument(ctx, "Count", "SELECT")
+	defer func() { done(err) }()
+
+	where, args := filter.where()
+
+	var n int
+
+	err = m.Retry.do(ctx, func() error {
+		stmt, err := m.reader().PrepareContext(ctx, logSQL(ctx, "SELECT COUNT(*) FROM books "+where+";"))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		return stmt.QueryRowContext(ctx, args...).Scan(&n)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Use a method on the custom BookModel type to run the SQL query.
+func (m BookModel) Get(ctx context.Context, isbn string) (_ *Book, err error) {
+	if m.Cache != nil {
+		if bk, ok := m.Cache.Get(ctx, isbn); ok {
+			return &bk, nil
+		}
+	}
+
+	ctx, done := m.instrument(ctx, "Get", "SELECT", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+
+	var bk Book
+
+	// A row read from a lagging replica could sit in the cache long after
+	// the replica catches up, so the cache is only filled from the primary.
+	db := m.reader
+	if m.Cache != nil || isPrimaryRead(ctx) {
+		db = m.primary
+	}
+
+	err = m.Retry.do(ctx, func() error {
+		stmt, err := db().PrepareContext(ctx, logSQL(ctx, "SELECT "+bookColumns+" FROM books WHERE isbn=$1;"))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		return stmt.QueryRowContext(ctx, isbn).Scan(&bk.Isbn, &bk.Title, &bk.Author, &bk.Genre, &bk.Price, &bk.Quantity, &bk.PublishedYear, &bk.Version)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Cache != nil {
+		m.Cache.Set(ctx, isbn, bk)
+	}
+
+	return &bk, nil
+}
+
+// GetMany returns the books with the given ISBNs, in the same order and
+// without duplicates. ISBNs with no book are skipped.
+func (m BookModel) GetMany(ctx context.Context, isbns []string) (_ []Book, err error) {
+	ctx, done := m.instrument(ctx, "GetMany", "SELECT", attribute.Int("batch.size", len(isbns)))
+	defer func() { done(err) }()
+
+	found, err := m.queryBooks(ctx, "SELECT "+bookColumns+" FROM books WHERE isbn = ANY($1);", pq.Array(isbns))
+	if err != nil {
+		return nil, err
+	}
+
+	byISBN := make(map[string]Book, len(found))
+	for _, bk := range found {
+		byISBN[bk.Isbn] = bk
+	}
+
+	bks := []Book{}
+	for _, isbn := range isbns {
+		if bk, ok := byISBN[isbn]; ok {
+			bks = append(bks, bk)
+			delete(byISBN, isbn)
+		}
+	}
+
+	return bks, nil
+}
+
+// Exists reports whether a book with the given ISBN exists, for callers
+// that don't need the row itself. It reads from the primary, since
+// createBook uses it to decide whether to insert.
+func (m BookModel) Exists(ctx context.Context, isbn string) (_ bool, err error) {
+	ctx, done := m.instrument(ctx, "Exists", "SELECT", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+
+	var exists bool
+
+	err = m.Retry.do(ctx, func() error {
+		return m.primary().QueryRowContext(ctx, logSQL(ctx, "SELECT EXISTS(SELECT 1 FROM books WHERE isbn=$1);"), isbn).Scan(&exists)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return exists, nil
+}
+
+// RelatedByAuthor returns up to limit other books by the author of the book
+// with the given ISBN, ordered by title.
+func (m BookModel) RelatedByAuthor(ctx context.Context, isbn string, limit int) (_ []Book, err error) {
+	ctx, done := m.instrument(ctx, "RelatedByAuthor", "SELECT", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+
+	return m.queryBooks(ctx, "SELECT "+bookColumns+" FROM books "+
+		"WHERE lower(author) = (SELECT lower(author) FROM books WHERE isbn=$1) AND isbn <> $1 "+
+		"ORDER BY title ASC LIMIT $2;", isbn, limit)
+}
+
+// Genres returns the distinct genres of all books, in alphabetical order.
+// Books added before genres existed have none and are left out.
+func (m BookModel) Genres(ctx context.Context) (_ []string, err error) {
+	ctx, done := m.instrument(ctx, "Genres", "SELECT")
+	defer func() { done(err) }()
+
+	var genres []string
+
+	err = m.Retry.do(ctx, func() error {
+		genres = nil
+
+		rows, err := m.reader().QueryContext(ctx, logSQL(ctx, "SELECT DISTINCT genre FROM books WHERE genre <> '' ORDER BY genre;"))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var genre string
+			if err := rows.Scan(&genre); err != nil {
+				return err
+			}
+			genres = append(genres, genre)
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return genres, nil
+}
+
+func (m BookModel) Create(ctx context.Context, bk *Book) (err error) {
+	ctx, done := m.instrument(ctx, "Create", "INSERT", attribute.String("book.isbn", bk.Isbn))
+	defer func() { done(err) }()
+	defer m.evict(ctx, bk.Isbn)
+
+	// The check and the insert aren't atomic, so two racing requests can
+	// still both get in; it catches the double entry, not a determined race.
+	if err = m.findDuplicate(ctx, m.primary(), bk); err != nil {
+		return err
+	}
+
+	stmt, err := m.primary().PrepareContext(ctx, logSQL(ctx, "INSERT INTO books (isbn, title, author, genre, price, quantity, published_year) VALUES ($1, $2, $3, $4, $5, $6, $7);"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.ExecContext(ctx, bk.Isbn, bk.Title, bk.Author, bk.Genre, bk.Price, bk.Quantity, bk.PublishedYear)
+	if err != nil {
+		return err
+	}
+
+	// New rows start at the column's default version.
+	bk.Version = 1
+
+	return nil
+}
+
+// CheckDuplicate returns a *DuplicateBookError if Create would reject bk as
+// a duplicate of another book's title and author, which it only does with
+// StrictDedup set. ISBN clashes are Exists' business.
+func (m BookModel) CheckDuplicate(ctx context.Context, bk *Book) (err error) {
+	ctx, done := m.instrument(ctx, "CheckDuplicate", "SELECT", attribute.String("book.isbn", bk.Isbn))
+	defer func() { done(err) }()
+
+	return m.findDuplicate(ctx, m.primary(), bk)
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx, so a batch can look
+// for duplicates among the books it has already inserted.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (m BookModel) findDuplicate(ctx context.Context, q rowQuerier, bk *Book) error {
+	if !m.StrictDedup {
+		return nil
+	}
+
+	var existing string
+
+	err := q.QueryRowContext(ctx, logSQL(ctx, "SELECT isbn FROM books WHERE LOWER(title)=LOWER($1) AND LOWER(author)=LOWER($2) LIMIT 1;"), bk.Title, bk.Author).Scan(&existing)
+	if err == nil {
+		return &DuplicateBookError{Isbn: existing}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+
+	return err
+}
+
+// CreateBatch inserts all books in a single transaction, reusing one prepared
+// statement. If any insert fails, or with StrictDedup set any book is a
+// duplicate, the whole batch is rolled back.
+func (m BookModel) CreateBatch(ctx context.Context, bks []Book) (err error) {
+	ctx, done := m.instrument(ctx, "CreateBatch", "INSERT", attribute.Int("batch.size", len(bks)))
+	defer func() { done(err) }()
+
+	tx, err := m.primary().BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed.
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, logSQL(ctx, "INSERT INTO books (isbn, title, author, genre, price, quantity, published_year) VALUES ($1, $2, $3, $4, $5, $6, $7);"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, bk := range bks {
+		err = m.findDuplicate(ctx, tx, &bk)
+		if err == nil {
+			_, err = stmt.ExecContext(ctx, bk.Isbn, bk.Title, bk.Author, bk.Genre, bk.Price, bk.Quantity, bk.PublishedYear)
+		}
+		if err != nil {
+			return fmt.Errorf("insert book %s: %w", bk.Isbn, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Import inserts bks in one transaction, skipping books whose ISBN already
+// exists, and with StrictDedup set duplicates, rather than failing the whole
+// import. The result holds, for each book, nil if it was inserted or
+// ErrBookExists or a *DuplicateBookError if it was skipped.
+func (m BookModel) Import(ctx context.Context, bks []Book) (_ []error, err error) {
+	ctx, done := m.instrument(ctx, "Import", "INSERT", attribute.Int("batch.size", len(bks)))
+	defer func() { done(err) }()
+
+	tx, err := m.primary().BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, logSQL(ctx, `INSERT INTO books (isbn, title, author, genre, price, quantity, published_year) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (isbn) DO NOTHING;`))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	skipped := make([]error, len(bks))
+
+	for i, bk := range bks {
+		var dup *DuplicateBookError
+
+		err := m.findDuplicate(ctx, tx, &bk)
+		if errors.As(err, &dup) {
+			// The title and author match because the book itself is stored.
+			if dup.Isbn == bk.Isbn {
+				err = ErrBookExists
+			}
+			skipped[i] = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := stmt.ExecContext(ctx, bk.Isbn, bk.Title, bk.Author, bk.Genre, bk.Price, bk.Quantity, bk.PublishedYear)
+		if err != nil {
+			return nil, fmt.Errorf("insert book %s: %w", bk.Isbn, err)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			skipped[i] = ErrBookExists
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return skipped, nil
+}
+
+// Update overwrites the title, author, genre, price and published year of
+// the book with the given ISBN and increments its version, returning
+// ErrBookNotFound if no row matched. When bk.Version is set the book must
+// still be at that version, or ErrVersionConflict is returned. Stock is not
+// changed by an update; bk.Quantity and bk.Version are set from the row.
+//
+// The version makes a repeated update detectable, so it is never retried.
+func (m BookModel) Update(ctx context.Context, isbn string, bk *Book) (err error) {
+	ctx, done := m.instrument(ctx, "Update", "UPDATE", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+	defer m.evict(ctx, isbn)
+
+	stmt, err := m.primary().PrepareContext(ctx, logSQL(ctx, "UPDATE books SET title=$1, author=$2, genre=$3, price=$4, published_year=$5, version=version+1 WHERE isbn=$6 AND ($7 = 0 OR version=$7) RETURNING quantity, version;"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	err = stmt.QueryRowContext(ctx, bk.Title, bk.Author, bk.Genre, bk.Price, bk.PublishedYear, isbn, bk.Version).Scan(&bk.Quantity, &bk.Version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m.notUpdated(ctx, isbn, bk.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// notUpdated explains an update of the book with the given ISBN that matched
+// no row: ErrVersionConflict if it asked for a version and the book exists,
+// otherwise ErrBookNotFound.
+func (m BookModel) notUpdated(ctx context.Context, isbn string, version int) error {
+	if version == 0 {
+		return ErrBookNotFound
+	}
+
+	var exists bool
+
+	err := m.primary().QueryRowContext(ctx, logSQL(ctx, "SELECT EXISTS(SELECT 1 FROM books WHERE isbn=$1);"), isbn).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrBookNotFound
+	}
+
+	return ErrVersionConflict
+}
+
+// SetStock sets the quantity in stock of the book with the given ISBN and
+// returns the updated book. Negative quantities are rejected.
+func (m BookModel) SetStock(ctx context.Context, isbn string, n int) (_ *Book, err error) {
+	ctx, done := m.instrument(ctx, "SetStock", "UPDATE", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+	defer m.evict(ctx, isbn)
+
+	if n < 0 {
+		return nil, fmt.Errorf("stock cannot be negative: %d", n)
+	}
+
+	var bk Book
+
+	// Setting an absolute quantity is idempotent, so it can be retried.
+	err = m.Retry.do(ctx, func() error {
+		stmt, err := m.primary().PrepareContext(ctx, logSQL(ctx, "UPDATE books SET quantity=$1 WHERE isbn=$2 RETURNING "+bookColumns+";"))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		return stmt.QueryRowContext(ctx, n, isbn).Scan(&bk.Isbn, &bk.Title, &bk.Author, &bk.Genre, &bk.Price, &bk.Quantity, &bk.PublishedYear, &bk.Version)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &bk, nil
+}
+
+// patchableColumns are the columns PartialUpdate may set. Column names cannot
+// be parameterized, so anything else is rejected.
+var patchableColumns = map[string]bool{
+	"title":          true,
+	"author":         true,
+	"genre":          true,
+	"price":          true,
+	"published_year": true,
+}
+
+// PartialUpdate sets only the given columns on the book with the given ISBN
+// and increments its version, returning ErrBookNotFound if no row was
+// affected. A non-zero version must match the book's, as in Update.
+func (m BookModel) PartialUpdate(ctx context.Context, isbn string, version int, fields map[string]any) (err error) {
+	ctx, done := m.instrument(ctx, "PartialUpdate", "UPDATE", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+	defer m.evict(ctx, isbn)
+
+	if len(fields) == 0 {
+		return errors.New("no fields to update")
+	}
+
+	cols := make([]string, 0, len(fields))
+	for col := range fields {
+		if !patchableColumns[col] {
+			return fmt.Errorf("column %q cannot be updated", col)
+		}
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	set := make([]string, len(cols))
+	args := make([]any, 0, len(cols)+1)
+	for i, col := range cols {
+		set[i] = fmt.Sprintf("%s=$%d", col, i+1)
+		args = append(args, fields[col])
+	}
+	args = append(args, isbn, version)
+
+	query := fmt.Sprintf("UPDATE books SET %s, version=version+1 WHERE isbn=$%d AND ($%d = 0 OR version=$%d);",
+		strings.Join(set, ", "), len(args)-1, len(args), len(args))
+
+	// Like Update, never retried.
+	stmt, err := m.primary().PrepareContext(ctx, logSQL(ctx, query))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return m.notUpdated(ctx, isbn, version)
+	}
+
+	return nil
+}
+
+// DecrementStock removes n copies of the book from stock. It returns
+// ErrInsufficientStock, leaving the quantity untouched, if fewer than n are
+// available.
+func (m BookModel) DecrementStock(ctx context.Context, isbn string, n int) (err error) {
+	ctx, done := m.instrument(ctx, "DecrementStock", "UPDATE", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+	defer m.evict(ctx, isbn)
+
+	stmt, err := m.primary().PrepareContext(ctx, logSQL(ctx, "UPDATE books SET quantity = quantity - $1 WHERE isbn=$2 AND quantity >= $1;"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.ExecContext(ctx, n, isbn)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected > 0 {
+		return nil
+	}
+
+	// Nothing was updated: either the book is missing or it is out of stock.
+	var exists bool
+
+	err = m.primary().QueryRowContext(ctx, logSQL(ctx, "SELECT EXISTS(SELECT 1 FROM books WHERE isbn=$1);"), isbn).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return ErrBookNotFound
+	}
+
+	return ErrInsufficientStock
+}
+
+// Purchase sells n copies of the book, returning the quantity left in stock.
+// The decrement and the purchases row are written in one transaction, and
+// the conditional UPDATE locks the book's row, so concurrent purchases queue
+// behind each other and can never oversell. Like DecrementStock, it returns
+// ErrInsufficientStock or ErrBookNotFound and is never retried.
+func (m BookModel) Purchase(ctx context.Context, isbn string, n int) (remaining int, err error) {
+	ctx, done := m.instrument(ctx, "Purchase", "UPDATE", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+	defer m.evict(ctx, isbn)
+
+	tx, err := m.primary().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		logSQL(ctx, "UPDATE books SET quantity = quantity - $1 WHERE isbn=$2 AND quantity >= $1 RETURNING quantity;"), n, isbn,
+	).Scan(&remaining)
+	if errors.Is(err, sql.ErrNoRows) {
+		var exists bool
+
+		err = tx.QueryRowContext(ctx, logSQL(ctx, "SELECT EXISTS(SELECT 1 FROM books WHERE isbn=$1);"), isbn).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if !exists {
+			return 0, ErrBookNotFound
+		}
+
+		return 0, ErrInsufficientStock
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.ExecContext(ctx, logSQL(ctx, "INSERT INTO purchases (isbn, quantity) VALUES ($1, $2);"), isbn, n)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return remaining, nil
+}
+
+// Delete removes the book with the given ISBN, returning ErrBookNotFound if
+// no row was affected.
+func (m BookModel) Delete(ctx context.Context, isbn string) (err error) {
+	ctx, done := m.instrument(ctx, "Delete", "DELETE", attribute.String("book.isbn", isbn))
+	defer func() { done(err) }()
+	defer m.evict(ctx, isbn)
+
+	n, err := m.exec(ctx, "DELETE FROM books WHERE isbn=$1;", isbn)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrBookNotFound
+	}
+
+	return nil
+}
+
+// DeleteMany removes the books with the given ISBNs in one statement, so
+// either all of them are deleted or none are, and returns the ISBNs that
+// were. ISBNs with no book are skipped.
+func (m BookModel) DeleteMany(ctx context.Context, isbns []string) (_ []string, err error) {
+	ctx, done := m.instrument(ctx, "DeleteMany", "DELETE", attribute.Int("batch.size", len(isbns)))
+	defer func() { done(err) }()
+
+	var deleted []string
+
+	err = m.Retry.do(ctx, func() error {
+		deleted = nil
+
+		rows, err := m.primary().QueryContext(ctx, logSQL(ctx, "DELETE FROM books WHERE isbn = ANY($1) RETURNING isbn;"), pq.Array(isbns))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var isbn string
+			if err := rows.Scan(&isbn); err != nil {
+				return err
+			}
+			deleted = append(deleted, isbn)
+		}
+
+		return rows.Err()
+	})
+	for _, isbn := range deleted {
+		m.evict(ctx, isbn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// exec runs an idempotent statement under the retry policy and returns the
+// number of rows it affected.
+func (m BookModel) exec(ctx context.Context, query string, args ...any) (n int64, err error) {
+	err = m.Retry.do(ctx, func() error {
+		stmt, err := m.primary().PrepareContext(ctx, logSQL(ctx, query))
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		res, err := stmt.ExecContext(ctx, args...)
+		if err != nil {
+			return err
+		}
+
+		n, err = res.RowsAffected()
+		return err
+	})
+
+	return n, err
+}
+
+func Respond(w http.ResponseWriter, text string, code int) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	fmt.Fprintln(w, text)
+}
+
+// maxBodyBytes caps the size of JSON request bodies.
+const maxBodyBytes = 1 << 20
+
+// decodeJSON decodes the request body into dst, rejecting bodies larger than
+// maxBodyBytes and fields dst does not define. On failure it returns the
+// status code to respond with and an error whose message is safe to show the
+// client.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) (int, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	var body io.Reader = r.Body
+
+	// At debug level, keep a copy of what the decoder reads to log it.
+	var logged bytes.Buffer
+	if slog.Default().Enabled(r.Context(), slog.LevelDebug) {
+		body = io.TeeReader(r.Body, &logged)
+		defer func() {
+			slog.DebugContext(r.Context(), "request body", "method", r.Method, "path", r.URL.Path, "body", redactJSON(logged.Bytes()))
+		}()
+	}
+
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err == nil {
+		return 0, nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return 413, fmt.Errorf("request body must not be larger than %d bytes", maxBytesErr.Limit)
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return 400, errors.New("request body contains badly-formed JSON")
+	case errors.As(err, &typeErr):
+		return 400, fmt.Errorf("request body contains an invalid value for the %q field", typeErr.Field)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		return 400, fmt.Errorf("request body contains unknown field %s", field)
+	case errors.Is(err, io.EOF):
+		return 400, errors.New("request body must not be empty")
+	}
+
+	return 400, err
+}
+
+type errorBody struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func RespondError(w http.ResponseWriter, code int, msg string) {
+	var body errorBody
+	body.Error.Code = code
+	body.Error.Message = msg
+
+	RespondJSON(w, code, body)
+}
+
+// RespondJSON writes payload as JSON with the given status code, indented
+// when the request asked for ?pretty=true. Responses that honour the Accept
+// header use writeEntity instead.
+func RespondJSON(w http.ResponseWriter, code int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	if isPretty(w) {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(payload)
+}
+
+// healthCheckTimeout bounds each dependency check, so a stuck database or
+// Vault makes the probe fail instead of hang.
+const healthCheckTimeout = 2 * time.Second
+
+// errVaultDisabled is returned by CheckVault when the service was started
+// without Vault.
+var errVaultDisabled = errors.New("vault is disabled")
+
+type App struct {
+	DB     *sql.DB
+	Handle *DBHandle
+	Vault  *vault.Client
+}
+
+// CheckDBConn runs a trivial query to confirm the database is reachable.
+func (a App) CheckDBConn(ctx context.Context) error {
+	var one int
+
+	return a.Handle.primary(a.DB).QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+// CheckVault confirms the Vault token is still valid by looking it up.
+func (a App) CheckVault(ctx context.Context) error {
+	if a.Vault == nil {
+		return errVaultDisabled
+	}
+
+	_, err := a.Vault.Auth().Token().LookupSelfWithContext(ctx)
+
+	return err
 }
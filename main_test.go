@@ -1,42 +1,2300 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
 )
 
-type mockBookModel struct{}
+type mockBookModel struct {
+	patched map[string]any
+	created int
+}
+
+var mockBooks = []Book{
+	{Isbn: "978-1503261969", Title: "Emma", Author: "Jayne Austen", Genre: "Romance", Price: 944},
+	{Isbn: "978-1505255607", Title: "The Time Machine", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599},
+}
+
+func paginate(bks []Book, limit, offset int) []Book {
+	if offset >= len(bks) {
+		return []Book{}
+	}
+	bks = bks[offset:]
+	if limit < len(bks) {
+		bks = bks[:limit]
+	}
+
+	return bks
+}
+
+func filterBooks(filter BookFilter) []Book {
+	bks := []Book{}
+
+	q := strings.ToLower(filter.Query)
+	for _, bk := range mockBooks {
+		if !strings.Contains(strings.ToLower(bk.Title), q) && !strings.Contains(strings.ToLower(bk.Author), q) {
+			continue
+		}
+		if filter.Author != "" && !strings.EqualFold(bk.Author, filter.Author) {
+			continue
+		}
+		if filter.Genre != "" && !strings.EqualFold(bk.Genre, filter.Genre) {
+			continue
+		}
+		if filter.YearFrom != 0 && bk.PublishedYear < filter.YearFrom || filter.YearTo != 0 && (bk.PublishedYear == 0 || bk.PublishedYear > filter.YearTo) {
+			continue
+		}
+		if filter.MinPrice != nil && bk.Price < *filter.MinPrice || filter.MaxPrice != nil && bk.Price > *filter.MaxPrice {
+			continue
+		}
+		bks = append(bks, bk)
+	}
+
+	return bks
+}
+
+func (m *mockBookModel) List(ctx context.Context, filter BookFilter, limit, offset int, order BookSort) ([]Book, error) {
+	return paginate(filterBooks(filter), limit, offset), nil
+}
+
+func (m *mockBookModel) ListAfter(ctx context.Context, filter BookFilter, after string, limit int) ([]Book, error) {
+	bks := []Book{}
+	for _, bk := range filterBooks(filter) {
+		if bk.Isbn > after {
+			bks = append(bks, bk)
+		}
+	}
+
+	return paginate(bks, limit, 0), nil
+}
+
+func (m *mockBookModel) ForEach(ctx context.Context, fn func(Book) error) error {
+	for _, bk := range mockBooks {
+		if err := fn(bk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *mockBookModel) Count(ctx context.Context, filter BookFilter) (int, error) {
+	return len(filterBooks(filter)), nil
+}
+
+func (m *mockBookModel) Get(ctx context.Context, isbn string) (*Book, error) {
+	if isbn != "978-1505255607" {
+		return nil, ErrBookNotFound
+	}
+
+	bk := Book{Isbn: "978-1505255607", Title: "The Time Machine", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599}
 
-func (m *mockBookModel) All() ([]Book, error) {
-	var bks []Book
+	return &bk, nil
+}
 
-	bks = append(bks, Book{Isbn: "978-1503261969", Title: "Emma", Author: "Jayne Austen", Price: 9.44})
-	bks = append(bks, Book{Isbn: "978-1505255607", Title: "The Time Machine", Author: "H. G. Wells", Price: 5.99})
+func (m *mockBookModel) GetMany(ctx context.Context, isbns []string) ([]Book, error) {
+	bks := []Book{}
+	for _, isbn := range isbns {
+		for _, bk := range mockBooks {
+			if bk.Isbn == isbn {
+				bks = append(bks, bk)
+			}
+		}
+	}
 
 	return bks, nil
 }
 
-func (m *mockBookModel) Get(isbn string) (*Book, error) {
-	bk := Book{Isbn: "978-1505255607", Title: "The Time Machine", Author: "H. G. Wells", Price: 5.99}
+func (m *mockBookModel) Exists(ctx context.Context, isbn string) (bool, error) {
+	for _, bk := range mockBooks {
+		if bk.Isbn == isbn {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (m *mockBookModel) RelatedByAuthor(ctx context.Context, isbn string, limit int) ([]Book, error) {
+	if isbn != "978-1505255607" {
+		return nil, nil
+	}
+
+	bks := []Book{
+		{Isbn: "978-1503290334", Title: "The Invisible Man", Author: "H. G. Wells", Genre: "Science Fiction", Price: 699},
+		{Isbn: "978-1505260731", Title: "The War of the Worlds", Author: "H. G. Wells", Genre: "Science Fiction", Price: 799},
+	}
+
+	return paginate(bks, limit, 0), nil
+}
+
+func (m *mockBookModel) Genres(ctx context.Context) ([]string, error) {
+	return []string{"Romance", "Science Fiction"}, nil
+}
+
+func (m *mockBookModel) Authors(ctx context.Context, limit, offset int) ([]AuthorCount, int, error) {
+	authors := []AuthorCount{{Author: "H. G. Wells", Books: 1}, {Author: "Jayne Austen", Books: 2}}
+	if offset >= len(authors) {
+		return []AuthorCount{}, len(authors), nil
+	}
+	page := authors[offset:]
+	if limit < len(page) {
+		page = page[:limit]
+	}
+
+	return page, len(authors), nil
+}
+
+func (m *mockBookModel) Stats(ctx context.Context) (*BookStats, error) {
+	return &BookStats{Total: 2, AveragePrice: 772, MinPrice: 599, MaxPrice: 944, Genres: map[string]int{"Romance": 1, "Science Fiction": 1}}, nil
+}
+
+func (m *mockBookModel) CheckDuplicate(ctx context.Context, book *Book) error {
+	for _, bk := range mockBooks {
+		if strings.EqualFold(bk.Title, book.Title) && strings.EqualFold(bk.Author, book.Author) {
+			return &DuplicateBookError{Isbn: bk.Isbn}
+		}
+	}
+
+	return nil
+}
+
+func (m *mockBookModel) Create(ctx context.Context, book *Book) error {
+	m.created++
+	for _, bk := range mockBooks {
+		if bk.Isbn == book.Isbn {
+			return fmt.Errorf("insert book: %w", &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"})
+		}
+	}
+
+	return nil
+}
+
+func (m *mockBookModel) CreateBatch(ctx context.Context, books []Book) error {
+	for _, book := range books {
+		if err := m.Create(ctx, &book); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *mockBookModel) Import(ctx context.Context, books []Book) ([]error, error) {
+	skipped := make([]error, len(books))
+	for i := range books {
+		if m.Create(ctx, &books[i]) != nil {
+			skipped[i] = ErrBookExists
+		}
+	}
+
+	return skipped, nil
+}
+
+// The mock's book is at version 1.
+func (m *mockBookModel) Update(ctx context.Context, isbn string, book *Book) error {
+	if isbn != "978-1505255607" {
+		return ErrBookNotFound
+	}
+	if book.Version > 1 {
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
+func (m *mockBookModel) PartialUpdate(ctx context.Context, isbn string, version int, fields map[string]any) error {
+	if isbn != "978-1505255607" {
+		return ErrBookNotFound
+	}
+	if version > 1 {
+		return ErrVersionConflict
+	}
+
+	m.patched = fields
+
+	return nil
+}
+
+func (m *mockBookModel) Purchase(ctx context.Context, isbn string, n int) (int, error) {
+	if isbn != "978-1505255607" {
+		return 0, ErrBookNotFound
+	}
+	if n > 2 {
+		return 0, ErrInsufficientStock
+	}
+
+	return 2 - n, nil
+}
+
+func (m *mockBookModel) SetStock(ctx context.Context, isbn string, n int) (*Book, error) {
+	if isbn != "978-1505255607" {
+		return nil, ErrBookNotFound
+	}
+
+	bk := Book{Isbn: "978-1505255607", Title: "The Time Machine", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599, Quantity: n}
 
 	return &bk, nil
 }
 
-func (m *mockBookModel) Create(book *Book) error {
+func (m *mockBookModel) Delete(ctx context.Context, isbn string) error {
+	if isbn != "978-1505255607" {
+		return ErrBookNotFound
+	}
+
 	return nil
 }
 
+func (m *mockBookModel) DeleteMany(ctx context.Context, isbns []string) ([]string, error) {
+	var deleted []string
+	for _, bk := range mockBooks {
+		for _, isbn := range isbns {
+			if bk.Isbn == isbn {
+				deleted = append(deleted, isbn)
+				break
+			}
+		}
+	}
+
+	return deleted, nil
+}
+
+type mockApp struct {
+	err      error
+	vaultErr error
+}
+
+func (a *mockApp) CheckDBConn(ctx context.Context) error {
+	return a.err
+}
+
+func (a *mockApp) CheckVault(ctx context.Context) error {
+	return a.vaultErr
+}
+
 func TestBooksIndex(t *testing.T) {
 	rec := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/books", nil)
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
 
 	env := Env{books: &mockBookModel{}}
 
 	http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
 
-	expected := "978-1503261969, Emma, Jayne Austen, $9.44\n978-1505255607, The Time Machine, H. G. Wells, $5.99\n"
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+	}
+
+	expected := `{"books":[{"ISBN":"978-1503261969","Title":"Emma","Author":"Jayne Austen","Genre":"Romance","Price":"9.44","Quantity":0},{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}],"total":2,"limit":20,"offset":0}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestBooksIndexEmpty(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectPrepare("SELECT " + bookColumns + " FROM books").
+		ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}))
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM books").
+		ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
+
+	env := Env{books: BookModel{DB: db}}
+
+	http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+	}
+
+	expected := `{"books":[],"total":0,"limit":20,"offset":0}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestBooksIndexPagination(t *testing.T) {
+	tests := []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{
+			query:    "?limit=1&offset=1",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}],"total":2,"limit":1,"offset":1}` + "\n",
+		},
+		{
+			query:    "?limit=500&offset=5",
+			code:     200,
+			expected: `{"books":[],"total":2,"limit":100,"offset":5}` + "\n",
+		},
+		{
+			query:    "?limit=abc",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"limit must be a positive integer"}}` + "\n",
+		},
+		{
+			query:    "?offset=-1",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"offset must be a non-negative integer"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestBooksIndexSearch(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "?q=wells",
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}],"total":1,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?q=" + url.QueryEscape("' OR 1=1 --"),
+			expected: `{"books":[],"total":0,"limit":20,"offset":0}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestBooksIndexAuthor(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "?author=" + url.QueryEscape("h. g. wells"),
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}],"total":1,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?author=" + url.QueryEscape("H. G. Wells") + "&limit=1&offset=1",
+			expected: `{"books":[],"total":1,"limit":1,"offset":1}` + "\n",
+		},
+		{
+			query:    "?author=" + url.QueryEscape("Jayne Austen") + "&q=time",
+			expected: `{"books":[],"total":0,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?author=wells",
+			expected: `{"books":[],"total":0,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?author=&limit=1",
+			expected: `{"books":[{"ISBN":"978-1503261969","Title":"Emma","Author":"Jayne Austen","Genre":"Romance","Price":"9.44","Quantity":0}],"total":2,"limit":1,"offset":0}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.query, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestBooksIndexPriceRange(t *testing.T) {
+	tests := []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{
+			query:    "?min_price=6",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1503261969","Title":"Emma","Author":"Jayne Austen","Genre":"Romance","Price":"9.44","Quantity":0}],"total":1,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?max_price=5.99",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}],"total":1,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?min_price=5.99&max_price=9.44&limit=1",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1503261969","Title":"Emma","Author":"Jayne Austen","Genre":"Romance","Price":"9.44","Quantity":0}],"total":2,"limit":1,"offset":0}` + "\n",
+		},
+		{
+			query:    "?min_price=cheap",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"min_price must be a decimal with at most two fractional digits"}}` + "\n",
+		},
+		{
+			query:    "?min_price=10&max_price=5",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"min_price must not be greater than max_price"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.query, tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.query, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestBooksIndexCursor(t *testing.T) {
+	tests := []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{
+			query:    "?after=&limit=1",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1503261969","Title":"Emma","Author":"Jayne Austen","Genre":"Romance","Price":"9.44","Quantity":0}],"total":2,"limit":1,"offset":0,"next":"978-1503261969"}` + "\n",
+		},
+		{
+			query:    "?after=978-1503261969&limit=1",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}],"total":2,"limit":1,"offset":0,"next":"978-1505255607"}` + "\n",
+		},
+		{
+			query:    "?after=978-1505255607&limit=1",
+			code:     200,
+			expected: `{"books":[],"total":2,"limit":1,"offset":0}` + "\n",
+		},
+		{
+			query:    "?after=978-1503261969",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}],"total":2,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?after=978-1503261969&offset=1",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"after cannot be combined with offset or sort"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.query, tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.query, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestListAfterQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT isbn, title, author, genre, price, quantity, published_year, version FROM books WHERE lower(author) = lower($1) AND isbn > $2 ORDER BY isbn ASC LIMIT $3")).
+		ExpectQuery().
+		WithArgs("H. G. Wells", "978-1503261969", 10).
+		WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+			AddRow("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 2, 1895, 1))
+
+	bks, err := BookModel{DB: db}.ListAfter(context.Background(), BookFilter{Author: "H. G. Wells"}, "978-1503261969", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bks) != 1 || bks[0].Isbn != "978-1505255607" {
+		t.Errorf("unexpected books: %v", bks)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBooksIndexGenre(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{
+			query:    "?genre=" + url.QueryEscape("science fiction"),
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}],"total":1,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?genre=Romance&author=" + url.QueryEscape("H. G. Wells"),
+			expected: `{"books":[],"total":0,"limit":20,"offset":0}` + "\n",
+		},
+		{
+			query:    "?genre=Horror",
+			expected: `{"books":[],"total":0,"limit":20,"offset":0}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.query, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestBooksIndexYearRange(t *testing.T) {
+	tests := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{query: "?year_from=1800&year_to=1899", code: 200, body: `{"books":[],"total":0,"limit":20,"offset":0}`},
+		{query: "?year_from=1900&year_to=1800", code: 400, body: `{"error":{"code":400,"message":"year_from must not be greater than year_to"}}`},
+		{query: "?year_from=95", code: 400, body: `{"error":{"code":400,"message":"year_from must be a four-digit year"}}`},
+		{query: "?year_to=recent", code: 400, body: `{"error":{"code":400,"message":"year_to must be a four-digit year"}}`},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.query, tt.code, rec.Code)
+		}
+		if tt.body+"\n" != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.query, tt.body, rec.Body.String())
+		}
+	}
+}
+
+func TestGenresIndex(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/genres", nil)
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.genresIndex).ServeHTTP(rec, req)
+
+	expected := `["Romance","Science Fiction"]` + "\n"
 	if expected != rec.Body.String() {
 		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
 	}
 }
+
+func TestGenresQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT DISTINCT genre FROM books WHERE genre <> '' ORDER BY genre;")).
+		WillReturnRows(sqlmock.NewRows([]string{"genre"}).AddRow("Romance").AddRow("Science Fiction"))
+
+	genres, err := BookModel{DB: db}.Genres(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(genres, []string{"Romance", "Science Fiction"}) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", []string{"Romance", "Science Fiction"}, genres)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBookFilterWhere(t *testing.T) {
+	lo, hi := Price(500), Price(1000)
+
+	tests := []struct {
+		filter BookFilter
+		where  string
+		args   []any
+	}{
+		{BookFilter{}, "", nil},
+		{BookFilter{Author: "H. G. Wells"}, "WHERE lower(author) = lower($1)", []any{"H. G. Wells"}},
+		{
+			BookFilter{Query: "time", Author: "H. G. Wells"},
+			"WHERE (title ILIKE '%' || $1 || '%' OR author ILIKE '%' || $1 || '%') AND lower(author) = lower($2)",
+			[]any{"time", "H. G. Wells"},
+		},
+		{
+			BookFilter{Author: "H. G. Wells", Genre: "science fiction"},
+			"WHERE lower(author) = lower($1) AND lower(genre) = lower($2)",
+			[]any{"H. G. Wells", "science fiction"},
+		},
+		{BookFilter{MinPrice: &lo}, "WHERE price >= $1", []any{lo}},
+		{BookFilter{YearFrom: 1800, YearTo: 1899}, "WHERE published_year BETWEEN $1 AND $2", []any{1800, 1899}},
+		{BookFilter{YearFrom: 2020}, "WHERE published_year >= $1", []any{2020}},
+		{BookFilter{YearTo: 1900}, "WHERE published_year BETWEEN 1 AND $1", []any{1900}},
+		{
+			BookFilter{MaxPrice: &hi, YearFrom: 2020},
+			"WHERE price <= $1 AND published_year >= $2",
+			[]any{hi, 2020},
+		},
+		{BookFilter{MaxPrice: &hi}, "WHERE price <= $1", []any{hi}},
+		{
+			BookFilter{Author: "H. G. Wells", MinPrice: &lo, MaxPrice: &hi},
+			"WHERE lower(author) = lower($1) AND price BETWEEN $2 AND $3",
+			[]any{"H. G. Wells", lo, hi},
+		},
+	}
+
+	for _, tt := range tests {
+		where, args := tt.filter.where()
+
+		if where != tt.where {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.where, where)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.args, args)
+		}
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{in: "", expected: "ORDER BY isbn ASC"},
+		{in: "price", expected: "ORDER BY price ASC, isbn ASC"},
+		{in: "-title", expected: "ORDER BY title DESC, isbn ASC"},
+		{in: "-isbn", expected: "ORDER BY isbn DESC"},
+		{in: "pages", expected: "ORDER BY isbn ASC"},
+		{in: "price; DROP TABLE books", expected: "ORDER BY isbn ASC"},
+		{in: "-(SELECT 1)", expected: "ORDER BY isbn ASC"},
+	}
+
+	for _, tt := range tests {
+		obtained := parseSort(tt.in).orderBy()
+		if tt.expected != obtained {
+			t.Errorf("parseSort(%q):\n...expected = %v\n...obtained = %v", tt.in, tt.expected, obtained)
+		}
+	}
+
+	// A BookSort built by hand is still checked against the allowlist.
+	if obtained := (BookSort{Column: "1; DROP TABLE books"}).orderBy(); obtained != "ORDER BY isbn ASC" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "ORDER BY isbn ASC", obtained)
+	}
+}
+
+func TestBookByISBN(t *testing.T) {
+	tests := []struct {
+		isbn string
+		code int
+	}{
+		{isbn: "978-1505255607", code: 200},
+		{isbn: "1-50525-560-0", code: 200},
+		{isbn: "9781505255607", code: 200},
+		{isbn: "978-0000000002", code: 404},
+		{isbn: "", code: 400},
+		{isbn: "978-15O5255607", code: 400},
+		{isbn: "978-1505255608", code: 400},
+		{isbn: "'; DROP TABLE books;--", code: 400},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books/"+tt.isbn, nil)
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+
+		http.HandlerFunc(env.bookByISBN).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+		}
+	}
+}
+
+func TestBookByISBNHead(t *testing.T) {
+	tests := []struct {
+		isbn string
+		code int
+	}{
+		{isbn: "978-1505255607", code: 200},
+		{isbn: "978-0000000002", code: 404},
+		{isbn: "978-15O5255607", code: 400},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		get := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books/"+tt.isbn, nil)
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+		http.HandlerFunc(env.bookByISBN).ServeHTTP(get, req)
+
+		rec := httptest.NewRecorder()
+		req, _ = http.NewRequest("HEAD", "/v1/books/"+tt.isbn, nil)
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+		http.HandlerFunc(env.bookByISBN).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("\n...expected = %v\n...obtained = %v", "", rec.Body.String())
+		}
+		if tt.code != 200 {
+			continue
+		}
+		if tag := rec.Header().Get("ETag"); tag != get.Header().Get("ETag") {
+			t.Errorf("\n...expected = %v\n...obtained = %v", get.Header().Get("ETag"), tag)
+		}
+		if n := rec.Header().Get("Content-Length"); n != strconv.Itoa(get.Body.Len()) {
+			t.Errorf("\n...expected = %v\n...obtained = %v", get.Body.Len(), n)
+		}
+	}
+}
+
+func TestSimilarBooks(t *testing.T) {
+	tests := []struct {
+		url      string
+		isbn     string
+		code     int
+		expected string
+	}{
+		{
+			url:      "/v1/books/978-1505255607/similar",
+			isbn:     "978-1505255607",
+			code:     200,
+			expected: `[{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99","Quantity":0},{"ISBN":"978-1505260731","Title":"The War of the Worlds","Author":"H. G. Wells","Genre":"Science Fiction","Price":"7.99","Quantity":0}]` + "\n",
+		},
+		{
+			url:      "/v1/books/978-1505255607/similar?limit=1",
+			isbn:     "978-1505255607",
+			code:     200,
+			expected: `[{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99","Quantity":0}]` + "\n",
+		},
+		{
+			url:      "/v1/books/978-1503261969/similar",
+			isbn:     "978-1503261969",
+			code:     200,
+			expected: "[]\n",
+		},
+		{
+			url:      "/v1/books/978-1505255607/similar?limit=0",
+			isbn:     "978-1505255607",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"limit must be a positive integer"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+
+		http.HandlerFunc(env.similarBooks).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.url, tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.url, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestBooksIndexISBNs(t *testing.T) {
+	tests := []struct {
+		query    string
+		code     int
+		expected string
+	}{
+		{
+			query:    "?isbn=978-1505255607&isbn=978-0000000000&isbn=978-1503261969",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0},{"ISBN":"978-1503261969","Title":"Emma","Author":"Jayne Austen","Genre":"Romance","Price":"9.44","Quantity":0}],"total":2,"limit":3,"offset":0}` + "\n",
+		},
+		{
+			query:    "?isbn=978-0000000000",
+			code:     200,
+			expected: `{"books":[],"total":0,"limit":1,"offset":0}` + "\n",
+		},
+		{
+			query:    "?isbn=1505255600&isbn=978-1-50326-196-9",
+			code:     200,
+			expected: `{"books":[{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0},{"ISBN":"978-1503261969","Title":"Emma","Author":"Jayne Austen","Genre":"Romance","Price":"9.44","Quantity":0}],"total":2,"limit":2,"offset":0}` + "\n",
+		},
+		{
+			query:    "?isbn=978-1505255607&sort=title",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"isbn cannot be combined with other parameters"}}` + "\n",
+		},
+		{
+			query:    "?isbn=" + strings.Repeat("x&isbn=", maxPageLimit) + "x",
+			code:     400,
+			expected: `{"error":{"code":400,"message":"at most 100 isbn values may be given"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books"+tt.query, nil)
+
+		http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestGetManyQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	isbns := []string{"978-1505255607", "978-0000000000", "978-1503261969", "978-1505255607"}
+
+	// Postgres returns rows in any order; GetMany restores the request's.
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT " + bookColumns + " FROM books WHERE isbn = ANY($1);")).
+		ExpectQuery().
+		WithArgs(pq.Array(isbns)).
+		WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+			AddRow("978-1503261969", "Emma", "Jayne Austen", "Romance", "9.44", 0, 0, 1).
+			AddRow("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 0, 0, 1))
+
+	bks, err := BookModel{DB: db}.GetMany(context.Background(), isbns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, bk := range bks {
+		got = append(got, bk.Isbn)
+	}
+	expected := []string{"978-1505255607", "978-1503261969"}
+	if !reflect.DeepEqual(expected, got) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, got)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExistsQuery(t *testing.T) {
+	for _, expected := range []bool{true, false} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS(SELECT 1 FROM books WHERE isbn=$1);")).
+			WithArgs("978-1505255607").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(expected))
+
+		exists, err := BookModel{DB: db}.Exists(context.Background(), "978-1505255607")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != expected {
+			t.Errorf("\n...expected = %v\n...obtained = %v", expected, exists)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestForEachQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The export streams for as long as the client reads, so it lifts the
+	// statement timeout for its own transaction.
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("SET LOCAL statement_timeout = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT " + bookColumns + " FROM books ORDER BY isbn ASC;")).
+		WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+			AddRow("978-1503261969", "Emma", "Jayne Austen", "Romance", "9.44", 0, 0, 1).
+			AddRow("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 0, 0, 1))
+	mock.ExpectRollback()
+
+	var isbns []string
+	err = BookModel{DB: db}.ForEach(context.Background(), func(bk Book) error {
+		isbns = append(isbns, bk.Isbn)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"978-1503261969", "978-1505255607"}
+	if !reflect.DeepEqual(expected, isbns) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, isbns)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRelatedByAuthorQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectPrepare(regexp.QuoteMeta("WHERE lower(author) = (SELECT lower(author) FROM books WHERE isbn=$1) AND isbn <> $1 ORDER BY title ASC LIMIT $2")).
+		ExpectQuery().
+		WithArgs("978-1505255607", 5).
+		WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+			AddRow("978-1503290334", "The Invisible Man", "H. G. Wells", "Science Fiction", "6.99", 1, 1897, 1))
+
+	m := BookModel{DB: db}
+
+	bks, err := m.RelatedByAuthor(context.Background(), "978-1505255607", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bks) != 1 || bks[0].Isbn != "978-1503290334" {
+		t.Errorf("unexpected books: %v", bks)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateBookInvalidISBN(t *testing.T) {
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"ISBN":"978-1505255600","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":5.99}`)
+	req, _ := http.NewRequest("POST", "/v1/books", body)
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.createBook).ServeHTTP(rec, req)
+
+	if rec.Code != 422 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 422, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+	}
+
+	expected := `{"errors":{"ISBN":"invalid checksum"}}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestCreateBookPrice(t *testing.T) {
+	tests := []struct {
+		price    string
+		code     int
+		expected string
+	}{
+		{price: `-1.0`, code: 422, expected: `{"errors":{"Price":"must be greater than 0"}}` + "\n"},
+		{price: `0`, code: 422, expected: `{"errors":{"Price":"must be greater than 0"}}` + "\n"},
+		{price: `"1000000.00"`, code: 422, expected: `{"errors":{"Price":"must be at most 999.99"}}` + "\n"},
+		{price: `"NaN"`, code: 400},
+		{price: `"6.99"`, code: 201},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		body := strings.NewReader(`{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":` + tt.price + `}`)
+		req, _ := http.NewRequest("POST", "/v1/books", body)
+
+		http.HandlerFunc(env.createBook).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.price, tt.code, rec.Code)
+		}
+		if tt.expected != "" && tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.price, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestRespondError(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	RespondError(rec, 404, "Not Found")
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+	}
+
+	expected := `{"error":{"code":404,"message":"Not Found"}}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestRespondJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	RespondJSON(rec, 201, map[string]int{"inserted": 2})
+
+	if rec.Code != 201 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 201, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+	}
+
+	expected := `{"inserted":2}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestCreateBookCreated(t *testing.T) {
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99"}`)
+	req, _ := http.NewRequest("POST", "/v1/books", body)
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.createBook).ServeHTTP(rec, req)
+
+	if rec.Code != 201 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 201, rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/v1/books/978-1503290334" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "/v1/books/978-1503290334", loc)
+	}
+
+	expected := `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99","Quantity":0}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestCreateBookDuplicate(t *testing.T) {
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":5.99}`)
+	req, _ := http.NewRequest("POST", "/v1/books", body)
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.createBook).ServeHTTP(rec, req)
+
+	if rec.Code != 409 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 409, rec.Code)
+	}
+
+	expected := `{"error":{"code":409,"message":"a book with ISBN 978-1505255607 already exists"}}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestCreateBookDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		body     string
+		code     int
+		created  int
+		expected string
+	}{
+		{
+			name:     "valid",
+			query:    "?dry_run=true",
+			body:     `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"  H. G.  Wells ","Genre":"Science Fiction","Price":6.99}`,
+			code:     200,
+			expected: `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99","Quantity":0,"Version":1}` + "\n",
+		},
+		{
+			name:     "existing ISBN",
+			query:    "?dry_run=true",
+			body:     `{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":5.99}`,
+			code:     409,
+			expected: `{"error":{"code":409,"message":"a book with ISBN 978-1505255607 already exists"}}` + "\n",
+		},
+		{
+			name:     "existing title and author",
+			query:    "?dry_run=1",
+			body:     `{"ISBN":"978-1503290334","Title":"the time machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":5.99}`,
+			code:     409,
+			expected: `{"error":{"code":409,"message":"a book with this title and author already exists with ISBN 978-1505255607"}}` + "\n",
+		},
+		{
+			name:     "invalid",
+			query:    "?dry_run=true",
+			body:     `{"ISBN":"978-1503290334","Title":"","Author":"H. G. Wells","Genre":"Science Fiction","Price":6.99}`,
+			code:     422,
+			expected: `{"errors":{"Title":"must not be empty"}}` + "\n",
+		},
+		{
+			name:     "not a dry run",
+			query:    "?dry_run=false",
+			body:     `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":6.99}`,
+			code:     201,
+			created:  1,
+			expected: `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99","Quantity":0}` + "\n",
+		},
+		{
+			name:     "unrecognised value",
+			query:    "?dry_run=yes",
+			body:     `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":6.99}`,
+			code:     400,
+			expected: `{"error":{"code":400,"message":"dry_run must be true or false"}}` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		books := &mockBookModel{}
+		env := Env{books: books}
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/books"+tt.query, strings.NewReader(tt.body))
+
+		http.HandlerFunc(env.createBook).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Body.String())
+		}
+		if tt.created != books.created {
+			t.Errorf("%s: Create calls\n...expected = %v\n...obtained = %v", tt.name, tt.created, books.created)
+		}
+		if tt.code == 200 && rec.Header().Get("Location") != "" {
+			t.Errorf("%s: a dry run set Location %s", tt.name, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestCreateBookBadBody(t *testing.T) {
+	tests := []struct {
+		body     string
+		code     int
+		expected string
+	}{
+		{
+			body:     `{"ISBN":"978-1503379640","Titel":"The Prince","Author":"Niccolò Machiavelli","Genre":"Philosophy","Price":6.99}`,
+			code:     400,
+			expected: `{"error":{"code":400,"message":"request body contains unknown field \"Titel\""}}` + "\n",
+		},
+		{
+			body:     `{"ISBN":"978-1503379640","Title":"` + strings.Repeat("a", maxBodyBytes) + `"}`,
+			code:     413,
+			expected: `{"error":{"code":413,"message":"request body must not be larger than 1048576 bytes"}}` + "\n",
+		},
+		{
+			body:     `{"ISBN":"978-1503379640","Price":"cheap"}`,
+			code:     400,
+			expected: `{"error":{"code":400,"message":"invalid price \"cheap\": must be a decimal with at most two fractional digits"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/books", strings.NewReader(tt.body))
+
+		http.HandlerFunc(env.createBook).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestDeleteBook(t *testing.T) {
+	tests := []struct {
+		isbn string
+		code int
+	}{
+		{isbn: "978-1505255607", code: 204},
+		{isbn: "978-0000000000", code: 404},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/books/"+tt.isbn, nil)
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+
+		http.HandlerFunc(env.deleteBook).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+	}
+}
+
+func TestDeleteBooks(t *testing.T) {
+	tests := []struct {
+		body     string
+		code     int
+		expected string
+	}{
+		{
+			body:     `["978-1505255607","978-0000000002","978-1503261969"]`,
+			code:     200,
+			expected: `{"deleted":2,"missing":1}` + "\n",
+		},
+		{
+			body:     `["978-0000000002","978-0000000002"]`,
+			code:     200,
+			expected: `{"deleted":0,"missing":1}` + "\n",
+		},
+		{
+			body:     `["1505255600","9781505255607","978-1-50326-196-9"]`,
+			code:     200,
+			expected: `{"deleted":2,"missing":0}` + "\n",
+		},
+		{
+			body:     `[]`,
+			code:     400,
+			expected: `{"error":{"code":400,"message":"body must list at least one ISBN"}}` + "\n",
+		},
+		{body: `{"isbn":"978-1505255607"}`, code: 400},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/v1/books", strings.NewReader(tt.body))
+
+		http.HandlerFunc(env.deleteBooks).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.body, tt.code, rec.Code)
+		}
+		if tt.expected != "" && tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.body, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestDeleteManyQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	isbns := []string{"978-1505255607", "978-0000000002"}
+
+	mock.ExpectQuery(regexp.QuoteMeta("DELETE FROM books WHERE isbn = ANY($1) RETURNING isbn;")).
+		WithArgs(pq.Array(isbns)).
+		WillReturnRows(sqlmock.NewRows([]string{"isbn"}).AddRow("978-1505255607"))
+
+	deleted, err := BookModel{DB: db}.DeleteMany(context.Background(), isbns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string{"978-1505255607"}, deleted) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", []string{"978-1505255607"}, deleted)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateBook(t *testing.T) {
+	const book = `{"ISBN":"ignored","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":6.99}`
+
+	tests := []struct {
+		isbn     string
+		body     string
+		code     int
+		expected string
+	}{
+		{isbn: "978-1505255607", body: book, code: 200},
+		{isbn: "978-0000000002", body: book, code: 404},
+		{
+			isbn:     "978-0000000000",
+			body:     book,
+			code:     422,
+			expected: `{"errors":{"ISBN":"invalid checksum"}}` + "\n",
+		},
+		{
+			isbn:     "978-1505255607",
+			body:     `{"Title":" ","Author":"H. G. Wells","Genre":"Science Fiction","Price":-1}`,
+			code:     422,
+			expected: `{"errors":{"Price":"must be greater than 0","Title":"must not be empty"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/v1/books/"+tt.isbn, strings.NewReader(tt.body))
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+
+		http.HandlerFunc(env.updateBook).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+		if tt.code == 200 && !strings.Contains(rec.Body.String(), `"ISBN":"`+tt.isbn+`"`) {
+			t.Errorf("expected path ISBN %v in body, obtained %v", tt.isbn, rec.Body.String())
+		}
+		if tt.expected != "" && tt.expected != rec.Body.String() {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestUpdateBookVersion(t *testing.T) {
+	const book = `"Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":6.99`
+
+	tests := []struct {
+		name     string
+		method   string
+		ifMatch  string
+		body     string
+		code     int
+		expected string
+	}{
+		{name: "current If-Match", method: "PUT", ifMatch: `"1"`, body: `{` + book + `}`, code: 200},
+		{name: "current body version", method: "PUT", body: `{` + book + `,"version":1}`, code: 200},
+		{
+			name:     "stale If-Match",
+			method:   "PUT",
+			ifMatch:  `"2"`,
+			body:     `{` + book + `}`,
+			code:     409,
+			expected: `{"error":{"code":409,"message":"the book has changed since version 2"}}` + "\n",
+		},
+		{name: "stale body version", method: "PUT", body: `{` + book + `,"Version":2}`, code: 409},
+		{name: "any version", method: "PUT", ifMatch: "*", body: `{` + book + `}`, code: 200},
+		{name: "malformed If-Match", method: "PUT", ifMatch: `abc`, body: `{` + book + `}`, code: 400},
+		{name: "current ETag", method: "PUT", ifMatch: "etag", body: `{` + book + `}`, code: 200},
+		{
+			name:     "stale ETag",
+			method:   "PUT",
+			ifMatch:  `"abc"`,
+			body:     `{` + book + `}`,
+			code:     409,
+			expected: `{"error":{"code":409,"message":"the book has changed since ETag \"abc\""}}` + "\n",
+		},
+		{name: "current ETag and stale body version", method: "PUT", ifMatch: "etag", body: `{` + book + `,"Version":2}`, code: 409},
+		{name: "current patch ETag", method: "PATCH", ifMatch: "etag", body: `{"Price":"6.49"}`, code: 200},
+		{name: "stale patch ETag", method: "PATCH", ifMatch: `"abc"`, body: `{"Price":"6.49"}`, code: 409},
+		{name: "disagreeing versions", method: "PUT", ifMatch: `"1"`, body: `{` + book + `,"Version":2}`, code: 400},
+		{name: "current patch", method: "PATCH", ifMatch: "1", body: `{"Price":"6.49"}`, code: 200},
+		{name: "stale patch", method: "PATCH", ifMatch: `"2"`, body: `{"Price":"6.49"}`, code: 409},
+		{name: "stale patch body version", method: "PATCH", body: `{"Price":"6.49","version":3}`, code: 409},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	// "etag" stands for the ETag a GET of the book sends.
+	get := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books/978-1505255607", nil)
+	req = mux.SetURLVars(req, map[string]string{"isbn": "978-1505255607"})
+	http.HandlerFunc(env.bookByISBN).ServeHTTP(get, req)
+	etag := get.Header().Get("ETag")
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, "/v1/books/978-1505255607", strings.NewReader(tt.body))
+		req = mux.SetURLVars(req, map[string]string{"isbn": "978-1505255607"})
+		if tt.ifMatch == "etag" {
+			tt.ifMatch = etag
+		}
+		if tt.ifMatch != "" {
+			req.Header.Set("If-Match", tt.ifMatch)
+		}
+
+		handler := env.updateBook
+		if tt.method == "PATCH" {
+			handler = env.patchBook
+		}
+		http.HandlerFunc(handler).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.expected != "" && tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestUpdateVersionQuery(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		exists   bool
+		expected error
+	}{
+		{name: "stale version", version: 1, exists: true, expected: ErrVersionConflict},
+		{name: "missing book", version: 1, exists: false, expected: ErrBookNotFound},
+	}
+
+	for _, tt := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The row is already at version 2, so the conditional UPDATE matches
+		// nothing.
+		mock.ExpectPrepare(regexp.QuoteMeta("UPDATE books SET title=$1, author=$2, genre=$3, price=$4, published_year=$5, version=version+1 WHERE isbn=$6 AND ($7 = 0 OR version=$7) RETURNING quantity, version;")).
+			ExpectQuery().
+			WithArgs("The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 0, "978-1505255607", tt.version).
+			WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}))
+		mock.ExpectQuery("SELECT EXISTS").WithArgs("978-1505255607").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.exists))
+		mock.ExpectPrepare(regexp.QuoteMeta("UPDATE books SET price=$1, version=version+1 WHERE isbn=$2 AND ($3 = 0 OR version=$3);")).
+			ExpectExec().
+			WithArgs("6.49", "978-1505255607", tt.version).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT EXISTS").WithArgs("978-1505255607").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.exists))
+
+		m := BookModel{DB: db}
+		bk := Book{Title: "The Time Machine", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599, Version: tt.version}
+
+		if err := m.Update(context.Background(), "978-1505255607", &bk); !errors.Is(err, tt.expected) {
+			t.Errorf("%s: Update:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, err)
+		}
+		if err := m.PartialUpdate(context.Background(), "978-1505255607", tt.version, map[string]any{"price": Price(649)}); !errors.Is(err, tt.expected) {
+			t.Errorf("%s: PartialUpdate:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestHealthDBFailure(t *testing.T) {
+	env := Env{app: &mockApp{err: errors.New("connection refused")}}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+
+	http.HandlerFunc(env.appHealth).ServeHTTP(rec, req)
+
+	if rec.Code != 500 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 500, rec.Code)
+	}
+
+	expected := `{"error":{"code":500,"message":"Internal Server Error"}}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestReady(t *testing.T) {
+	tests := []struct {
+		name     string
+		app      mockApp
+		code     int
+		expected string
+	}{
+		{
+			name:     "healthy",
+			app:      mockApp{},
+			code:     200,
+			expected: `{"db":"ok","vault":"ok"}`,
+		},
+		{
+			name:     "vault disabled",
+			app:      mockApp{vaultErr: errVaultDisabled},
+			code:     200,
+			expected: `{"db":"ok","vault":"disabled"}`,
+		},
+		{
+			name:     "db down",
+			app:      mockApp{err: errors.New("connection refused")},
+			code:     503,
+			expected: `{"db":"error","vault":"ok"}`,
+		},
+		{
+			name:     "vault token expired",
+			app:      mockApp{vaultErr: errors.New("permission denied")},
+			code:     503,
+			expected: `{"db":"ok","vault":"error"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		env := Env{app: &tt.app}
+		env.started.Store(true)
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+
+		http.HandlerFunc(env.appReady).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.expected+"\n" != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestReadyStarting(t *testing.T) {
+	// The database would pass, but startup hasn't finished.
+	env := Env{app: &mockApp{}}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+
+	http.HandlerFunc(env.appReady).ServeHTTP(rec, req)
+
+	if rec.Code != 503 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 503, rec.Code)
+	}
+	if expected := `{"reason":"starting"}` + "\n"; expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+
+	env.started.Store(true)
+
+	rec = httptest.NewRecorder()
+	http.HandlerFunc(env.appReady).ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, rec.Code)
+	}
+}
+
+func TestCheckDBConnTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT 1").
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err = App{DB: db}.CheckDBConn(ctx)
+	if err == nil {
+		t.Fatal("expected the check to fail at the deadline")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("check took %v, expected it to stop at the deadline", elapsed)
+	}
+}
+
+func TestPatchBook(t *testing.T) {
+	tests := []struct {
+		isbn     string
+		body     string
+		code     int
+		expected map[string]any
+		response string
+	}{
+		{isbn: "978-1505255607", body: `{"Price":"6.49"}`, code: 200, expected: map[string]any{"price": Price(649)}},
+		{isbn: "978-1505255607", body: `{}`, code: 400},
+		{isbn: "978-0000000000", body: `{"Price":"6.49"}`, code: 404},
+		{isbn: "978-1505255607", body: `{"Author":" H. G.  Wells "}`, code: 200, expected: map[string]any{"author": "H. G. Wells"}},
+		{isbn: "978-1505255607", body: `{"Title":" ","Genre":""}`, code: 422, response: `{"errors":{"Genre":"must not be empty","Title":"must not be empty"}}` + "\n"},
+		{isbn: "978-1505255607", body: `{"Author":"` + strings.Repeat("a", 256) + `"}`, code: 422, response: `{"errors":{"Author":"must be at most 255 characters"}}` + "\n"},
+		{isbn: "978-1505255607", body: `{"Price":"0"}`, code: 422, response: `{"errors":{"Price":"must be greater than 0"}}` + "\n"},
+	}
+
+	for _, tt := range tests {
+		books := &mockBookModel{}
+		env := Env{books: books}
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("PATCH", "/v1/books/"+tt.isbn, strings.NewReader(tt.body))
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+
+		http.HandlerFunc(env.patchBook).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+		if tt.expected != nil && !reflect.DeepEqual(tt.expected, books.patched) {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, books.patched)
+		}
+		if tt.response != "" && tt.response != rec.Body.String() {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.response, rec.Body.String())
+		}
+		if tt.code == 422 && books.patched != nil {
+			t.Errorf("patched %v despite failing validation", books.patched)
+		}
+	}
+}
+
+func TestPartialUpdateQuery(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectPrepare("UPDATE books SET author=$1, price=$2, version=version+1 WHERE isbn=$3 AND ($4 = 0 OR version=$4);").
+		ExpectExec().
+		WithArgs("H.G. Wells", "6.49", "978-1505255607", 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	fields := map[string]any{"price": Price(649), "author": "H.G. Wells"}
+
+	err = BookModel{DB: db}.PartialUpdate(context.Background(), "978-1505255607", 0, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	err = BookModel{DB: db}.PartialUpdate(context.Background(), "978-1505255607", 0, map[string]any{"isbn = '' --": 1})
+	if err == nil {
+		t.Error("expected an error for a column outside the allowlist")
+	}
+}
+
+func TestCreateBooks(t *testing.T) {
+	tests := []struct {
+		body     string
+		code     int
+		expected string
+	}{
+		{
+			body:     `[{"ISBN":"978-1503379640","Title":"The Prince","Author":"Niccolò Machiavelli","Genre":"Philosophy","Price":"6.99"},{"ISBN":"978-0306406157","Title":"Title","Author":"Author","Genre":"Genre","Price":"1.00"}]`,
+			code:     200,
+			expected: `{"inserted":2}` + "\n",
+		},
+		{
+			body:     `[{"ISBN":"978-1503379640","Title":"The Prince","Author":"Niccolò Machiavelli","Genre":"Philosophy","Price":"6.99"},{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99"}]`,
+			code:     409,
+			expected: `{"error":{"code":409,"message":"one or more books in the batch already exist"}}` + "\n",
+		},
+		{
+			body:     `[{"ISBN":"978-1503379640","Title":"The Prince","Genre":"Philosophy","Price":"6.99"},{"ISBN":"978-1503379641","Title":"Title","Genre":"Philosophy","Price":"1.00"}]`,
+			code:     422,
+			expected: `{"index":1,"errors":{"ISBN":"invalid checksum"}}` + "\n",
+		},
+		{
+			body:     `[{"ISBN":"978-1503379640","Title":"The Prince","Genre":"Philosophy","Price":"6.99"},{"ISBN":"978-0306406157","Price":"1.00"}]`,
+			code:     422,
+			expected: `{"index":1,"errors":{"Genre":"must not be empty","Title":"must not be empty"}}` + "\n",
+		},
+		{
+			body:     `[]`,
+			code:     400,
+			expected: `{"error":{"code":400,"message":"batch must contain at least one book"}}` + "\n",
+		},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/books/batch", strings.NewReader(tt.body))
+
+		http.HandlerFunc(env.createBooks).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.code, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+		}
+		if tt.expected != rec.Body.String() {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestCreateBatchRollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare("INSERT INTO books")
+	prep.ExpectExec().WithArgs("978-1503379640", "The Prince", "Niccolò Machiavelli", "Philosophy", "6.99", 0, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 0, 0).
+		WillReturnError(&pq.Error{Code: "23505"})
+	mock.ExpectRollback()
+
+	bks := []Book{
+		{Isbn: "978-1503379640", Title: "The Prince", Author: "Niccolò Machiavelli", Genre: "Philosophy", Price: 699},
+		{Isbn: "978-1505255607", Title: "The Time Machine", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599},
+	}
+
+	err = BookModel{DB: db}.CreateBatch(context.Background(), bks)
+	if !isUniqueViolation(err) {
+		t.Errorf("expected a unique violation, obtained %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateBatchStrictDedup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dedup := regexp.QuoteMeta("SELECT isbn FROM books WHERE LOWER(title)=LOWER($1) AND LOWER(author)=LOWER($2) LIMIT 1;")
+
+	mock.ExpectBegin()
+	prep := mock.ExpectPrepare("INSERT INTO books")
+	mock.ExpectQuery(dedup).WithArgs("The Prince", "Niccolò Machiavelli").WillReturnRows(sqlmock.NewRows([]string{"isbn"}))
+	prep.ExpectExec().WithArgs("978-1503379640", "The Prince", "Niccolò Machiavelli", "Philosophy", "6.99", 0, 0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(dedup).WithArgs("the time machine", "H. G. Wells").
+		WillReturnRows(sqlmock.NewRows([]string{"isbn"}).AddRow("978-1505255607"))
+	mock.ExpectRollback()
+
+	env := Env{books: BookModel{DB: db, StrictDedup: true}}
+
+	rec := httptest.NewRecorder()
+	body := strings.NewReader(`[{"ISBN":"978-1503379640","Title":"The Prince","Author":"Niccolò Machiavelli","Genre":"Philosophy","Price":"6.99"},{"ISBN":"978-0000000002","Title":"the time machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99"}]`)
+	req, _ := http.NewRequest("POST", "/v1/books/batch", body)
+
+	http.HandlerFunc(env.createBooks).ServeHTTP(rec, req)
+
+	if rec.Code != 409 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 409, rec.Code)
+	}
+	expected := `{"error":{"code":409,"message":"a book in the batch has the same title and author as ISBN 978-1505255607"}}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreateStrictDedup(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		code     int
+		expected string
+	}{
+		{
+			name:     "duplicate",
+			existing: "978-1505255607",
+			code:     409,
+			expected: `{"error":{"code":409,"message":"a book with this title and author already exists with ISBN 978-1505255607"}}` + "\n",
+		},
+		{name: "new edition", code: 201},
+	}
+
+	for _, tt := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		dedup := mock.ExpectQuery(regexp.QuoteMeta("SELECT isbn FROM books WHERE LOWER(title)=LOWER($1) AND LOWER(author)=LOWER($2) LIMIT 1;")).
+			WithArgs("the time machine", "H. G. Wells")
+		if tt.existing != "" {
+			dedup.WillReturnRows(sqlmock.NewRows([]string{"isbn"}).AddRow(tt.existing))
+		} else {
+			dedup.WillReturnRows(sqlmock.NewRows([]string{"isbn"}))
+			mock.ExpectPrepare("INSERT INTO books").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+		}
+
+		env := Env{books: BookModel{DB: db, StrictDedup: true}}
+
+		rec := httptest.NewRecorder()
+		body := strings.NewReader(`{"ISBN":"978-0000000002","Title":"the time machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99"}`)
+		req, _ := http.NewRequest("POST", "/v1/books", body)
+
+		http.HandlerFunc(env.createBook).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.expected != "" && tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Body.String())
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestCreateWithoutStrictDedup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Without STRICT_DEDUP there is no title and author lookup.
+	mock.ExpectPrepare("INSERT INTO books").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+
+	bk := Book{Isbn: "978-0000000002", Title: "The Time Machine", Author: "H. G. Wells", Genre: "Science Fiction", Price: 599}
+	err = BookModel{DB: db}.Create(context.Background(), &bk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecrementStock(t *testing.T) {
+	tests := []struct {
+		name     string
+		affected int64
+		exists   bool
+		expected error
+	}{
+		{name: "in stock", affected: 1, expected: nil},
+		{name: "insufficient stock", affected: 0, exists: true, expected: ErrInsufficientStock},
+		{name: "missing book", affected: 0, exists: false, expected: ErrBookNotFound},
+	}
+
+	for _, tt := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectPrepare("UPDATE books SET quantity = quantity - \\$1").
+			ExpectExec().
+			WithArgs(3, "978-1505255607").
+			WillReturnResult(sqlmock.NewResult(0, tt.affected))
+		if tt.affected == 0 {
+			mock.ExpectQuery("SELECT EXISTS").
+				WithArgs("978-1505255607").
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.exists))
+		}
+
+		err = BookModel{DB: db}.DecrementStock(context.Background(), "978-1505255607", 3)
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestPurchaseBook(t *testing.T) {
+	tests := []struct {
+		name     string
+		isbn     string
+		body     string
+		code     int
+		expected string
+	}{
+		{name: "in stock", isbn: "978-1505255607", body: `{"quantity":2}`, code: 200, expected: `{"remaining":0}` + "\n"},
+		{name: "insufficient stock", isbn: "978-1505255607", body: `{"quantity":3}`, code: 409, expected: `{"error":{"code":409,"message":"not enough copies in stock"}}` + "\n"},
+		{name: "missing book", isbn: "978-0000000000", body: `{"quantity":1}`, code: 404},
+		{name: "zero quantity", isbn: "978-1505255607", body: `{"quantity":0}`, code: 422, expected: `{"field":"quantity","message":"must be at least 1"}` + "\n"},
+		{name: "bad body", isbn: "978-1505255607", body: `{"quantity":"one"}`, code: 400},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/v1/books/"+tt.isbn+"/purchase", strings.NewReader(tt.body))
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+
+		http.HandlerFunc(env.purchaseBook).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.expected != "" && tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestSetStock(t *testing.T) {
+	tests := []struct {
+		name     string
+		isbn     string
+		body     string
+		code     int
+		expected string
+	}{
+		{name: "set", isbn: "978-1505255607", body: `{"quantity":12}`, code: 200, expected: `{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":12}` + "\n"},
+		{name: "out of stock", isbn: "978-1505255607", body: `{"quantity":0}`, code: 200, expected: `{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"H. G. Wells","Genre":"Science Fiction","Price":"5.99","Quantity":0}` + "\n"},
+		{name: "negative", isbn: "978-1505255607", body: `{"quantity":-1}`, code: 422, expected: `{"field":"quantity","message":"must not be negative"}` + "\n"},
+		{name: "missing book", isbn: "978-0000000000", body: `{"quantity":1}`, code: 404},
+		{name: "bad body", isbn: "978-1505255607", body: `{"quantity":1.5}`, code: 400},
+	}
+
+	env := Env{books: &mockBookModel{}}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/v1/books/"+tt.isbn+"/stock", strings.NewReader(tt.body))
+		req = mux.SetURLVars(req, map[string]string{"isbn": tt.isbn})
+
+		http.HandlerFunc(env.setStock).ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+		if tt.expected != "" && tt.expected != rec.Body.String() {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestSetStockQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectPrepare(regexp.QuoteMeta("UPDATE books SET quantity=$1 WHERE isbn=$2 RETURNING "+bookColumns+";")).
+		ExpectQuery().
+		WithArgs(7, "978-1505255607").
+		WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+			AddRow("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 7, 1895, 1))
+
+	bk, err := BookModel{DB: db}.SetStock(context.Background(), "978-1505255607", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bk.Quantity != 7 || bk.PublishedYear != 1895 {
+		t.Errorf("unexpected book %+v", bk)
+	}
+
+	// A negative quantity never reaches the database.
+	if _, err := (BookModel{DB: db}).SetStock(context.Background(), "978-1505255607", -1); err == nil {
+		t.Error("expected an error for a negative quantity")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// stockBookModel holds one book's stock behind a mutex, standing in for the
+// row lock Purchase takes in Postgres.
+type stockBookModel struct {
+	mockBookModel
+	mu    sync.Mutex
+	stock int
+}
+
+func (m *stockBookModel) Purchase(ctx context.Context, isbn string, n int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stock < n {
+		return 0, ErrInsufficientStock
+	}
+	m.stock -= n
+
+	return m.stock, nil
+}
+
+func TestPurchaseBookConcurrent(t *testing.T) {
+	books := &stockBookModel{stock: 5}
+	env := Env{books: books}
+
+	var wg sync.WaitGroup
+	codes := make([]int, 20)
+
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			rec := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/v1/books/978-1505255607/purchase", strings.NewReader(`{"quantity":1}`))
+			req = mux.SetURLVars(req, map[string]string{"isbn": "978-1505255607"})
+
+			http.HandlerFunc(env.purchaseBook).ServeHTTP(rec, req)
+			codes[i] = rec.Code
+		}(i)
+	}
+	wg.Wait()
+
+	sold := 0
+	for _, code := range codes {
+		if code == 200 {
+			sold++
+		} else if code != 409 {
+			t.Errorf("\n...expected = 200 or 409\n...obtained = %v", code)
+		}
+	}
+	if sold != 5 || books.stock != 0 {
+		t.Errorf("expected 5 sold leaving 0 in stock, obtained %d sold leaving %d", sold, books.stock)
+	}
+}
+
+func TestPurchaseQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining int
+		updated   bool
+		exists    bool
+		expected  error
+	}{
+		{name: "in stock", remaining: 2, updated: true, expected: nil},
+		{name: "insufficient stock", exists: true, expected: ErrInsufficientStock},
+		{name: "missing book", exists: false, expected: ErrBookNotFound},
+	}
+
+	for _, tt := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectBegin()
+		rows := sqlmock.NewRows([]string{"quantity"})
+		if tt.updated {
+			rows.AddRow(tt.remaining)
+		}
+		mock.ExpectQuery(regexp.QuoteMeta("UPDATE books SET quantity = quantity - $1 WHERE isbn=$2 AND quantity >= $1 RETURNING quantity;")).
+			WithArgs(3, "978-1505255607").
+			WillReturnRows(rows)
+		if tt.updated {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO purchases (isbn, quantity) VALUES ($1, $2);")).
+				WithArgs("978-1505255607", 3).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+		} else {
+			mock.ExpectQuery("SELECT EXISTS").
+				WithArgs("978-1505255607").
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.exists))
+			mock.ExpectRollback()
+		}
+
+		remaining, err := BookModel{DB: db}.Purchase(context.Background(), "978-1505255607", 3)
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, err)
+		}
+		if remaining != tt.remaining {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.remaining, remaining)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		db.Close()
+	}
+}
+
+func TestLoadConfigWithoutVault(t *testing.T) {
+	t.Setenv(VAULT_ENABLED, "false")
+	t.Setenv(DB_HOST, "localhost")
+
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.GetString(DB_HOST); got != "localhost" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "localhost", got)
+	}
+	if got := c.GetInt(DB_MAX_OPEN); got != 20 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 20, got)
+	}
+}
+
+func TestV1Routes(t *testing.T) {
+	env := Env{books: &mockBookModel{}, app: &mockApp{}}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/healthz", env.appHealth).Methods("GET")
+	env.registerV1(router.PathPrefix("/v1").Subrouter())
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/v1/books/978-1505255607", 200},
+		{"/books/978-1505255607", 404},
+		{"/healthz", 200},
+		{"/v1/healthz", 404},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", tt.path, nil)
+
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.path, tt.code, rec.Code)
+		}
+	}
+}
+
+func TestCount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM books").
+		ExpectQuery().
+		WithArgs("wells").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(7))
+
+	n, err := BookModel{DB: db}.Count(context.Background(), BookFilter{Query: "wells"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 7 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 7, n)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNilDB(t *testing.T) {
+	env := Env{books: BookModel{}, app: App{}}
+
+	router := mux.NewRouter()
+	env.registerV1(router.PathPrefix("/v1").Subrouter())
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{method: "GET", target: "/v1/books"},
+		{method: "GET", target: "/v1/books/978-1505255607"},
+		{method: "GET", target: "/v1/stats"},
+		{method: "POST", target: "/v1/books", body: `{"ISBN":"978-1503290334","Title":"The Invisible Man","Author":"H. G. Wells","Genre":"Science Fiction","Price":"6.99"}`},
+		{method: "DELETE", target: "/v1/books/978-1505255607"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != 503 {
+			t.Errorf("%s %s:\n...expected = %v\n...obtained = %v", tt.method, tt.target, 503, rec.Code)
+		}
+
+		expected := `{"error":{"code":503,"message":"database unavailable"}}` + "\n"
+		if expected != rec.Body.String() {
+			t.Errorf("%s %s:\n...expected = %v\n...obtained = %v", tt.method, tt.target, expected, rec.Body.String())
+		}
+	}
+
+	if err := (App{}).CheckDBConn(context.Background()); !errors.Is(err, ErrDBUnavailable) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", ErrDBUnavailable, err)
+	}
+}
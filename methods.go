@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// methodNotAllowed answers requests whose path matches a route but whose
+// method doesn't, listing the route's methods in the Allow header. OPTIONS
+// requests get the same header with a 204 instead of a 405.
+func methodNotAllowed(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", strings.Join(allowedMethods(router, r.URL.Path), ", "))
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		RespondError(w, 405, http.StatusText(405))
+	})
+}
+
+// allowedMethods returns the methods registered on router for path, plus
+// OPTIONS, sorted.
+func allowedMethods(router *mux.Router, path string) []string {
+	seen := map[string]bool{http.MethodOptions: true}
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		var match mux.RouteMatch
+		req := &http.Request{Method: methods[0], URL: &url.URL{Path: path}}
+		if route.Match(req, &match) {
+			for _, m := range methods {
+				seen[m] = true
+			}
+		}
+
+		return nil
+	})
+
+	methods := make([]string, 0, len(seen))
+	for m := range seen {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+
+	return methods
+}
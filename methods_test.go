@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMethodNotAllowed(t *testing.T) {
+	env := Env{books: &mockBookModel{}, app: &mockApp{}}
+
+	router := mux.NewRouter()
+	router.MethodNotAllowedHandler = methodNotAllowed(router)
+	router.HandleFunc("/healthz", env.appHealth).Methods("GET")
+	env.registerV1(router.PathPrefix("/v1").Subrouter())
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		allow  string
+	}{
+		{"PUT", "/v1/books", 405, "DELETE, GET, OPTIONS, POST"},
+		{"OPTIONS", "/v1/books", 204, "DELETE, GET, OPTIONS, POST"},
+		{"POST", "/v1/books/978-1505255607", 405, "DELETE, GET, HEAD, OPTIONS, PATCH, PUT"},
+		{"DELETE", "/healthz", 405, "GET, OPTIONS"},
+		{"GET", "/v1/books", 200, ""},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, tt.path, nil)
+
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.code {
+			t.Errorf("\n%s %s\n...expected = %v\n...obtained = %v", tt.method, tt.path, tt.code, rec.Code)
+		}
+		if got := rec.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("\n%s %s\n...expected = %v\n...obtained = %v", tt.method, tt.path, tt.allow, got)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the Prometheus collectors exported at /metrics.
+type Metrics struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	dbErrors *prometheus.CounterVec
+
+	dbQueries  *prometheus.CounterVec
+	dbDuration *prometheus.HistogramVec
+}
+
+// NewMetrics creates the collectors and registers them with reg, so tests
+// can pass their own registry.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Total number of HTTP requests.",
+		}, []string{"method", "path", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "path"}),
+		dbErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_errors_total",
+			Help: "Total number of failed database operations.",
+		}, []string{"operation"}),
+		dbQueries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "db_queries_total",
+			Help: "Total number of database operations.",
+		}, []string{"operation", "outcome"}),
+		dbDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "db_query_duration_seconds",
+			Help:    "Database operation latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"operation", "outcome"}),
+	}
+
+	reg.MustRegister(m.requests, m.duration, m.dbErrors, m.dbQueries, m.dbDuration)
+
+	return m
+}
+
+// Middleware records the request count and latency. Routes are labelled by
+// their template (e.g. /books/{isbn}) to keep label cardinality bounded.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		// Count a panic as the 500 recoverPanic will answer it with.
+		panicked := true
+		defer func() {
+			if panicked {
+				rec.status = http.StatusInternalServerError
+			}
+
+			path := r.URL.Path
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					path = tmpl
+				}
+			}
+
+			m.requests.WithLabelValues(r.Method, path, strconv.Itoa(rec.status)).Inc()
+			m.duration.WithLabelValues(r.Method, path).Observe(time.Since(start).Seconds())
+		}()
+
+		next.ServeHTTP(rec, r)
+		panicked = false
+	})
+}
+
+// isDBFailure reports whether err is a real database failure rather than nil
+// or an expected outcome such as a missing book, a duplicate or a stale
+// version.
+func isDBFailure(err error) bool {
+	var dup *DuplicateBookError
+
+	return err != nil && !errors.Is(err, ErrBookNotFound) && !errors.Is(err, ErrInsufficientStock) &&
+		!errors.Is(err, ErrVersionConflict) && !errors.As(err, &dup)
+}
+
+// recordDBError counts err against op if it is a real database failure. It
+// is safe to call on a nil *Metrics.
+func (m *Metrics) recordDBError(op string, err error) {
+	if m == nil || !isDBFailure(err) {
+		return
+	}
+
+	m.dbErrors.WithLabelValues(op).Inc()
+}
+
+// recordDBQuery counts a database operation and its latency against op,
+// with an outcome of error for real failures and ok otherwise. It is safe to
+// call on a nil *Metrics.
+func (m *Metrics) recordDBQuery(op string, err error, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+
+	outcome := "ok"
+	if isDBFailure(err) {
+		outcome = "error"
+	}
+
+	m.dbQueries.WithLabelValues(op, outcome).Inc()
+	m.dbDuration.WithLabelValues(op, outcome).Observe(elapsed.Seconds())
+}
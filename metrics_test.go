@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	env := Env{books: &mockBookModel{}}
+
+	router := mux.NewRouter()
+	router.Use(metrics.Middleware)
+	env.registerV1(router.PathPrefix("/v1").Subrouter())
+
+	for _, isbn := range []string{"978-1505255607", "978-1505255607", "978-0000000002"} {
+		req, _ := http.NewRequest("GET", "/v1/books/"+isbn, nil)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if n := testutil.ToFloat64(metrics.requests.WithLabelValues("GET", "/v1/books/{isbn}", "200")); n != 2 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 2, n)
+	}
+	if n := testutil.ToFloat64(metrics.requests.WithLabelValues("GET", "/v1/books/{isbn}", "404")); n != 1 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 1, n)
+	}
+}
+
+func TestRecordDBError(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	metrics.recordDBError("get", nil)
+	metrics.recordDBError("get", ErrBookNotFound)
+	metrics.recordDBError("get", ErrInsufficientStock)
+	metrics.recordDBError("get", ErrVersionConflict)
+	metrics.recordDBError("get", fmt.Errorf("create: %w", &DuplicateBookError{Isbn: "978-1505255607"}))
+	metrics.recordDBError("get", errors.New("connection reset"))
+
+	if n := testutil.ToFloat64(metrics.dbErrors.WithLabelValues("get")); n != 1 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 1, n)
+	}
+
+	// A model built without metrics must not panic.
+	var nilMetrics *Metrics
+	nilMetrics.recordDBError("get", errors.New("connection reset"))
+}
+
+func TestDBQueryMetrics(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	m := BookModel{DB: db, Metrics: metrics}
+	bk := Book{Isbn: "978-1503290334", Title: "The Invisible Man", Price: 699}
+
+	mock.ExpectPrepare("INSERT INTO books").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectPrepare("INSERT INTO books").ExpectExec().WillReturnError(errors.New("connection reset"))
+
+	if err := m.Create(context.Background(), &bk); err != nil {
+		t.Fatal(err)
+	}
+	m.Create(context.Background(), &bk)
+
+	tests := []struct {
+		outcome  string
+		expected float64
+	}{
+		{outcome: "ok", expected: 1},
+		{outcome: "error", expected: 1},
+	}
+
+	for _, tt := range tests {
+		if n := testutil.ToFloat64(metrics.dbQueries.WithLabelValues("create", tt.outcome)); n != tt.expected {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.outcome, tt.expected, n)
+		}
+	}
+	if n := testutil.CollectAndCount(metrics.dbDuration, "db_query_duration_seconds"); n != 2 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 2, n)
+	}
+}
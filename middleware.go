@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"mime"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Middleware wraps a handler with extra behaviour, like mux.MiddlewareFunc.
+type Middleware func(http.Handler) http.Handler
+
+// chain wraps h in mw so that requests pass through mw in the order listed:
+// mw[0] is outermost and sees each request first.
+func chain(h http.Handler, mw ...Middleware) http.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+
+	return h
+}
+
+// statusRecorder captures the status code written by the wrapped handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the underlying connection.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// requestLogger logs the method, path, status code and latency of every
+// request served by the router.
+func requestLogger(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			// A panic unwinds through here to recoverPanic, which answers
+			// with a 500, so log it as one.
+			panicked := true
+			defer func() {
+				if panicked {
+					rec.status = http.StatusInternalServerError
+				}
+
+				logger.InfoContext(r.Context(), "request",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"status", rec.status,
+					"duration", time.Since(start),
+				)
+			}()
+
+			next.ServeHTTP(rec, r)
+			panicked = false
+		})
+	}
+}
+
+// recoverPanic turns a panicking handler into a 500 response and logs the
+// stack trace, so one bad request can't take down the server.
+func recoverPanic(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				logger.ErrorContext(r.Context(), "panic serving request",
+					"method", r.Method,
+					"path", r.URL.Path,
+					"error", err,
+					"stack", string(debug.Stack()),
+				)
+				RespondError(w, 500, http.StatusText(500))
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// timeout aborts handlers that run longer than d and responds with a 503. The
+// request context is cancelled at the deadline, which also cancels any
+// in-flight database query.
+//
+// http.TimeoutHandler buffers the whole response, so routes named in
+// streaming are served directly, without a deadline.
+func timeout(d time.Duration, streaming ...string) func(http.Handler) http.Handler {
+	var body errorBody
+	body.Error.Code = 503
+	body.Error.Message = "request timed out"
+	msg, _ := json.Marshal(body)
+
+	exempt := map[string]bool{}
+	for _, name := range streaming {
+		exempt[name] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		th := http.TimeoutHandler(next, d, string(msg))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil && exempt[route.GetName()] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			th.ServeHTTP(timeoutWriter{w}, r)
+		})
+	}
+}
+
+// requireJSON rejects POST, PUT and PATCH requests whose body isn't labelled
+// application/json with a 415, rather than trying to decode whatever was
+// sent. A charset parameter is allowed as long as it is UTF-8, the only
+// encoding JSON has. Routes named in exempt take other media types and check
+// them themselves.
+func requireJSON(exempt ...string) func(http.Handler) http.Handler {
+	skip := map[string]bool{}
+	for _, name := range exempt {
+		skip[name] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case "POST", "PUT", "PATCH":
+			default:
+				next.ServeHTTP(w, r)
+				return
+			}
+			if route := mux.CurrentRoute(r); route != nil && skip[route.GetName()] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				RespondError(w, 415, "Content-Type must be application/json")
+				return
+			}
+			if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+				RespondError(w, 415, "Content-Type charset must be utf-8")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// timeoutWriter labels the body http.TimeoutHandler writes on timeout as
+// JSON. Handler responses already carry their own Content-Type by the time
+// the header is written, so they are left alone.
+type timeoutWriter struct {
+	http.ResponseWriter
+}
+
+func (w timeoutWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
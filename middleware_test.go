@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	h := requestLogger(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+	}))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books/978-1505255607", nil)
+
+	h.ServeHTTP(rec, req)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+
+	if entry["method"] != "GET" || entry["path"] != "/v1/books/978-1505255607" || entry["status"] != float64(404) {
+		t.Errorf("unexpected log entry: %v", entry)
+	}
+	if _, ok := entry["duration"]; !ok {
+		t.Errorf("log entry is missing duration: %v", entry)
+	}
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	h := recoverPanic(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var bk *Book
+		w.Write([]byte(bk.Title))
+	}))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 500 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 500, rec.Code)
+	}
+
+	expected := `{"error":{"code":500,"message":"Internal Server Error"}}`
+	if got := strings.TrimSpace(rec.Body.String()); got != expected {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, got)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "panic serving request" || !strings.Contains(entry["stack"].(string), "TestRecoverPanic") {
+		t.Errorf("unexpected log entry: %v", entry)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), trace("recovery"), trace("requestID"), trace("logging"), trace("metrics"), trace("auth"))
+
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := "recovery,requestID,logging,metrics,auth,handler"
+	if got := strings.Join(order, ","); got != expected {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, got)
+	}
+}
+
+func TestChainPanic(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(requestIDHandler{slog.NewJSONHandler(&buf, nil)})
+
+	h := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}), recoverPanic(logger), requestID, requestLogger(logger), gzipResponse)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("X-Request-ID", "abc-123")
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 500 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 500, rec.Code)
+	}
+
+	// The access log still records the request, as the 500 it became.
+	var entry map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["msg"] == "request" {
+			break
+		}
+	}
+	if entry["msg"] != "request" || entry["status"] != float64(500) || entry["request_id"] != "abc-123" {
+		t.Errorf("unexpected log entry: %v", entry)
+	}
+}
+
+// slowBookModel blocks List until the request context is cancelled, like a
+// query stuck on a lock.
+type slowBookModel struct {
+	mockBookModel
+	cancelled chan error
+}
+
+func (m *slowBookModel) List(ctx context.Context, filter BookFilter, limit, offset int, order BookSort) ([]Book, error) {
+	<-ctx.Done()
+	m.cancelled <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	books := &slowBookModel{cancelled: make(chan error, 1)}
+	env := Env{books: books}
+
+	h := timeout(10 * time.Millisecond)(http.HandlerFunc(env.booksIndex))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
+
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != 503 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 503, rec.Code)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", got)
+	}
+
+	expected := `{"error":{"code":503,"message":"request timed out"}}`
+	if got := rec.Body.String(); got != expected {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, got)
+	}
+
+	if err := <-books.cancelled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestRequireJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		code        int
+	}{
+		{name: "json", method: "POST", path: "/v1/books", contentType: "application/json", code: 200},
+		{name: "charset", method: "PUT", path: "/v1/books", contentType: "application/json; charset=UTF-8", code: 200},
+		{name: "missing", method: "POST", path: "/v1/books", code: 415},
+		{name: "wrong", method: "PATCH", path: "/v1/books", contentType: "text/plain", code: 415},
+		{name: "wrong charset", method: "POST", path: "/v1/books", contentType: "application/json; charset=latin1", code: 415},
+		{name: "malformed", method: "POST", path: "/v1/books", contentType: "application/json; charset", code: 415},
+		{name: "read", method: "GET", path: "/v1/books", code: 200},
+		{name: "delete", method: "DELETE", path: "/v1/books", code: 200},
+		{name: "exempt route", method: "POST", path: "/v1/books/import", contentType: "text/csv", code: 200},
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router := mux.NewRouter()
+	router.Use(requireJSON(importCSVRoute))
+	router.Handle("/v1/books", ok)
+	router.Handle("/v1/books/import", ok).Name(importCSVRoute)
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, tt.path, strings.NewReader(`{}`))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+
+		router.ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.code, rec.Code)
+		}
+	}
+}
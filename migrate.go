@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migrationLockID is the Postgres advisory lock key held while migrating, so
+// pods starting at the same time don't race each other.
+const migrationLockID = 7355608
+
+// runMigrations applies every embedded migration not yet recorded in the
+// schema_migrations table, in filename order. All pending migrations run in
+// one transaction, so a failure leaves the schema untouched.
+func runMigrations(ctx context.Context, db *sql.DB, migrations fs.FS) error {
+	names, err := fs.Glob(migrations, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Waiting for another pod's migrations, or rewriting a large table, can
+	// take longer than DB_STATEMENT_TIMEOUT allows.
+	_, err = tx.ExecContext(ctx, "SET LOCAL statement_timeout = 0;")
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1);", migrationLockID)
+	if err != nil {
+		return fmt.Errorf("acquire migration lock: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version varchar(255) NOT NULL PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	);`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	applied, err := appliedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+		if applied[version] {
+			continue
+		}
+
+		body, err := fs.ReadFile(migrations, name)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, string(body))
+		if err != nil {
+			return fmt.Errorf("apply migration %s: %w", version, err)
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1);", version)
+		if err != nil {
+			return fmt.Errorf("record migration %s: %w", version, err)
+		}
+
+		slog.InfoContext(ctx, "applied migration", "version", version)
+	}
+
+	return tx.Commit()
+}
+
+func appliedMigrations(ctx context.Context, tx *sql.Tx) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT version FROM schema_migrations;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[string]bool{}
+
+	for rows.Next() {
+		var version string
+
+		err := rows.Scan(&version)
+		if err != nil {
+			return nil, err
+		}
+
+		applied[version] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRunMigrations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations := fstest.MapFS{
+		"migrations/0001_create_books.sql":       {Data: []byte("CREATE TABLE books ();")},
+		"migrations/0002_add_books_quantity.sql": {Data: []byte("ALTER TABLE books ADD COLUMN quantity integer;")},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("0001_create_books"))
+	mock.ExpectExec("ALTER TABLE books ADD COLUMN quantity").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs("0002_add_books_quantity").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = runMigrations(context.Background(), db, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRunMigrationsRollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations := fstest.MapFS{
+		"migrations/0001_create_books.sql": {Data: []byte("CREATE TABLE books ();")},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SET LOCAL statement_timeout = 0").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("SELECT pg_advisory_xact_lock").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectExec("CREATE TABLE books").WillReturnError(errors.New("syntax error"))
+	mock.ExpectRollback()
+
+	err = runMigrations(context.Background(), db, migrations)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	data, err := migrationsFS.ReadFile("migrations/0001_create_books.sql")
+	if err != nil || len(data) == 0 {
+		t.Errorf("expected embedded migration, obtained %v", err)
+	}
+}
+
+// TestNormalizeISBNsMigration runs 0009_normalize_isbns against a real
+// Postgres, since sqlmock can't check what SQL does. It needs
+// TEST_DATABASE_URL, and works in a schema of its own that it drops after.
+func TestNormalizeISBNsMigration(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// One connection, so the search_path applies to every statement.
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	schema := fmt.Sprintf("migration_test_%d", os.Getpid())
+
+	if _, err := db.ExecContext(ctx, "CREATE SCHEMA "+schema+"; SET search_path TO "+schema+";"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE;")
+
+	// Migrate up to the one under test, then add the rows it must fix, or
+	// leave alone.
+	before := fstest.MapFS{}
+	names, err := fs.Glob(migrationsFS, "migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if name < "migrations/0009" {
+			data, _ := migrationsFS.ReadFile(name)
+			before[name] = &fstest.MapFile{Data: data}
+		}
+	}
+	if err := runMigrations(ctx, db, before); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.ExecContext(ctx, `
+		INSERT INTO books (isbn, title, author, price) VALUES
+			('0-306-40615-2', 'ISBN-10', 'A', 1),
+			('080442957X', 'ISBN-10 ending in X', 'A', 1),
+			('9781505255607', 'Unhyphenated ISBN-13', 'A', 1),
+			('12345abcd9', 'Ten characters, not digits', 'A', 1),
+			('978-12345abcde', 'Thirteen characters, not digits', 'A', 1);
+		INSERT INTO purchases (isbn, quantity) VALUES ('0-306-40615-2', 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runMigrations(ctx, db, migrationsFS); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"ISBN-10":                         "978-0306406157",
+		"ISBN-10 ending in X":             "978-0804429573",
+		"Unhyphenated ISBN-13":            "978-1505255607",
+		"Ten characters, not digits":      "12345abcd9",
+		"Thirteen characters, not digits": "978-12345abcde",
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT title, isbn FROM books;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var title, isbn string
+		if err := rows.Scan(&title, &isbn); err != nil {
+			t.Fatal(err)
+		}
+		if isbn = strings.TrimSpace(isbn); isbn != expected[title] {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", title, expected[title], isbn)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var purchased string
+	if err := db.QueryRowContext(ctx, "SELECT isbn FROM purchases;").Scan(&purchased); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(purchased) != "978-0306406157" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "978-0306406157", purchased)
+	}
+}
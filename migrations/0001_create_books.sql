@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS books (
+    isbn char(14) NOT NULL PRIMARY KEY,
+    title varchar(255) NOT NULL,
+    author varchar(255) NOT NULL,
+    price decimal(5,2) NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS quantity integer NOT NULL DEFAULT 0 CHECK (quantity >= 0);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    subject varchar(255) NOT NULL,
+    key varchar(255) NOT NULL,
+    fingerprint bytea NOT NULL,
+    status integer NOT NULL,
+    content_type varchar(255) NOT NULL,
+    body bytea NOT NULL,
+    created_at timestamptz NOT NULL,
+    PRIMARY KEY (subject, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);
@@ -0,0 +1 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS genre varchar(64) NOT NULL DEFAULT '';
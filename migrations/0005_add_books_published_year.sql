@@ -0,0 +1 @@
+ALTER TABLE books ADD COLUMN IF NOT EXISTS published_year integer NOT NULL DEFAULT 0;
@@ -0,0 +1,24 @@
+-- Store every ISBN the way normalizeISBN writes it: the ISBN-13, as its
+-- three-digit prefix, a hyphen and the other ten digits. ISBN-10s get 978
+-- and a recomputed check digit. A book whose new ISBN another book already
+-- has is left alone, for someone to merge by hand, as is any ISBN that
+-- isn't ten or thirteen digits, an ISBN-10 possibly ending in X.
+CREATE TEMPORARY TABLE isbn_renames ON COMMIT DROP AS
+SELECT isbn AS old_isbn,
+       CASE length(digits)
+           WHEN 13 THEN substr(digits, 1, 3) || '-' || substr(digits, 4)
+           ELSE '978-' || substr(digits, 1, 9) || ((10 - (
+               SELECT sum(substr('978' || digits, i, 1)::int * CASE WHEN i % 2 = 0 THEN 3 ELSE 1 END)
+               FROM generate_series(1, 12) AS i
+           ) % 10) % 10)::text
+       END AS new_isbn
+FROM (SELECT isbn, replace(trim(isbn), '-', '') AS digits FROM books) AS b
+WHERE digits ~ '^[0-9]{9}[0-9Xx]$' OR digits ~ '^[0-9]{13}$';
+
+DELETE FROM isbn_renames
+WHERE trim(old_isbn) = new_isbn
+   OR new_isbn IN (SELECT trim(isbn) FROM books)
+   OR new_isbn IN (SELECT new_isbn FROM isbn_renames GROUP BY new_isbn HAVING count(*) > 1);
+
+UPDATE purchases SET isbn = r.new_isbn FROM isbn_renames r WHERE purchases.isbn = r.old_isbn;
+UPDATE books SET isbn = r.new_isbn FROM isbn_renames r WHERE books.isbn = r.old_isbn;
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// negotiate picks the response media type for the Accept header: XML if the
+// client prefers application/xml or text/xml over JSON, otherwise JSON.
+func negotiate(r *http.Request) string {
+	best, bestQ := "application/json", -1.0
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		var candidate string
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			candidate = "application/json"
+		case "application/xml", "text/xml":
+			candidate = "application/xml"
+		default:
+			continue
+		}
+
+		// Ties go to JSON, the default.
+		if q > bestQ || q == bestQ && candidate == "application/json" {
+			best, bestQ = candidate, q
+		}
+	}
+
+	return best
+}
+
+// marshalEntity encodes v in the negotiated format, returning the body and
+// its Content-Type. JSON is indented when the request asked for
+// ?pretty=true.
+func marshalEntity(r *http.Request, v any) ([]byte, string, error) {
+	return encodeEntity(v, negotiate(r), prettyRequested(r))
+}
+
+// encodeEntity encodes v as mediaType, application/json or application/xml,
+// returning the body and its Content-Type. pretty indents JSON.
+func encodeEntity(v any, mediaType string, pretty bool) ([]byte, string, error) {
+	if mediaType == "application/xml" {
+		body, err := xml.Marshal(v)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return append([]byte(xml.Header), append(body, '\n')...), "application/xml; charset=utf-8", nil
+	}
+
+	var body []byte
+	var err error
+	if pretty {
+		body, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return append(body, '\n'), "application/json", nil
+}
+
+// writeEntity writes v as JSON or XML according to the Accept header, with
+// the given status code.
+func writeEntity(w http.ResponseWriter, r *http.Request, code int, v any) {
+	body, contentType, err := marshalEntity(r, v)
+	if err != nil {
+		logError(r, err)
+		RespondError(w, 500, http.StatusText(500))
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(code)
+	w.Write(body)
+}
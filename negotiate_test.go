@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", "application/json"},
+		{"application/json", "application/json"},
+		{"application/xml", "application/xml"},
+		{"text/xml", "application/xml"},
+		{"application/xml, application/json", "application/json"},
+		{"application/json;q=0.5, application/xml", "application/xml"},
+		{"*/*", "application/json"},
+		{"text/html", "application/json"},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/v1/books", nil)
+		req.Header.Set("Accept", tt.accept)
+
+		if got := negotiate(req); got != tt.expected {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.accept, tt.expected, got)
+		}
+	}
+}
+
+func TestBookByISBNXML(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books/978-1505255607", nil)
+	req = mux.SetURLVars(req, map[string]string{"isbn": "978-1505255607"})
+	req.Header.Set("Accept", "application/xml")
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.bookByISBN).ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Content-Type"); got != "application/xml; charset=utf-8" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/xml; charset=utf-8", got)
+	}
+
+	var bk Book
+	if err := xml.Unmarshal(rec.Body.Bytes(), &bk); err != nil {
+		t.Fatalf("response is not well-formed XML: %v\n%s", err, rec.Body.String())
+	}
+
+	expected := xml.Header + `<Book><ISBN>978-1505255607</ISBN><Title>The Time Machine</Title><Author>H. G. Wells</Author><Genre>Science Fiction</Genre><Price>5.99</Price><Quantity>0</Quantity></Book>` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestBooksIndexXML(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books?limit=1", nil)
+	req.Header.Set("Accept", "application/xml")
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.booksIndex).ServeHTTP(rec, req)
+
+	expected := xml.Header + `<BookPage><books><Book><ISBN>978-1503261969</ISBN><Title>Emma</Title><Author>Jayne Austen</Author><Genre>Romance</Genre><Price>9.44</Price><Quantity>0</Quantity></Book></books><total>2</total><limit>1</limit><offset>0</offset></BookPage>` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+type openAPIDoc struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+func loadOpenAPI(t *testing.T) openAPIDoc {
+	t.Helper()
+
+	var doc openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatalf("openapi.json is not valid JSON: %v", err)
+	}
+
+	return doc
+}
+
+func jsonFields(v any) []string {
+	var fields []string
+
+	typ := reflect.TypeOf(v)
+	for i := 0; i < typ.NumField(); i++ {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	return fields
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	tests := []struct {
+		schema string
+		value  any
+	}{
+		{"Book", Book{}},
+		{"BookPatch", bookPatch{}},
+		{"BookPage", BookPage{}},
+		{"AuthorPage", AuthorPage{}},
+		{"AuthorCount", AuthorCount{}},
+		{"FieldError", FieldError{}},
+		{"ConfigSummary", configSummary{}},
+	}
+
+	for _, tt := range tests {
+		var props []string
+		for name := range doc.Components.Schemas[tt.schema].Properties {
+			props = append(props, name)
+		}
+		sort.Strings(props)
+
+		if expected := jsonFields(tt.value); !reflect.DeepEqual(props, expected) {
+			t.Errorf("\n%s\n...expected = %v\n...obtained = %v", tt.schema, expected, props)
+		}
+	}
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+
+	env := Env{}
+	router := mux.NewRouter()
+	router.HandleFunc("/healthz", env.appHealth).Methods("GET")
+	router.HandleFunc("/readyz", env.appReady).Methods("GET")
+	router.HandleFunc("/version", serveVersion).Methods("GET")
+	router.HandleFunc("/maintenance", env.serveMaintenance).Methods("GET")
+	env.registerV1(router.PathPrefix("/v1").Subrouter())
+
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path, _ := route.GetPathTemplate()
+
+		for _, m := range methods {
+			if _, ok := doc.Paths[path][strings.ToLower(m)]; !ok {
+				t.Errorf("%s %s is not documented in openapi.json", m, path)
+			}
+		}
+
+		return nil
+	})
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+
+	serveOpenAPI(openAPISpec)(rec, req)
+
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", got)
+	}
+	if !json.Valid(rec.Body.Bytes()) {
+		t.Error("response is not valid JSON")
+	}
+}
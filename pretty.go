@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// prettyRequested reports whether the request asked for indented JSON with
+// ?pretty=true, for reading responses by hand while debugging.
+func prettyRequested(r *http.Request) bool {
+	pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty"))
+
+	return pretty
+}
+
+// prettyJSON marks the response writer of requests with ?pretty=true so
+// RespondJSON, which has no request to look at, indents its output. It must
+// be the innermost router middleware, so handlers receive the marked writer.
+func prettyJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if prettyRequested(r) {
+			w = prettyWriter{w}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// prettyWriter marks a response that should be indented.
+type prettyWriter struct {
+	http.ResponseWriter
+}
+
+func (w prettyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isPretty reports whether w, or a writer it wraps, is a prettyWriter.
+func isPretty(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(prettyWriter); ok {
+			return true
+		}
+
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "", expected: `{"db":"ok","vault":"ok"}` + "\n"},
+		{query: "?pretty=false", expected: `{"db":"ok","vault":"ok"}` + "\n"},
+		{query: "?pretty=true", expected: "{\n  \"db\": \"ok\",\n  \"vault\": \"ok\"\n}\n"},
+		{query: "?pretty=1", expected: "{\n  \"db\": \"ok\",\n  \"vault\": \"ok\"\n}\n"},
+	}
+
+	handler := prettyJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RespondJSON(w, 200, map[string]string{"db": "ok", "vault": "ok"})
+	}))
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/readyz"+tt.query, nil)
+
+		handler.ServeHTTP(rec, req)
+
+		if tt.expected != rec.Body.String() {
+			t.Errorf("%q:\n...expected = %v\n...obtained = %v", tt.query, tt.expected, rec.Body.String())
+		}
+	}
+}
+
+func TestPrettyJSONThroughWrappers(t *testing.T) {
+	// A handler that wraps the writer, as idempotent does, still indents.
+	handler := prettyJSON(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RespondError(&responseRecorder{ResponseWriter: w}, 404, http.StatusText(404))
+	}))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books/978-0000000000?pretty=true", nil)
+
+	handler.ServeHTTP(rec, req)
+
+	expected := "{\n  \"error\": {\n    \"code\": 404,\n    \"message\": \"Not Found\"\n  }\n}\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestPrettyEntity(t *testing.T) {
+	bk := Book{Isbn: "978-1505255607", Title: "The Time Machine"}
+
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{query: "", expected: `{"ISBN":"978-1505255607","Title":"The Time Machine","Author":"","Genre":"","Price":"0.00","Quantity":0}` + "\n"},
+		{query: "?pretty=true", expected: "{\n  \"ISBN\": \"978-1505255607\",\n  \"Title\": \"The Time Machine\",\n  \"Author\": \"\",\n  \"Genre\": \"\",\n  \"Price\": \"0.00\",\n  \"Quantity\": 0\n}\n"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books/978-1505255607"+tt.query, nil)
+
+		writeEntity(rec, req, 200, bk)
+
+		if tt.expected != rec.Body.String() {
+			t.Errorf("%q:\n...expected = %v\n...obtained = %v", tt.query, tt.expected, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Price is a monetary amount stored as an integer number of cents, so values
+// like 9.44 round-trip exactly. It is encoded in JSON as a string such as
+// "9.44" and stored in the decimal price column.
+type Price int64
+
+var errInvalidPrice = errors.New("invalid price")
+
+// ParsePrice parses a decimal string with at most two fractional digits.
+func ParsePrice(s string) (Price, error) {
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || len(frac) > 2 {
+		return 0, errInvalidPrice
+	}
+	for len(frac) < 2 {
+		frac += "0"
+	}
+
+	for _, c := range whole + frac {
+		if c < '0' || c > '9' {
+			return 0, errInvalidPrice
+		}
+	}
+
+	cents, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, errInvalidPrice
+	}
+	if neg {
+		cents = -cents
+	}
+
+	return Price(cents), nil
+}
+
+func (p Price) String() string {
+	sign := ""
+	c := int64(p)
+	if c < 0 {
+		sign = "-"
+		c = -c
+	}
+
+	return fmt.Sprintf("%s%d.%02d", sign, c/100, c%100)
+}
+
+func (p Price) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON accepts both the string form ("9.44") and a plain JSON
+// number (9.44) for compatibility with older clients.
+func (p *Price) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	v, err := ParsePrice(s)
+	if err != nil {
+		return fmt.Errorf("invalid price %s: must be a decimal with at most two fractional digits", data)
+	}
+
+	*p = v
+
+	return nil
+}
+
+// MarshalText and UnmarshalText give Price the same string form in XML.
+// JSON uses MarshalJSON and UnmarshalJSON, which take precedence.
+func (p Price) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Price) UnmarshalText(text []byte) error {
+	v, err := ParsePrice(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid price %s: must be a decimal with at most two fractional digits", text)
+	}
+
+	*p = v
+
+	return nil
+}
+
+// Scan implements sql.Scanner for the numeric price column.
+func (p *Price) Scan(src any) error {
+	var s string
+
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		*p = Price(v * 100)
+		return nil
+	case float64:
+		s = strconv.FormatFloat(v, 'f', 2, 64)
+	default:
+		return fmt.Errorf("cannot scan %T into Price", src)
+	}
+
+	v, err := ParsePrice(s)
+	if err != nil {
+		return fmt.Errorf("cannot scan %q into Price: %w", s, err)
+	}
+
+	*p = v
+
+	return nil
+}
+
+// Value implements driver.Valuer, passing the price to Postgres as an exact
+// decimal string.
+func (p Price) Value() (driver.Value, error) {
+	return p.String(), nil
+}
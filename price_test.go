@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+)
+
+func TestPriceJSON(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected Price
+	}{
+		{in: `"9.44"`, expected: 944},
+		{in: `9.44`, expected: 944},
+		{in: `"5"`, expected: 500},
+		{in: `"0.5"`, expected: 50},
+	}
+
+	for _, tt := range tests {
+		var p Price
+
+		err := json.Unmarshal([]byte(tt.in), &p)
+		if err != nil {
+			t.Errorf("json.Unmarshal(%s): %v", tt.in, err)
+			continue
+		}
+		if tt.expected != p {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, p)
+		}
+	}
+
+	for _, in := range []string{`"9.444"`, `"cheap"`, `"1e3"`, `true`, `"NaN"`, `"Infinity"`, `"-Inf"`} {
+		var p Price
+		if err := json.Unmarshal([]byte(in), &p); err == nil {
+			t.Errorf("json.Unmarshal(%s) = %v, expected an error", in, p)
+		}
+	}
+
+	out, _ := json.Marshal(Price(944))
+	if string(out) != `"9.44"` {
+		t.Errorf("\n...expected = %v\n...obtained = %v", `"9.44"`, string(out))
+	}
+}
+
+func TestPriceScan(t *testing.T) {
+	tests := []struct {
+		src      any
+		expected Price
+	}{
+		{src: []byte("9.44"), expected: 944},
+		{src: "5.99", expected: 599},
+		{src: int64(7), expected: 700},
+		{src: float64(6.99), expected: 699},
+	}
+
+	for _, tt := range tests {
+		var p Price
+
+		err := p.Scan(tt.src)
+		if err != nil {
+			t.Errorf("Scan(%v): %v", tt.src, err)
+			continue
+		}
+		if tt.expected != p {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, p)
+		}
+	}
+}
+
+func TestPriceXML(t *testing.T) {
+	var v struct {
+		Price Price
+	}
+
+	err := xml.Unmarshal([]byte(`<v><Price>9.44</Price></v>`), &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Price != 944 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", Price(944), v.Price)
+	}
+
+	if err := xml.Unmarshal([]byte(`<v><Price>cheap</Price></v>`), &v); err == nil {
+		t.Error("expected an error for an invalid price")
+	}
+}
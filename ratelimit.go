@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter keeps a token bucket per client. Clients are identified by
+// their API key if they send one of keys, otherwise by remote IP.
+type rateLimiter struct {
+	rate  rate.Limit
+	burst int
+	keys  apiKeys
+	// forwarded takes the remote IP from X-Forwarded-For rather than the
+	// connection. It is only safe when every connection comes through a
+	// proxy that sets the header, as on LISTEN_SOCKET.
+	forwarded bool
+
+	mu      sync.Mutex
+	clients map[string]*rateClient
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(r rate.Limit, burst int, keys apiKeys) *rateLimiter {
+	return &rateLimiter{rate: r, burst: burst, keys: keys, clients: map[string]*rateClient{}}
+}
+
+// reserve takes a token for key, returning how long the client must wait if
+// none is available.
+func (l *rateLimiter) reserve(key string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	c, ok := l.clients[key]
+	if !ok {
+		c = &rateClient{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	l.mu.Unlock()
+
+	res := c.limiter.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Duration(math.MaxInt64), false
+	}
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return delay, false
+	}
+
+	return 0, true
+}
+
+// cleanup forgets clients not seen for idle, whose buckets have refilled.
+func (l *rateLimiter) cleanup(now time.Time, idle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, c := range l.clients {
+		if now.Sub(c.lastSeen) > idle {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// run cleans up idle clients every interval until ctx is done.
+func (l *rateLimiter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.cleanup(now, interval)
+		}
+	}
+}
+
+// Middleware responds with a 429 and a Retry-After header once a client has
+// used up its bucket.
+func (l *rateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wait, ok := l.reserve(l.clientKey(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			RespondError(w, 429, http.StatusText(429))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies the caller for rate limiting. The limiter runs
+// before authentication, so only an API key that matches one of l.keys
+// earns its own bucket; anything else would let a client dodge its IP's
+// limit, and grow the bucket map, by sending a new key each time. Keys are
+// named by their hash so they aren't held in memory in the clear.
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		if sum, ok := l.keys.match(key); ok {
+			return "key:" + hex.EncodeToString(sum[:8])
+		}
+	}
+
+	if l.forwarded {
+		if host := forwardedFor(r); host != "" {
+			return "ip:" + host
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// forwardedFor returns the last address in X-Forwarded-For, the one the
+// proxy in front of us added. Earlier entries come from the client and
+// can't be trusted.
+func forwardedFor(r *http.Request) string {
+	values := r.Header.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		return ""
+	}
+
+	hops := strings.Split(values[len(values)-1], ",")
+
+	return strings.TrimSpace(hops[len(hops)-1])
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	sum := sha256.Sum256([]byte("importer-key"))
+	l := newRateLimiter(1, 2, apiKeys{sum[:]})
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books", nil)
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+
+		h.ServeHTTP(rec, req)
+
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := send("10.0.0.1:5000", ""); rec.Code != 200 {
+			t.Fatalf("request %d:\n...expected = %v\n...obtained = %v", i, 200, rec.Code)
+		}
+	}
+
+	// The bucket is empty; a new port on the same host shares it.
+	rec := send("10.0.0.1:5001", "")
+	if rec.Code != 429 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 429, rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "1", got)
+	}
+
+	// Other clients have their own buckets.
+	if rec := send("10.0.0.2:5000", ""); rec.Code != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, rec.Code)
+	}
+	if rec := send("10.0.0.1:5000", "importer-key"); rec.Code != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, rec.Code)
+	}
+}
+
+func TestRateLimiterCleanup(t *testing.T) {
+	l := newRateLimiter(1, 1, nil)
+	now := time.Now()
+
+	l.reserve("ip:10.0.0.1", now.Add(-time.Hour))
+	l.reserve("ip:10.0.0.2", now)
+
+	l.cleanup(now, time.Minute)
+
+	if _, ok := l.clients["ip:10.0.0.1"]; ok {
+		t.Error("expected the idle client to be removed")
+	}
+	if _, ok := l.clients["ip:10.0.0.2"]; !ok {
+		t.Error("expected the active client to be kept")
+	}
+}
+
+func TestRateLimiterUnknownKeys(t *testing.T) {
+	sum := sha256.Sum256([]byte("importer-key"))
+	l := newRateLimiter(1, 1, apiKeys{sum[:]})
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// A key that isn't configured doesn't get its own bucket, so a new one on
+	// each request still shares the IP's.
+	for i, key := range []string{"", "guess-1", "guess-2"} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books", nil)
+		req.RemoteAddr = "10.0.0.1:5000"
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+
+		h.ServeHTTP(rec, req)
+
+		expected := 429
+		if i == 0 {
+			expected = 200
+		}
+		if rec.Code != expected {
+			t.Errorf("%q:\n...expected = %v\n...obtained = %v", key, expected, rec.Code)
+		}
+	}
+
+	if n := len(l.clients); n != 1 {
+		t.Errorf("\n...expected = %v buckets\n...obtained = %v buckets", 1, n)
+	}
+}
+
+func TestRateLimiterForwarded(t *testing.T) {
+	tests := []struct {
+		name     string
+		first    []string
+		second   []string
+		expected int
+	}{
+		{name: "same client", first: []string{"203.0.113.7"}, second: []string{"203.0.113.7"}, expected: 429},
+		{name: "other client", first: []string{"203.0.113.7"}, second: []string{"203.0.113.8"}, expected: 200},
+		{name: "spoofed first hop", first: []string{"10.9.9.9, 203.0.113.7"}, second: []string{"10.8.8.8, 203.0.113.7"}, expected: 429},
+		{name: "header sent twice", first: []string{"203.0.113.7"}, second: []string{"203.0.113.8", "203.0.113.7"}, expected: 429},
+		{name: "no header", expected: 429},
+	}
+
+	for _, tt := range tests {
+		l := newRateLimiter(1, 1, nil)
+		l.forwarded = true
+		h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		var rec *httptest.ResponseRecorder
+		for _, xff := range [][]string{tt.first, tt.second} {
+			rec = httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/v1/books", nil)
+			// Connections over a Unix socket have no remote address.
+			req.RemoteAddr = "@"
+			for _, v := range xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+
+			h.ServeHTTP(rec, req)
+		}
+
+		if tt.expected != rec.Code {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// rejectWrites answers every request but GET, HEAD and OPTIONS with a 503
+// while the service is in read-only mode, so writes can be paused during
+// maintenance such as a migration while reads carry on.
+func (env *Env) rejectWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !env.readOnly.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Retry-After", "60")
+		RespondError(w, 503, "the service is in read-only mode for maintenance")
+	})
+}
+
+// toggleReadOnly flips read-only mode each time a signal arrives on sigs.
+func (env *Env) toggleReadOnly(sigs <-chan os.Signal) {
+	for range sigs {
+		on := !env.readOnly.Load()
+		env.readOnly.Store(on)
+		slog.Warn("read-only mode changed", "read_only", on)
+	}
+}
+
+// serveMaintenance reports whether the service is in read-only mode.
+func (env *Env) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	RespondJSON(w, 200, map[string]bool{"read_only": env.readOnly.Load()})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	env := &Env{books: &mockBookModel{}}
+	router := mux.NewRouter()
+	router.HandleFunc("/maintenance", env.serveMaintenance).Methods("GET")
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.Use(env.rejectWrites)
+	env.registerV1(v1)
+
+	tests := []struct {
+		method   string
+		target   string
+		body     string
+		readOnly bool
+		code     int
+	}{
+		{method: "GET", target: "/v1/books/978-1505255607", readOnly: true, code: 200},
+		{method: "GET", target: "/v1/books", readOnly: true, code: 200},
+		{method: "POST", target: "/v1/books", body: `{"ISBN":"978-1503290334","Title":"The Invisible Man","Price":"6.99"}`, readOnly: true, code: 503},
+		{method: "PUT", target: "/v1/books/978-1505255607/stock", body: `{"quantity":1}`, readOnly: true, code: 503},
+		{method: "PATCH", target: "/v1/books/978-1505255607", body: `{"Title":"The Time Machine"}`, readOnly: true, code: 503},
+		{method: "DELETE", target: "/v1/books/978-1505255607", readOnly: true, code: 503},
+		{method: "DELETE", target: "/v1/books/978-1505255607", readOnly: false, code: 204},
+	}
+
+	for _, tt := range tests {
+		env.readOnly.Store(tt.readOnly)
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+
+		router.ServeHTTP(rec, req)
+
+		if tt.code != rec.Code {
+			t.Errorf("%s %s:\n...expected = %v\n...obtained = %v", tt.method, tt.target, tt.code, rec.Code)
+		}
+		if tt.code == 503 {
+			expected := `{"error":{"code":503,"message":"the service is in read-only mode for maintenance"}}` + "\n"
+			if expected != rec.Body.String() {
+				t.Errorf("%s %s:\n...expected = %v\n...obtained = %v", tt.method, tt.target, expected, rec.Body.String())
+			}
+		}
+	}
+
+	env.readOnly.Store(true)
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/maintenance", nil)
+	router.ServeHTTP(rec, req)
+
+	if expected := `{"read_only":true}` + "\n"; expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestToggleReadOnly(t *testing.T) {
+	env := &Env{}
+	sigs := make(chan os.Signal)
+	done := make(chan struct{})
+
+	go func() {
+		env.toggleReadOnly(sigs)
+		close(done)
+	}()
+
+	sigs <- syscall.SIGUSR1
+	sigs <- syscall.SIGUSR1
+	sigs <- syscall.SIGUSR1
+	close(sigs)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("toggleReadOnly did not return")
+	}
+
+	if !env.readOnly.Load() {
+		t.Error("expected read-only mode after three toggles")
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/spf13/viper"
+)
+
+// dataSourceName builds the Postgres DSN for host and port from the DB_*
+// settings in c. DB_STATEMENT_TIMEOUT is passed as a run-time parameter, so
+// it applies to every connection in the pool.
+func dataSourceName(c *viper.Viper, host, port string) string {
+	dsn := fmt.Sprintf("postgres://%s:%s@%s/%s?sslmode=%s",
+		c.GetString(DB_USER), c.GetString(DB_PASS), net.JoinHostPort(host, port), c.GetString(DB_NAME), c.GetString(DB_SSL))
+
+	if timeout := c.GetDuration(DB_STATEMENT_TIMEOUT); timeout > 0 {
+		dsn += "&statement_timeout=" + strconv.FormatInt(timeout.Milliseconds(), 10)
+	}
+
+	return dsn
+}
+
+// replicaAddrs returns the address, as host:port, of each replica in
+// DB_READ_HOSTS. Each entry is a host, or host:port to override DB_PORT.
+func replicaAddrs(c *viper.Viper) []string {
+	var addrs []string
+	for _, hostPort := range splitList(c.GetString(DB_READ_HOSTS)) {
+		if _, _, err := net.SplitHostPort(hostPort); err != nil {
+			hostPort = net.JoinHostPort(hostPort, c.GetString(DB_PORT))
+		}
+		addrs = append(addrs, hostPort)
+	}
+
+	return addrs
+}
+
+// openPool opens a connection pool for dsn, sized by the DB_MAX_* settings
+// in c, along with the circuit breaker, named name, that its connections go
+// through. Each pool gets a breaker of its own, so failures connecting to
+// one database never count against another. Like sql.Open, it doesn't
+// connect.
+func openPool(c *viper.Viper, dsn, name string) (*sql.DB, *circuitBreaker, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	breaker := newCircuitBreaker(name, c.GetInt(DB_BREAKER_THRESHOLD), c.GetDuration(DB_BREAKER_COOLDOWN))
+	db := sql.OpenDB(breakerConnector{Connector: connector, breaker: breaker})
+
+	db.SetMaxOpenConns(c.GetInt(DB_MAX_OPEN))
+	db.SetMaxIdleConns(c.GetInt(DB_MAX_IDLE))
+	db.SetConnMaxLifetime(c.GetDuration(DB_CONN_MAX_LIFETIME))
+
+	return db, breaker, nil
+}
+
+// DBHandle holds the primary connection pool, which a reload may replace
+// while requests are using it. Callers fetch the pool for each operation
+// rather than keeping it.
+type DBHandle struct {
+	mu      sync.RWMutex
+	db      *sql.DB
+	dsn     string
+	breaker *circuitBreaker
+}
+
+func newDBHandle(db *sql.DB, dsn string, breaker *circuitBreaker) *DBHandle {
+	return &DBHandle{db: db, dsn: dsn, breaker: breaker}
+}
+
+// Get returns the current pool.
+func (h *DBHandle) Get() *sql.DB {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.db
+}
+
+// Breaker returns the circuit breaker of the current pool.
+func (h *DBHandle) Breaker() *circuitBreaker {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.breaker
+}
+
+// primary returns the pool for writes: the handle's current pool when there
+// is a handle, otherwise db. Without either it returns unavailableDB, so
+// callers get ErrDBUnavailable rather than a nil pointer.
+func (h *DBHandle) primary(db *sql.DB) *sql.DB {
+	if h != nil {
+		db = h.Get()
+	}
+	if db == nil {
+		return unavailableDB
+	}
+
+	return db
+}
+
+// unavailableDB stands in for a pool that was never opened. Every query on
+// it fails with ErrDBUnavailable.
+var unavailableDB = sql.OpenDB(unavailableConnector{})
+
+type unavailableConnector struct{}
+
+func (unavailableConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, ErrDBUnavailable
+}
+
+func (c unavailableConnector) Driver() driver.Driver {
+	return unavailableDriver{}
+}
+
+type unavailableDriver struct{}
+
+func (unavailableDriver) Open(string) (driver.Conn, error) {
+	return nil, ErrDBUnavailable
+}
+
+// reloader re-reads the configuration for POST /admin/reload and, if the
+// database settings changed, switches to new pools for the primary and the
+// replicas. Other settings are read at startup only and still need a
+// restart.
+type reloader struct {
+	// mu serializes reloads, so two can't both replace the pools.
+	mu sync.Mutex
+
+	load     func() (*viper.Viper, error)
+	open     func(c *viper.Viper, dsn, name string) (*sql.DB, *circuitBreaker, error)
+	ping     func(ctx context.Context, db *sql.DB) error
+	db       *DBHandle
+	replicas *ReplicaPool
+
+	// grace is how long an old pool stays open for operations that
+	// fetched it just before the swap.
+	grace time.Duration
+}
+
+// configSummary is the reloaded configuration, without credentials.
+type configSummary struct {
+	DBHost          string   `json:"db_host"`
+	DBPort          string   `json:"db_port"`
+	DBName          string   `json:"db_name"`
+	DBUser          string   `json:"db_user"`
+	DBSSL           string   `json:"db_ssl"`
+	DBReadHosts     []string `json:"db_read_hosts"`
+	VaultEnabled    bool     `json:"vault_enabled"`
+	DBChanged       bool     `json:"db_changed"`
+	ReplicasChanged bool     `json:"replicas_changed"`
+}
+
+// reload loads the configuration and swaps in new pools for the primary, if
+// its DSN changed, and for the replicas, if any of theirs did. Every new
+// pool must answer a ping first, so bad credentials leave all the old ones
+// in place.
+func (rl *reloader) reload(ctx context.Context) (configSummary, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	c, err := rl.load()
+	if err != nil {
+		return configSummary{}, fmt.Errorf("unable to load configuration: %w", err)
+	}
+
+	summary := configSummary{
+		DBHost:       c.GetString(DB_HOST),
+		DBPort:       c.GetString(DB_PORT),
+		DBName:       c.GetString(DB_NAME),
+		DBUser:       c.GetString(DB_USER),
+		DBSSL:        c.GetString(DB_SSL),
+		DBReadHosts:  replicaAddrs(c),
+		VaultEnabled: c.GetBool(VAULT_ENABLED),
+	}
+	if summary.DBReadHosts == nil {
+		summary.DBReadHosts = []string{}
+	}
+
+	dsn := dataSourceName(c, summary.DBHost, summary.DBPort)
+
+	var replicaDSNs []string
+	for _, addr := range summary.DBReadHosts {
+		host, port, _ := net.SplitHostPort(addr)
+		replicaDSNs = append(replicaDSNs, dataSourceName(c, host, port))
+	}
+
+	rl.db.mu.RLock()
+	summary.DBChanged = dsn != rl.db.dsn
+	rl.db.mu.RUnlock()
+	summary.ReplicasChanged = rl.replicas != nil && !slices.Equal(replicaDSNs, rl.replicas.DSNs())
+
+	if !summary.DBChanged && !summary.ReplicasChanged {
+		return summary, nil
+	}
+
+	// Each new pool brings its own breaker, so a failed ping here isn't
+	// counted against the pools still serving requests, and the old pools
+	// keep their breakers until they close.
+	var opened []*sql.DB
+	open := func(dsn, name string) (*sql.DB, *circuitBreaker, error) {
+		db, breaker, err := rl.open(c, dsn, name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to open database %s: %w", name, err)
+		}
+		opened = append(opened, db)
+
+		pingCtx, cancel := context.WithTimeout(ctx, dbPingTimeout)
+		defer cancel()
+
+		err = rl.ping(pingCtx, db)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to reach database %s: %w", name, err)
+		}
+
+		return db, breaker, nil
+	}
+	closeOpened := func() {
+		for _, db := range opened {
+			db.Close()
+		}
+	}
+
+	var (
+		db       *sql.DB
+		breaker  *circuitBreaker
+		replicas []*sql.DB
+		breakers []*circuitBreaker
+	)
+	if summary.DBChanged {
+		db, breaker, err = open(dsn, "primary")
+		if err != nil {
+			closeOpened()
+			return configSummary{}, err
+		}
+	}
+	if summary.ReplicasChanged {
+		for i, dsn := range replicaDSNs {
+			replica, replicaBreaker, err := open(dsn, summary.DBReadHosts[i])
+			if err != nil {
+				closeOpened()
+				return configSummary{}, err
+			}
+			replicas = append(replicas, replica)
+			breakers = append(breakers, replicaBreaker)
+		}
+	}
+
+	var old []*sql.DB
+	if summary.DBChanged {
+		rl.db.mu.Lock()
+		old = append(old, rl.db.db)
+		rl.db.db, rl.db.dsn, rl.db.breaker = db, dsn, breaker
+		rl.db.mu.Unlock()
+	}
+	if summary.ReplicasChanged {
+		old = append(old, rl.replicas.swap(replicas, replicaDSNs, breakers)...)
+	}
+
+	time.AfterFunc(rl.grace, func() {
+		for _, db := range old {
+			db.Close()
+		}
+	})
+
+	return summary, nil
+}
+
+// serveReload handles POST /admin/reload.
+func (rl *reloader) serveReload(w http.ResponseWriter, r *http.Request) {
+	summary, err := rl.reload(r.Context())
+	if err != nil {
+		logError(r, err)
+		RespondError(w, 500, "unable to reload configuration")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "configuration reloaded", "db_changed", summary.DBChanged, "replicas_changed", summary.ReplicasChanged)
+	RespondJSON(w, 200, summary)
+}
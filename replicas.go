@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// ReplicaPool hands out read replicas in turn. A nil or empty pool has no
+// replicas. Like DBHandle, a reload may replace the replicas while requests
+// are using them.
+type ReplicaPool struct {
+	mu       sync.RWMutex
+	dbs      []*sql.DB
+	dsns     []string
+	breakers []*circuitBreaker
+
+	next atomic.Uint64
+}
+
+func newReplicaPool(dbs []*sql.DB) *ReplicaPool {
+	return &ReplicaPool{dbs: dbs}
+}
+
+// pick returns the next replica, or nil when there are none.
+func (p *ReplicaPool) pick() *sql.DB {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.dbs) == 0 {
+		return nil
+	}
+
+	return p.dbs[(p.next.Add(1)-1)%uint64(len(p.dbs))]
+}
+
+// DSNs returns the DSN of each replica, in order.
+func (p *ReplicaPool) DSNs() []string {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.dsns
+}
+
+// Breakers returns the circuit breaker of each replica.
+func (p *ReplicaPool) Breakers() []*circuitBreaker {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.breakers
+}
+
+// swap replaces the replicas, returning the old ones for the caller to
+// close.
+func (p *ReplicaPool) swap(dbs []*sql.DB, dsns []string, breakers []*circuitBreaker) []*sql.DB {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old := p.dbs
+	p.dbs, p.dsns, p.breakers = dbs, dsns, breakers
+
+	return old
+}
+
+// close closes the current replicas.
+func (p *ReplicaPool) close() {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, db := range p.dbs {
+		db.Close()
+	}
+}
+
+// reader returns the database for a read: the next replica, or the primary
+// when there are no replicas. Writes, and reads that decide a write, always
+// use the primary, since a replica may lag behind it.
+func (m BookModel) reader() *sql.DB {
+	if db := m.Replicas.pick(); db != nil {
+		return db
+	}
+
+	return m.primary()
+}
+
+type primaryReadKey struct{}
+
+// readPrimary marks ctx so that a Get made with it reads from the primary.
+// Handlers use it to read back a row they have just written, which a replica
+// may not have caught up with yet.
+func readPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadKey{}, true)
+}
+
+func isPrimaryRead(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadKey{}).(bool)
+
+	return primary
+}
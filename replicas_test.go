@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newMockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db, mock
+}
+
+func TestReplicaReads(t *testing.T) {
+	primary, primaryMock := newMockDB(t)
+	r1, r1Mock := newMockDB(t)
+	r2, r2Mock := newMockDB(t)
+
+	m := BookModel{DB: primary, Replicas: newReplicaPool([]*sql.DB{r1, r2})}
+
+	// Four reads alternate between the replicas and leave the primary alone.
+	for _, mock := range []sqlmock.Sqlmock{r1Mock, r2Mock, r1Mock, r2Mock} {
+		mock.ExpectPrepare("SELECT COUNT").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := m.Count(context.Background(), BookFilter{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, mock := range map[string]sqlmock.Sqlmock{"primary": primaryMock, "replica 1": r1Mock, "replica 2": r2Mock} {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestReplicaWrites(t *testing.T) {
+	primary, primaryMock := newMockDB(t)
+	replica, replicaMock := newMockDB(t)
+
+	m := BookModel{DB: primary, Replicas: newReplicaPool([]*sql.DB{replica})}
+	ctx := context.Background()
+	bk := Book{Isbn: "978-1503290334", Title: "The Invisible Man", Author: "H. G. Wells", Price: 699}
+
+	// The replica has no expectations, so any statement sent to it fails.
+	primaryMock.ExpectQuery("SELECT EXISTS").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	primaryMock.ExpectPrepare("INSERT INTO books").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	primaryMock.ExpectPrepare("UPDATE books").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"quantity", "version"}).AddRow(0, 2))
+	primaryMock.ExpectPrepare("UPDATE books").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	primaryMock.ExpectPrepare("DELETE FROM books").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, err := m.Exists(ctx, bk.Isbn); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Create(ctx, &bk); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(ctx, bk.Isbn, &bk); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.PartialUpdate(ctx, bk.Isbn, 0, map[string]any{"title": "The Invisible Man"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Delete(ctx, bk.Isbn); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primaryMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+	if err := replicaMock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplicaGet(t *testing.T) {
+	primary, primaryMock := newMockDB(t)
+	replica, replicaMock := newMockDB(t)
+
+	expectGet := func(mock sqlmock.Sqlmock) {
+		mock.ExpectPrepare("SELECT isbn, title, author, genre, price, quantity, published_year, version FROM books WHERE isbn").
+			ExpectQuery().
+			WithArgs("978-1505255607").
+			WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+				AddRow("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 2, 1895, 1))
+	}
+
+	tests := []struct {
+		name  string
+		cache BookCache
+		ctx   context.Context
+		mock  sqlmock.Sqlmock
+	}{
+		{name: "no cache", ctx: context.Background(), mock: replicaMock},
+		{name: "read after a write", ctx: readPrimary(context.Background()), mock: primaryMock},
+		{name: "filling the cache", cache: newLRUCache(10, time.Minute), ctx: context.Background(), mock: primaryMock},
+	}
+
+	for _, test := range tests {
+		m := BookModel{DB: primary, Replicas: newReplicaPool([]*sql.DB{replica}), Cache: test.cache}
+
+		expectGet(test.mock)
+		if _, err := m.Get(test.ctx, "978-1505255607"); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		for name, mock := range map[string]sqlmock.Sqlmock{"primary": primaryMock, "replica": replicaMock} {
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("%s: %s: %v", test.name, name, err)
+			}
+		}
+	}
+}
+
+func TestReplicaFallback(t *testing.T) {
+	primary, mock := newMockDB(t)
+
+	for _, pool := range []*ReplicaPool{nil, newReplicaPool(nil)} {
+		m := BookModel{DB: primary, Replicas: pool}
+
+		mock.ExpectPrepare("SELECT COUNT").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		if _, err := m.Count(context.Background(), BookFilter{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
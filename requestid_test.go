@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		preserve bool
+	}{
+		{name: "missing", header: "", preserve: false},
+		{name: "provided", header: "abc-123", preserve: true},
+		{name: "too long", header: strings.Repeat("a", maxRequestIDLen+1), preserve: false},
+	}
+
+	for _, tt := range tests {
+		var seen string
+		h := requestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = requestIDFrom(r.Context())
+		}))
+
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books", nil)
+		if tt.header != "" {
+			req.Header.Set("X-Request-ID", tt.header)
+		}
+
+		h.ServeHTTP(rec, req)
+
+		id := rec.Header().Get("X-Request-ID")
+		if id != seen {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, seen, id)
+		}
+		if tt.preserve && id != tt.header {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.header, id)
+		}
+		if !tt.preserve {
+			if _, err := uuid.Parse(id); err != nil {
+				t.Errorf("%s: expected a generated UUID, got %q", tt.name, id)
+			}
+		}
+	}
+}
+
+func TestRequestIDLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(requestIDHandler{slog.NewJSONHandler(&buf, nil)})
+
+	h := requestID(requestLogger(logger)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books", nil)
+	req.Header.Set("X-Request-ID", "abc-123")
+
+	h.ServeHTTP(rec, req)
+
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if entry["request_id"] != "abc-123" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "abc-123", entry["request_id"])
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RetryPolicy retries database calls that fail with a transient error,
+// doubling the delay after each attempt. The zero value makes one attempt.
+//
+// Only idempotent operations are retried: a connection can drop after an
+// INSERT commits but before the reply arrives, so Create, CreateBatch,
+// DecrementStock and Purchase run once.
+type RetryPolicy struct {
+	Attempts  int
+	BaseDelay time.Duration
+}
+
+// transientCodes are the Postgres error codes worth retrying: the server is
+// starting, shutting down or overloaded, or the transaction lost a race.
+var transientCodes = map[pq.ErrorCode]bool{
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+	"53300": true, // too_many_connections
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+}
+
+// isTransient reports whether err is likely to succeed on retry. Constraint
+// violations and other data errors never are.
+func isTransient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is connection exceptions.
+		return transientCodes[pqErr.Code] || pqErr.Code.Class() == "08"
+	}
+
+	return errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// do calls fn until it succeeds, fails with a non-transient error, the
+// attempts run out or ctx is done.
+func (p RetryPolicy) do(ctx context.Context, fn func() error) error {
+	delay := p.BaseDelay
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.Attempts || !isTransient(err) {
+			return err
+		}
+
+		slog.WarnContext(ctx, "retrying transient database error", "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// maxStartupDelay caps the pause between waitForDB's attempts.
+const maxStartupDelay = 5 * time.Second
+
+// waitForDB pings the database until it answers or timeout has passed,
+// doubling the pause between attempts from baseDelay up to maxStartupDelay.
+// sql.Open doesn't connect, and under Kubernetes Postgres is often still
+// starting when the service is, so a first failure isn't fatal.
+func waitForDB(ctx context.Context, ping func(context.Context) error, timeout, baseDelay time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	delay := baseDelay
+
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancelPing := context.WithTimeout(ctx, dbPingTimeout)
+		err := ping(pingCtx)
+		cancelPing()
+		if err == nil {
+			return nil
+		}
+
+		slog.WarnContext(ctx, "database not ready", "attempt", attempt, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database not ready after %s: %w", timeout, err)
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxStartupDelay)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&pq.Error{Code: "57P03"}, true},
+		{fmt.Errorf("get book: %w", &pq.Error{Code: "08006"}), true},
+		{&pq.Error{Code: "40001"}, true},
+		{&pq.Error{Code: "23505"}, false},
+		{&pq.Error{Code: "23514"}, false},
+		{&pq.Error{Code: "42P01"}, false},
+		{driver.ErrBadConn, true},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{ErrBookNotFound, false},
+		{context.Canceled, false},
+	}
+
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.expected {
+			t.Errorf("\n%v\n...expected = %v\n...obtained = %v", tt.err, tt.expected, got)
+		}
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	transient := &pq.Error{Code: "57P03"}
+	violation := &pq.Error{Code: "23505"}
+
+	tests := []struct {
+		name     string
+		errs     []error
+		calls    int
+		expected error
+	}{
+		{"success", []error{nil}, 1, nil},
+		{"transient then success", []error{transient, transient, nil}, 3, nil},
+		{"attempts exhausted", []error{transient, transient, transient, nil}, 3, transient},
+		{"constraint violation not retried", []error{violation, nil}, 1, violation},
+	}
+
+	p := RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond}
+
+	for _, tt := range tests {
+		calls := 0
+
+		err := p.do(context.Background(), func() error {
+			calls++
+			return tt.errs[calls-1]
+		})
+
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, err)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s:\n...expected = %v calls\n...obtained = %v calls", tt.name, tt.calls, calls)
+		}
+	}
+}
+
+func TestWaitForDB(t *testing.T) {
+	refused := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		fails    int
+		timeout  time.Duration
+		expected error
+	}{
+		{"ready at once", 0, time.Second, nil},
+		{"failing then ready", 3, time.Second, nil},
+		{"never ready", 1000, 20 * time.Millisecond, refused},
+	}
+
+	for _, tt := range tests {
+		calls := 0
+		ping := func(ctx context.Context) error {
+			calls++
+			if calls <= tt.fails {
+				return refused
+			}
+			return nil
+		}
+
+		err := waitForDB(context.Background(), ping, tt.timeout, time.Millisecond)
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, err)
+		}
+		if tt.expected == nil && calls != tt.fails+1 {
+			t.Errorf("%s:\n...expected = %v calls\n...obtained = %v calls", tt.name, tt.fails+1, calls)
+		}
+	}
+}
+
+func TestGetRetriesTransientError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectPrepare("SELECT isbn, title, author, genre, price, quantity, published_year, version FROM books WHERE isbn").
+		WillReturnError(&pq.Error{Code: "57P03", Message: "the database system is starting up"})
+	mock.ExpectPrepare("SELECT isbn, title, author, genre, price, quantity, published_year, version FROM books WHERE isbn").
+		ExpectQuery().
+		WithArgs("978-1505255607").
+		WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+			AddRow("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 2, 1895, 1))
+
+	m := BookModel{DB: db, Retry: RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond}}
+
+	bk, err := m.Get(context.Background(), "978-1505255607")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bk.Title != "The Time Machine" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "The Time Machine", bk.Title)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -14,7 +14,11 @@ function err() {
 function docker_build_push() {
   local tag=$1
 
-  docker build -t "bookstore:${tag}" . && \
+  docker build -t "bookstore:${tag}" \
+    --build-arg VERSION="${tag}" \
+    --build-arg COMMIT="$(git rev-parse HEAD)" \
+    --build-arg BUILD_DATE="$(date -u +'%Y-%m-%dT%H:%M:%SZ')" \
+    . && \
     docker tag "bookstore:${tag}" "registry.digitalocean.com/at-docker/bookstore:${tag}" && \
     docker push "registry.digitalocean.com/at-docker/bookstore:${tag}"
 }
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statsTTL is how long GET /v1/stats serves the same figures before
+// querying again, so a wall of dashboards polling it costs one query.
+const statsTTL = 10 * time.Second
+
+// BookStats summarizes the catalogue. Genres counts books per genre, leaving
+// out books with none; Total counts every book.
+type BookStats struct {
+	Total        int            `json:"total"`
+	AveragePrice Price          `json:"average_price"`
+	MinPrice     Price          `json:"min_price"`
+	MaxPrice     Price          `json:"max_price"`
+	Genres       map[string]int `json:"genres"`
+}
+
+// Stats computes BookStats in one query, grouping by genre with a rollup row
+// for the totals. The prices are 0 when there are no books.
+func (m BookModel) Stats(ctx context.Context) (_ *BookStats, err error) {
+	ctx, done := m.instrument(ctx, "Stats", "SELECT")
+	defer func() { done(err) }()
+
+	var stats BookStats
+
+	err = m.Retry.do(ctx, func() error {
+		stats = BookStats{Genres: map[string]int{}}
+
+		rows, err := m.reader().QueryContext(ctx, logSQL(ctx, `SELECT GROUPING(genre) = 1, genre, COUNT(*),
+			COALESCE(ROUND(AVG(price), 2), 0), COALESCE(MIN(price), 0), COALESCE(MAX(price), 0)
+			FROM books GROUP BY ROLLUP (genre);`))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var (
+				total bool
+				genre *string
+				count int
+				avg   Price
+				lo    Price
+				hi    Price
+			)
+			if err := rows.Scan(&total, &genre, &count, &avg, &lo, &hi); err != nil {
+				return err
+			}
+
+			if total {
+				stats.Total, stats.AveragePrice, stats.MinPrice, stats.MaxPrice = count, avg, lo, hi
+			} else if genre != nil && *genre != "" {
+				stats.Genres[*genre] = count
+			}
+		}
+
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// statsCache holds the last BookStats for statsTTL. Its zero value is
+// empty and ready to use.
+type statsCache struct {
+	mu      sync.Mutex
+	stats   *BookStats
+	expires time.Time
+}
+
+// get returns the cached stats, calling load when they are missing or
+// stale. Callers arriving during a load wait for it rather than starting
+// their own.
+func (c *statsCache) get(ctx context.Context, load func(context.Context) (*BookStats, error)) (*BookStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats != nil && time.Now().Before(c.expires) {
+		return c.stats, nil
+	}
+
+	stats, err := load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.stats, c.expires = stats, time.Now().Add(statsTTL)
+
+	return stats, nil
+}
+
+// serveStats responds with the catalogue's BookStats, at most statsTTL old.
+func (env *Env) serveStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := env.stats.get(r.Context(), env.books.Stats)
+	if err != nil {
+		respondServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(statsTTL.Seconds())))
+	RespondJSON(w, 200, stats)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestServeStats(t *testing.T) {
+	env := Env{books: &mockBookModel{}}
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/stats", nil)
+
+	http.HandlerFunc(env.serveStats).ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, rec.Code)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=10" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "max-age=10", cc)
+	}
+
+	expected := `{"total":2,"average_price":"7.72","min_price":"5.99","max_price":"9.44","genres":{"Romance":1,"Science Fiction":1}}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}
+
+func TestStatsCache(t *testing.T) {
+	var c statsCache
+	calls := 0
+	load := func(ctx context.Context) (*BookStats, error) {
+		calls++
+		if calls == 1 {
+			return nil, errors.New("connection reset")
+		}
+		return &BookStats{Total: calls}, nil
+	}
+
+	// A failed load isn't cached.
+	if _, err := c.get(context.Background(), load); err == nil {
+		t.Error("expected the load error")
+	}
+
+	for i := 0; i < 3; i++ {
+		stats, err := c.get(context.Background(), load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Total != 2 {
+			t.Errorf("\n...expected = %v\n...obtained = %v", 2, stats.Total)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 2, calls)
+	}
+}
+
+func TestStatsQuery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT GROUPING\\(genre\\) = 1, genre, COUNT\\(\\*\\).* FROM books GROUP BY ROLLUP \\(genre\\);").
+		WillReturnRows(sqlmock.NewRows([]string{"total", "genre", "count", "avg", "min", "max"}).
+			AddRow(false, "", 1, "6.99", "6.99", "6.99").
+			AddRow(false, "Romance", 1, "9.44", "9.44", "9.44").
+			AddRow(false, "Science Fiction", 1, "5.99", "5.99", "5.99").
+			AddRow(true, nil, 3, "7.47", "5.99", "9.44"))
+
+	stats, err := BookModel{DB: db}.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &BookStats{
+		Total:        3,
+		AveragePrice: 747,
+		MinPrice:     599,
+		MaxPrice:     944,
+		Genres:       map[string]int{"Romance": 1, "Science Fiction": 1},
+	}
+	if !reflect.DeepEqual(expected, stats) {
+		t.Errorf("\n...expected = %+v\n...obtained = %+v", expected, stats)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// exportJSONRoute names the JSON export route so the timeout middleware can
+// let it stream, as it does the CSV export.
+const exportJSONRoute = "exportJSON"
+
+// exportFlushEvery is how many books the JSON export writes between
+// flushes, so the client receives the array while it is still being read.
+const exportFlushEvery = 500
+
+// exportJSON streams the whole catalogue as a JSON array of books. Each book
+// is encoded as the database cursor returns it, so memory use stays flat
+// however large the catalogue is.
+func (env *Env) exportJSON(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+
+	// As with the CSV export, a large catalogue may take longer than
+	// SERVER_WRITE_TIMEOUT to send.
+	rc.SetWriteDeadline(time.Time{})
+
+	bw := bufio.NewWriter(w)
+	n := 0
+
+	start := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		bw.WriteByte('[')
+	}
+
+	err := env.books.ForEach(r.Context(), func(bk Book) error {
+		b, err := json.Marshal(bk)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			start()
+		} else {
+			bw.WriteByte(',')
+		}
+		bw.Write(b)
+		n++
+
+		if n%exportFlushEvery == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			// A writer that can't flush still gets every book, only
+			// later.
+			rc.Flush()
+		}
+
+		return nil
+	})
+	if err != nil {
+		if n == 0 {
+			respondServerError(w, r, err)
+			return
+		}
+		logError(r, err)
+
+		// Part of the array has been sent with a 200; drop the connection
+		// so the client sees a failed download rather than a short one.
+		panic(http.ErrAbortHandler)
+	}
+
+	if n == 0 {
+		start()
+	}
+	bw.WriteString("]\n")
+
+	if err := bw.Flush(); err != nil {
+		logError(r, err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// generatedBooks is a catalogue of n made-up books, produced one at a time
+// like a database cursor.
+type generatedBooks struct {
+	mockBookModel
+	n int
+}
+
+func (m *generatedBooks) ForEach(ctx context.Context, fn func(Book) error) error {
+	for i := 0; i < m.n; i++ {
+		bk := Book{Isbn: fmt.Sprintf("isbn-%05d", i), Title: "Book", Author: "Author", Genre: "Genre", Price: 599}
+		if err := fn(bk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestExportJSON(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books.json", nil)
+
+	env := Env{books: &mockBookModel{}}
+
+	http.HandlerFunc(env.exportJSON).ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+	}
+
+	var bks []Book
+	if err := json.Unmarshal(rec.Body.Bytes(), &bks); err != nil {
+		t.Fatalf("expected a JSON array, obtained %v: %s", err, rec.Body.String())
+	}
+	if !reflect.DeepEqual(mockBooks, bks) {
+		t.Errorf("\n...expected = %v\n...obtained = %v", mockBooks, bks)
+	}
+}
+
+func TestExportJSONStreams(t *testing.T) {
+	tests := []struct {
+		n       int
+		flushed bool
+	}{
+		{n: 0},
+		{n: 1},
+		{n: exportFlushEvery},
+		{n: 2*exportFlushEvery + 1, flushed: true},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/v1/books.json", nil)
+
+		env := Env{books: &generatedBooks{n: tt.n}}
+
+		http.HandlerFunc(env.exportJSON).ServeHTTP(rec, req)
+
+		if !json.Valid(rec.Body.Bytes()) {
+			t.Errorf("%d books: expected valid JSON, obtained %.200s", tt.n, rec.Body.String())
+			continue
+		}
+
+		var bks []Book
+		json.Unmarshal(rec.Body.Bytes(), &bks)
+		if bks == nil || len(bks) != tt.n {
+			t.Errorf("%d books:\n...expected = %v\n...obtained = %v", tt.n, tt.n, len(bks))
+		}
+		if tt.flushed && !rec.Flushed {
+			t.Errorf("%d books: expected the export to be flushed as it went", tt.n)
+		}
+	}
+}
+
+func TestExportJSONError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/v1/books.json", nil)
+
+	env := Env{books: &failingCSVBooks{}}
+
+	http.HandlerFunc(env.exportJSON).ServeHTTP(rec, req)
+
+	if rec.Code != 500 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 500, rec.Code)
+	}
+}
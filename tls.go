@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// tlsConfig accepts TLS 1.2 and later. The TLS 1.2 suites are limited to
+// ECDHE key exchange with AEAD ciphers; TLS 1.3 suites aren't configurable
+// and are all sound.
+func tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// serve accepts connections on ln, over HTTPS when certFile and keyFile are
+// set and plain HTTP otherwise, for deployments that terminate TLS in front
+// of the service.
+func serve(srv *http.Server, ln net.Listener, certFile, keyFile string) error {
+	if certFile == "" && keyFile == "" {
+		return srv.Serve(ln)
+	}
+
+	srv.TLSConfig = tlsConfig()
+
+	return srv.ServeTLS(ln, certFile, keyFile)
+}
+
+// redirectHTTPS sends every request to the same host and path over HTTPS on
+// httpsPort. 308 keeps the method and body, so a POST is not turned into a
+// GET.
+func redirectHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
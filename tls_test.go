@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir,
+// returning their paths and a pool that trusts the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "bookstore test"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return certFile, keyFile, pool
+}
+
+// startServer serves a 200 on a free port with serve, returning its address.
+func startServer(t *testing.T, certFile, keyFile string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go serve(srv, ln, certFile, keyFile)
+	t.Cleanup(func() { srv.Close() })
+
+	return ln.Addr().String()
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, pool := writeSelfSignedCert(t, t.TempDir())
+	addr := startServer(t, certFile, keyFile)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := client.Get("https://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 200, resp.StatusCode)
+	}
+	if resp.TLS == nil || resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("expected a TLS 1.2+ connection, obtained %+v", resp.TLS)
+	}
+
+	// Clients capped below TLS 1.2 are refused.
+	old := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS11}}}
+	if resp, err := old.Get("https://" + addr + "/healthz"); err == nil {
+		resp.Body.Close()
+		t.Error("expected a TLS 1.1 handshake to fail")
+	}
+}
+
+func TestServePlainHTTP(t *testing.T) {
+	addr := startServer(t, "", "")
+
+	resp, err := http.Get("http://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 || resp.TLS != nil {
+		t.Errorf("expected a plain 200, obtained %v over %+v", resp.StatusCode, resp.TLS)
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	tests := []struct {
+		port     string
+		host     string
+		target   string
+		expected string
+	}{
+		{port: "8443", host: "books.example.com:8080", target: "/v1/books?limit=5", expected: "https://books.example.com:8443/v1/books?limit=5"},
+		{port: "443", host: "books.example.com", target: "/v1/books", expected: "https://books.example.com/v1/books"},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", tt.target, nil)
+		req.Host = tt.host
+
+		redirectHTTPS(tt.port).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Errorf("\n...expected = %v\n...obtained = %v", http.StatusPermanentRedirect, rec.Code)
+		}
+		if loc := rec.Header().Get("Location"); loc != tt.expected {
+			t.Errorf("\n...expected = %v\n...obtained = %v", tt.expected, loc)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	cfg := tlsConfig()
+	if cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", tls.VersionTLS12, cfg.MinVersion)
+	}
+
+	insecure := map[uint16]bool{}
+	for _, s := range tls.InsecureCipherSuites() {
+		insecure[s.ID] = true
+	}
+	for _, id := range cfg.CipherSuites {
+		if insecure[id] {
+			t.Errorf("insecure cipher suite %s", tls.CipherSuiteName(id))
+		}
+	}
+}
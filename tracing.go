@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+const tracerName = "bookstore"
+
+// setupTracing installs a global tracer provider that exports spans over
+// OTLP/HTTP to endpoint. When endpoint is empty the global no-op provider is
+// left in place, so local runs are unaffected. The returned func flushes and
+// stops the exporter.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(tracerName))),
+	)
+
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	return tp.Shutdown, nil
+}
+
+// instrument starts a child span for a BookModel operation. The returned func
+// ends the span, marking it failed and counting the DB error when err is a
+// real failure, records the operation's count and latency, and logs the
+// operation: as a warning if it took longer than SlowQuery, otherwise at
+// debug level with the statements it ran, as passed to logSQL.
+func (m BookModel) instrument(ctx context.Context, op, sqlOp string, attrs ...attribute.KeyValue) (context.Context, func(err error)) {
+	attrs = append([]attribute.KeyValue{semconv.DBSystemPostgreSQL, semconv.DBOperation(sqlOp)}, attrs...)
+
+	start := time.Now()
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "BookModel."+op)
+	span.SetAttributes(attrs...)
+
+	var statements *statementLog
+	if m.logger().Enabled(ctx, slog.LevelDebug) {
+		statements = &statementLog{}
+		ctx = context.WithValue(ctx, statementLogKey{}, statements)
+	}
+
+	return ctx, func(err error) {
+		elapsed := time.Since(start)
+
+		m.Metrics.recordDBError(strings.ToLower(op), err)
+		m.Metrics.recordDBQuery(strings.ToLower(op), err, elapsed)
+
+		if m.SlowQuery > 0 && elapsed >= m.SlowQuery {
+			m.logger().WarnContext(ctx, "slow query", "op", op, "duration_ms", elapsed.Milliseconds(), "threshold_ms", m.SlowQuery.Milliseconds())
+		} else if statements != nil {
+			args := []any{"op", op, "verb", sqlOp, "sql", statements.String(), "duration_ms", elapsed.Milliseconds()}
+			for _, kv := range attrs[2:] {
+				args = append(args, string(kv.Key), kv.Value.Emit())
+			}
+			if err != nil {
+				args = append(args, "err", err)
+			}
+			m.logger().DebugContext(ctx, "query", args...)
+		}
+
+		if isDBFailure(err) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		span.End()
+	}
+}
+
+// statementLog collects the SQL an instrumented operation runs, for its
+// debug log line.
+type statementLog struct {
+	mu         sync.Mutex
+	statements []string
+}
+
+type statementLogKey struct{}
+
+// logSQL notes query as run by the operation instrumented in ctx, when debug
+// logging is on, and returns it unchanged, so it can wrap a query where it
+// is passed to the database. Only the statement is kept, never its
+// arguments, which may hold customer data.
+func logSQL(ctx context.Context, query string) string {
+	if l, ok := ctx.Value(statementLogKey{}).(*statementLog); ok {
+		l.mu.Lock()
+		l.statements = append(l.statements, query)
+		l.mu.Unlock()
+	}
+
+	return query
+}
+
+// String returns the statements in the order they ran, separated by
+// semicolons.
+func (l *statementLog) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stmts := make([]string, len(l.statements))
+	for i, query := range l.statements {
+		stmts[i] = strings.TrimSuffix(strings.Join(strings.Fields(query), " "), ";")
+	}
+
+	return strings.Join(stmts, "; ")
+}
+
+// logger returns the logger for slow queries, falling back to the default.
+func (m BookModel) logger() *slog.Logger {
+	if m.Log != nil {
+		return m.Log
+	}
+
+	return slog.Default()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrumentSpans(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	defer otel.SetTracerProvider(prev)
+
+	m := BookModel{}
+
+	_, done := m.instrument(context.Background(), "Get", "SELECT", attribute.String("book.isbn", "978-1505255607"))
+	done(nil)
+
+	_, done = m.instrument(context.Background(), "Create", "INSERT")
+	done(errors.New("connection reset"))
+
+	spans := exp.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("\n...expected = %v\n...obtained = %v", 2, len(spans))
+	}
+
+	if spans[0].Name != "BookModel.Get" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "BookModel.Get", spans[0].Name)
+	}
+
+	attrs := map[attribute.Key]string{}
+	for _, kv := range spans[0].Attributes {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	if attrs["db.operation"] != "SELECT" || attrs["book.isbn"] != "978-1505255607" {
+		t.Errorf("unexpected span attributes: %v", attrs)
+	}
+
+	if spans[1].Status.Code != codes.Error {
+		t.Errorf("\n...expected = %v\n...obtained = %v", codes.Error, spans[1].Status.Code)
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration
+		slow  bool
+	}{
+		{name: "slow", delay: 50 * time.Millisecond, slow: true},
+		{name: "fast", delay: 0, slow: false},
+	}
+
+	for _, tt := range tests {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mock.ExpectPrepare(regexp.QuoteMeta("SELECT " + bookColumns + " FROM books WHERE isbn=$1;")).
+			ExpectQuery().
+			WithArgs("978-1505255607").
+			WillDelayFor(tt.delay).
+			WillReturnRows(sqlmock.NewRows([]string{"isbn", "title", "author", "genre", "price", "quantity", "published_year", "version"}).
+				AddRow("978-1505255607", "The Time Machine", "H. G. Wells", "Science Fiction", "5.99", 0, 0, 1))
+
+		var buf bytes.Buffer
+		m := BookModel{DB: db, SlowQuery: 20 * time.Millisecond, Log: slog.New(slog.NewJSONHandler(&buf, nil))}
+
+		bk, err := m.Get(context.Background(), "978-1505255607")
+		db.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+
+		// Logging must not change what the query returns.
+		if bk.Title != "The Time Machine" || bk.Price != 599 {
+			t.Errorf("%s: unexpected book %+v", tt.name, bk)
+		}
+
+		if !tt.slow {
+			if buf.Len() != 0 {
+				t.Errorf("%s: unexpected log %s", tt.name, buf.String())
+			}
+			continue
+		}
+
+		var entry struct {
+			Level      string `json:"level"`
+			Msg        string `json:"msg"`
+			Op         string `json:"op"`
+			DurationMs int64  `json:"duration_ms"`
+		}
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("%s: %v: %s", tt.name, err, buf.String())
+		}
+		if entry.Level != "WARN" || entry.Msg != "slow query" || entry.Op != "Get" || entry.DurationMs < 50 {
+			t.Errorf("%s: unexpected log entry %+v", tt.name, entry)
+		}
+	}
+}
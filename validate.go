@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FieldError describes a validation failure on a single Book field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// ValidationError reports every invalid field of a book at once, keyed by
+// the field's JSON name, so a client can fix them all in one round trip.
+type ValidationError struct {
+	Errors map[string]string `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	fields := make([]string, 0, len(e.Errors))
+	for field := range e.Errors {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	msgs := make([]string, len(fields))
+	for i, field := range fields {
+		msgs[i] = field + ": " + e.Errors[field]
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// validateBook checks every field of a new book, returning a
+// *ValidationError listing all of the failures, or nil. It normalizes
+// bk.Author first and, once the book is valid, bk.Isbn.
+func validateBook(bk *Book) error {
+	bk.Author = normalizeAuthor(bk.Author)
+
+	verr := &ValidationError{Errors: map[string]string{}}
+	add := func(err error) {
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			verr.Errors[fieldErr.Field] = fieldErr.Message
+		}
+	}
+
+	add(validateISBN(bk.Isbn))
+	if strings.TrimSpace(bk.Title) == "" {
+		add(&FieldError{Field: "Title", Message: "must not be empty"})
+	}
+	add(validateLength("Title", bk.Title))
+	add(validateLength("Author", bk.Author))
+	add(validateGenre(bk.Genre))
+	add(validatePrice(bk.Price))
+	if bk.Quantity < 0 {
+		add(&FieldError{Field: "Quantity", Message: "must not be negative"})
+	}
+	add(validatePublishedYear(bk.PublishedYear))
+
+	if len(verr.Errors) == 0 {
+		bk.Isbn, _ = normalizeISBN(bk.Isbn)
+		return nil
+	}
+
+	return verr
+}
+
+// validatePatch applies validateBook's checks to the fields a patch sets,
+// returning a *ValidationError listing all of the failures, or nil. It
+// normalizes p.Author first.
+func validatePatch(p *bookPatch) error {
+	verr := &ValidationError{Errors: map[string]string{}}
+	add := func(err error) {
+		var fieldErr *FieldError
+		if errors.As(err, &fieldErr) {
+			verr.Errors[fieldErr.Field] = fieldErr.Message
+		}
+	}
+
+	if p.Title != nil {
+		if strings.TrimSpace(*p.Title) == "" {
+			add(&FieldError{Field: "Title", Message: "must not be empty"})
+		}
+		add(validateLength("Title", *p.Title))
+	}
+	if p.Author != nil {
+		author := normalizeAuthor(*p.Author)
+		p.Author = &author
+		add(validateLength("Author", author))
+	}
+	if p.Genre != nil {
+		add(validateGenre(*p.Genre))
+	}
+	if p.Price != nil {
+		add(validatePrice(*p.Price))
+	}
+	if p.PublishedYear != nil {
+		add(validatePublishedYear(*p.PublishedYear))
+	}
+
+	if len(verr.Errors) == 0 {
+		return nil
+	}
+
+	return verr
+}
+
+// normalizeAuthor trims an author's name and collapses runs of whitespace
+// inside it to single spaces, so "H. G.  Wells " is stored as "H. G. Wells".
+// Punctuation and case are left alone: "H.G. Wells" stays as written, since
+// there's no telling a missing space from a name spelt that way.
+func normalizeAuthor(author string) string {
+	return strings.Join(strings.Fields(author), " ")
+}
+
+// maxPrice is the largest amount books.price, a decimal(5,2), can hold.
+const maxPrice Price = 99999
+
+// validatePrice rejects free and negative books, and prices too large to
+// store. ParsePrice has already ruled out NaN, infinities and exponents.
+func validatePrice(p Price) error {
+	if p <= 0 {
+		return &FieldError{Field: "Price", Message: "must be greater than 0"}
+	}
+	if p > maxPrice {
+		return &FieldError{Field: "Price", Message: "must be at most " + maxPrice.String()}
+	}
+
+	return nil
+}
+
+// maxTextLen matches the width of books.title and books.author.
+const maxTextLen = 255
+
+// validateLength checks that the text field fits its column. Postgres
+// counts a varchar's width in characters, not bytes.
+func validateLength(field, s string) error {
+	if utf8.RuneCountInString(s) > maxTextLen {
+		return &FieldError{Field: field, Message: fmt.Sprintf("must be at most %d characters", maxTextLen)}
+	}
+
+	return nil
+}
+
+// maxGenreLen matches the width of books.genre.
+const maxGenreLen = 64
+
+// validateGenre requires every new book to have a genre.
+func validateGenre(genre string) error {
+	if strings.TrimSpace(genre) == "" {
+		return &FieldError{Field: "Genre", Message: "must not be empty"}
+	}
+	if len(genre) > maxGenreLen {
+		return &FieldError{Field: "Genre", Message: fmt.Sprintf("must be at most %d bytes", maxGenreLen)}
+	}
+
+	return nil
+}
+
+// minPublishedYear is the earliest year accepted, keeping years to four
+// digits.
+const minPublishedYear = 1000
+
+// validatePublishedYear accepts 0, for an unknown year, or a four-digit year
+// no later than next year, so forthcoming books can be listed ahead of
+// release.
+func validatePublishedYear(year int) error {
+	if year == 0 {
+		return nil
+	}
+	if year < minPublishedYear {
+		return &FieldError{Field: "PublishedYear", Message: "must be a four-digit year"}
+	}
+	if latest := time.Now().Year() + 1; year > latest {
+		return &FieldError{Field: "PublishedYear", Message: fmt.Sprintf("must not be later than %d", latest)}
+	}
+
+	return nil
+}
+
+// validateISBN accepts ISBN-10 and ISBN-13 values, with or without hyphens,
+// and verifies the check digit.
+func validateISBN(isbn string) error {
+	digits := strings.ReplaceAll(isbn, "-", "")
+
+	switch len(digits) {
+	case 10:
+		return validateISBN10(digits)
+	case 13:
+		return validateISBN13(digits)
+	}
+
+	return &FieldError{Field: "ISBN", Message: "must be 10 or 13 digits"}
+}
+
+// normalizeISBN returns the form a book's ISBN is stored under: the
+// ISBN-13, written as its prefix, a hyphen and the other ten digits, however
+// it was hyphenated, so 978-1-50525-560-7 becomes 978-1505255607. An ISBN-10
+// is converted by prefixing 978 and recomputing the check digit, so
+// 0-306-40615-2 becomes 978-0306406157. Migration 0009 rewrote the books
+// stored before this in the same way.
+func normalizeISBN(isbn string) (string, error) {
+	if err := validateISBN(isbn); err != nil {
+		return "", err
+	}
+
+	digits := strings.ReplaceAll(isbn, "-", "")
+	if len(digits) == 10 {
+		digits = "978" + digits[:9]
+
+		sum := 0
+		for i, c := range digits {
+			d := int(c - '0')
+			if i%2 == 1 {
+				d *= 3
+			}
+			sum += d
+		}
+		digits += strconv.Itoa((10 - sum%10) % 10)
+	}
+
+	return digits[:3] + "-" + digits[3:], nil
+}
+
+// lookupISBN is normalizeISBN for finding a book. A value that isn't a valid
+// ISBN can't match one either, so it is returned as it is.
+func lookupISBN(isbn string) string {
+	if normalized, err := normalizeISBN(isbn); err == nil {
+		return normalized
+	}
+
+	return isbn
+}
+
+func validateISBN10(digits string) error {
+	sum := 0
+
+	for i, c := range digits {
+		var d int
+
+		switch {
+		case c >= '0' && c <= '9':
+			d = int(c - '0')
+		case (c == 'X' || c == 'x') && i == 9:
+			d = 10
+		default:
+			return &FieldError{Field: "ISBN", Message: "contains invalid characters"}
+		}
+
+		sum += (10 - i) * d
+	}
+
+	if sum%11 != 0 {
+		return &FieldError{Field: "ISBN", Message: "invalid checksum"}
+	}
+
+	return nil
+}
+
+func validateISBN13(digits string) error {
+	sum := 0
+
+	for i, c := range digits {
+		if c < '0' || c > '9' {
+			return &FieldError{Field: "ISBN", Message: "contains invalid characters"}
+		}
+
+		d := int(c - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+
+		sum += d
+	}
+
+	if sum%10 != 0 {
+		return &FieldError{Field: "ISBN", Message: "invalid checksum"}
+	}
+
+	return nil
+}
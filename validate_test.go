@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateISBN(t *testing.T) {
+	tests := []struct {
+		isbn  string
+		valid bool
+	}{
+		{isbn: "978-1503261969", valid: true},
+		{isbn: "9781505255607", valid: true},
+		{isbn: "0-306-40615-2", valid: true},
+		{isbn: "080442957X", valid: true},
+		{isbn: "978-1503261960", valid: false},
+		{isbn: "0-306-40615-3", valid: false},
+		{isbn: "978-15032619", valid: false},
+		{isbn: "978-15032619ab", valid: false},
+	}
+
+	for _, tt := range tests {
+		err := validateISBN(tt.isbn)
+		if tt.valid != (err == nil) {
+			t.Errorf("validateISBN(%q) = %v, expected valid = %v", tt.isbn, err, tt.valid)
+		}
+	}
+}
+
+func TestValidatePublishedYear(t *testing.T) {
+	next := time.Now().Year() + 1
+
+	tests := []struct {
+		year  int
+		valid bool
+	}{
+		{year: 0, valid: true},
+		{year: 1815, valid: true},
+		{year: next, valid: true},
+		{year: next + 1, valid: false},
+		{year: 999, valid: false},
+		{year: -1, valid: false},
+		{year: 20240, valid: false},
+	}
+
+	for _, tt := range tests {
+		err := validatePublishedYear(tt.year)
+		if tt.valid != (err == nil) {
+			t.Errorf("validatePublishedYear(%d) = %v, expected valid = %v", tt.year, err, tt.valid)
+		}
+	}
+}
+
+func TestValidatePrice(t *testing.T) {
+	tests := []struct {
+		price string
+		valid bool
+	}{
+		{price: "9.44", valid: true},
+		{price: "999.99", valid: true},
+		{price: "-1.0", valid: false},
+		{price: "0", valid: false},
+		{price: "1000.00", valid: false},
+		{price: "92233720368547758.07", valid: false},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePrice(tt.price)
+		if err != nil {
+			t.Fatalf("ParsePrice(%q): %v", tt.price, err)
+		}
+
+		err = validatePrice(p)
+		if tt.valid != (err == nil) {
+			t.Errorf("validatePrice(%s) = %v, expected valid = %v", tt.price, err, tt.valid)
+		}
+	}
+}
+
+func TestValidateBook(t *testing.T) {
+	tests := []struct {
+		name     string
+		book     Book
+		expected map[string]string
+	}{
+		{
+			name:     "valid",
+			book:     Book{Isbn: "978-1503261969", Title: "Emma", Genre: "Romance", Price: 944},
+			expected: nil,
+		},
+		{
+			name: "several invalid fields",
+			book: Book{Isbn: "978-1503261960", Title: " ", Genre: "Romance", Price: -100, PublishedYear: 999},
+			expected: map[string]string{
+				"ISBN":          "invalid checksum",
+				"Title":         "must not be empty",
+				"Price":         "must be greater than 0",
+				"PublishedYear": "must be a four-digit year",
+			},
+		},
+		{
+			name:     "negative quantity",
+			book:     Book{Isbn: "978-1503261969", Title: "Emma", Genre: "Romance", Price: 944, Quantity: -1},
+			expected: map[string]string{"Quantity": "must not be negative"},
+		},
+		{
+			name: "title and author too long",
+			book: Book{Isbn: "978-1503261969", Title: strings.Repeat("a", 256), Author: strings.Repeat("b", 256), Genre: "Romance", Price: 944},
+			expected: map[string]string{
+				"Title":  "must be at most 255 characters",
+				"Author": "must be at most 255 characters",
+			},
+		},
+		{
+			name:     "longest title, in characters not bytes",
+			book:     Book{Isbn: "978-1503261969", Title: strings.Repeat("é", 255), Author: "Jane Austen", Genre: "Romance", Price: 944},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		var verr *ValidationError
+
+		err := validateBook(&tt.book)
+		if tt.expected == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &verr) {
+			t.Fatalf("%s: expected a *ValidationError, obtained %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(tt.expected, verr.Errors) {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, verr.Errors)
+		}
+	}
+}
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		isbn     string
+		expected string
+		valid    bool
+	}{
+		{isbn: "0-306-40615-2", expected: "978-0306406157", valid: true},
+		{isbn: "0306406152", expected: "978-0306406157", valid: true},
+		{isbn: "080442957X", expected: "978-0804429573", valid: true},
+		{isbn: "1505255600", expected: "978-1505255607", valid: true},
+		{isbn: "978-1503261969", expected: "978-1503261969", valid: true},
+		{isbn: "9781505255607", expected: "978-1505255607", valid: true},
+		{isbn: "978-1-50525-560-7", expected: "978-1505255607", valid: true},
+		{isbn: "0-306-40615-3", valid: false},
+		{isbn: "978-15032619", valid: false},
+	}
+
+	for _, tt := range tests {
+		obtained, err := normalizeISBN(tt.isbn)
+		if tt.valid != (err == nil) {
+			t.Errorf("normalizeISBN(%q) = %v, expected valid = %v", tt.isbn, err, tt.valid)
+			continue
+		}
+		if tt.expected != obtained {
+			t.Errorf("%q:\n...expected = %v\n...obtained = %v", tt.isbn, tt.expected, obtained)
+		}
+	}
+}
+
+func TestValidateBookNormalizesISBN(t *testing.T) {
+	bk := Book{Isbn: "0-306-40615-2", Title: "Measurement", Author: "J. Smith", Genre: "Science", Price: 999}
+	if err := validateBook(&bk); err != nil {
+		t.Fatal(err)
+	}
+	if bk.Isbn != "978-0306406157" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "978-0306406157", bk.Isbn)
+	}
+}
+
+func TestNormalizeAuthor(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{in: "H. G. Wells", expected: "H. G. Wells"},
+		{in: "  H. G. Wells\t", expected: "H. G. Wells"},
+		{in: "H.  G.   Wells", expected: "H. G. Wells"},
+		{in: "H. G.\n Wells", expected: "H. G. Wells"},
+		{in: "H.G. Wells", expected: "H.G. Wells"},
+		{in: "bell hooks", expected: "bell hooks"},
+		{in: "Niccolò Machiavelli", expected: "Niccolò Machiavelli"},
+		{in: "Ngũgĩ wa Thiong'o", expected: "Ngũgĩ wa Thiong'o"},
+		{in: "   ", expected: ""},
+	}
+
+	for _, tt := range tests {
+		if obtained := normalizeAuthor(tt.in); tt.expected != obtained {
+			t.Errorf("%q:\n...expected = %q\n...obtained = %q", tt.in, tt.expected, obtained)
+		}
+	}
+}
+
+func TestValidateBookNormalizesAuthor(t *testing.T) {
+	bk := Book{Isbn: "978-1505255607", Title: "The Time Machine", Author: " H. G.  Wells ", Genre: "Science Fiction", Price: 599}
+
+	if err := validateBook(&bk); err != nil {
+		t.Fatal(err)
+	}
+	if bk.Author != "H. G. Wells" {
+		t.Errorf("\n...expected = %q\n...obtained = %q", "H. G. Wells", bk.Author)
+	}
+}
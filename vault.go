@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	auth "github.com/hashicorp/vault/api/auth/kubernetes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/viper"
+)
+
+var (
+	vaultClient *vault.Client
+	vaultAuth   *vault.Secret
+
+	// confMu guards conf while a renewed secret is merged into it.
+	confMu sync.RWMutex
+
+	// vaultSecretReadAt is when the secret merged into conf was read from
+	// Vault, in Unix seconds, or zero if none has been.
+	vaultSecretReadAt atomic.Int64
+)
+
+// vaultAuthMethods builds the Vault auth method VAULT_AUTH_METHOD names from
+// the configuration. Supporting another method is a matter of adding it here.
+var vaultAuthMethods = map[string]func(c *viper.Viper) (vault.AuthMethod, error){
+	"kubernetes": func(c *viper.Viper) (vault.AuthMethod, error) {
+		return auth.NewKubernetesAuth(
+			c.GetString(VAULT_ROLE),
+			auth.WithServiceAccountTokenPath(c.GetString(KUBE_SVC_ACCT_TOKEN)),
+		)
+	},
+	"approle": func(c *viper.Viper) (vault.AuthMethod, error) {
+		a := &appRoleAuth{
+			roleID:   c.GetString(VAULT_APPROLE_ROLE_ID),
+			secretID: c.GetString(VAULT_APPROLE_SECRET_ID),
+		}
+		if a.roleID == "" || a.secretID == "" {
+			return nil, fmt.Errorf("%s and %s must be set", VAULT_APPROLE_ROLE_ID, VAULT_APPROLE_SECRET_ID)
+		}
+		return a, nil
+	},
+}
+
+// newVaultAuthMethod returns the auth method VAULT_AUTH_METHOD selects.
+func newVaultAuthMethod(c *viper.Viper) (vault.AuthMethod, error) {
+	name := strings.ToLower(c.GetString(VAULT_AUTH_METHOD))
+
+	build, ok := vaultAuthMethods[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid %s %q: must be kubernetes or approle", VAULT_AUTH_METHOD, name)
+	}
+
+	method, err := build(c)
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialize %s auth method: %w", name, err)
+	}
+
+	return method, nil
+}
+
+// loginVault logs client in to Vault with the configured auth method.
+func loginVault(ctx context.Context, client *vault.Client, c *viper.Viper) (*vault.Secret, error) {
+	confMu.RLock()
+	method, err := newVaultAuthMethod(c)
+	confMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	authInfo, err := client.Auth().Login(ctx, method)
+	if err != nil {
+		return nil, fmt.Errorf("unable to log in to Vault: %w", err)
+	}
+	if authInfo == nil {
+		return nil, fmt.Errorf("no auth info was returned after login")
+	}
+
+	return authInfo, nil
+}
+
+// appRoleAuth logs in with a role ID and secret ID, for services running
+// outside Kubernetes.
+type appRoleAuth struct {
+	roleID   string
+	secretID string
+}
+
+func (a *appRoleAuth) Login(ctx context.Context, client *vault.Client) (*vault.Secret, error) {
+	return client.Logical().WriteWithContext(ctx, "auth/approle/login", map[string]any{
+		"role_id":   a.roleID,
+		"secret_id": a.secretID,
+	})
+}
+
+// refreshVaultSecret reads the bookstore secret from the KV mount, of the
+// version VAULT_KV_VERSION names, and merges it into c.
+func refreshVaultSecret(ctx context.Context, client *vault.Client, c *viper.Viper) error {
+	confMu.RLock()
+	kvVersion := c.GetInt(VAULT_KV_VERSION)
+	kvMount := c.GetString(VAULT_KV_MOUNT)
+	bookstoreEnv := c.GetString(VAULT_BOOKSTORE_ENV)
+	confMu.RUnlock()
+
+	data, err := readVaultSecret(ctx, client.Logical(), kvVersion, kvMount, bookstoreEnv)
+	if err != nil {
+		return fmt.Errorf("unable to read secret: %w", err)
+	}
+
+	return applyVaultSecret(ctx, c, data, time.Now())
+}
+
+// vaultLogical is the part of the Vault logical API the secret read needs,
+// so tests can stand in for Vault.
+type vaultLogical interface {
+	ReadWithContext(ctx context.Context, path string) (*vault.Secret, error)
+}
+
+// readVaultSecret returns the key/value pairs of the secret at path in a KV
+// mount. KV v1 returns them as the secret's data; KV v2 serves them from
+// mount/data/path, nested under "data" beside the version's metadata.
+func readVaultSecret(ctx context.Context, logical vaultLogical, version int, mount, path string) (map[string]any, error) {
+	mount = strings.Trim(mount, "/")
+
+	var full string
+	switch version {
+	case 1:
+		full = mount + "/" + path
+	case 2:
+		full = mount + "/data/" + path
+	default:
+		return nil, fmt.Errorf("invalid %s %d: must be 1 or 2", VAULT_KV_VERSION, version)
+	}
+
+	secret, err := logical.ReadWithContext(ctx, full)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("secret not found at %s", full)
+	}
+	if version == 1 {
+		return secret.Data, nil
+	}
+
+	// A deleted or destroyed version still has metadata, but no data.
+	data, ok := secret.Data["data"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("secret not found at %s", full)
+	}
+
+	return data, nil
+}
+
+// applyVaultSecret merges data, read from Vault at readAt, into c and saves
+// it to VAULT_CACHE_FILE as the last known good secret.
+func applyVaultSecret(ctx context.Context, c *viper.Viper, data map[string]any, readAt time.Time) error {
+	confMu.Lock()
+	err := c.MergeConfigMap(data)
+	cacheFile := c.GetString(VAULT_CACHE_FILE)
+	confMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to merge secret: %w", err)
+	}
+	vaultSecretReadAt.Store(readAt.Unix())
+
+	// The merged secret is already in use, so a cache that can't be
+	// written only costs the fallback on the next start.
+	if cacheFile != "" {
+		err = saveVaultCache(cacheFile, vaultCache{ReadAt: readAt, Data: data})
+		if err != nil {
+			slog.WarnContext(ctx, "unable to cache vault secret", "path", cacheFile, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// vaultCache is the last known good secret, as saved to VAULT_CACHE_FILE.
+type vaultCache struct {
+	ReadAt time.Time      `json:"read_at"`
+	Data   map[string]any `json:"data"`
+}
+
+// saveVaultCache writes cache to path, readable only by the service's user.
+// It writes a temporary file and renames it into place, so a crash never
+// leaves a half-written cache behind.
+func saveVaultCache(path string, cache vaultCache) error {
+	b, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func loadVaultCache(path string) (vaultCache, error) {
+	var cache vaultCache
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return cache, err
+	}
+	err = json.Unmarshal(b, &cache)
+
+	return cache, err
+}
+
+// vaultSecretAge exports how long ago the secret in use was read from
+// Vault, so alerts can fire while the service runs on a stale one.
+func vaultSecretAge() prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "vault_secret_age_seconds",
+		Help: "Seconds since the secret in use was read from Vault, or -1 if none has been.",
+	}, func() float64 {
+		readAt := vaultSecretReadAt.Load()
+		if readAt == 0 {
+			return -1
+		}
+
+		return time.Since(time.Unix(readAt, 0)).Seconds()
+	})
+}
+
+// vaultSecretStaleFor returns how long ago the secret in use was read, for
+// logging refresh failures.
+func vaultSecretStaleFor() time.Duration {
+	readAt := vaultSecretReadAt.Load()
+	if readAt == 0 {
+		return 0
+	}
+
+	return time.Since(time.Unix(readAt, 0)).Round(time.Second)
+}
+
+// mergeVaultSecret merges the bookstore secret into c by calling refresh. If
+// that fails it falls back to the secret saved in VAULT_CACHE_FILE by an
+// earlier run. Without one, the service carries on with its environment
+// configuration rather than going down with Vault, unless VAULT_REQUIRED is
+// set.
+func mergeVaultSecret(ctx context.Context, c *viper.Viper, refresh func(ctx context.Context) error) error {
+	err := refresh(ctx)
+	if err == nil {
+		return nil
+	}
+
+	if cacheFile := c.GetString(VAULT_CACHE_FILE); cacheFile != "" {
+		cache, cacheErr := loadVaultCache(cacheFile)
+		if cacheErr == nil {
+			cacheErr = c.MergeConfigMap(cache.Data)
+		}
+		if cacheErr == nil {
+			vaultSecretReadAt.Store(cache.ReadAt.Unix())
+			slog.WarnContext(ctx, "vault secret unavailable, using cached secret", "error", err, "read_at", cache.ReadAt)
+			return nil
+		}
+		slog.WarnContext(ctx, "unable to load cached vault secret", "path", cacheFile, "error", cacheErr)
+	}
+
+	if c.GetBool(VAULT_REQUIRED) {
+		return err
+	}
+
+	slog.WarnContext(ctx, "VAULT SECRET UNAVAILABLE: continuing with configuration from the environment only", "error", err)
+
+	return nil
+}
+
+// lifetimeWatcher is the subset of *vault.LifetimeWatcher used by
+// vaultRenewer, so tests can drive renewals without a Vault server.
+type lifetimeWatcher interface {
+	Start()
+	Stop()
+	DoneCh() <-chan error
+	RenewCh() <-chan *vault.RenewOutput
+}
+
+// vaultRenewer keeps the Vault token alive for the life of the process. Each
+// renewal re-reads the bookstore secret; when the token can no longer be
+// renewed it logs in again and starts a new watcher.
+type vaultRenewer struct {
+	newWatcher func(secret *vault.Secret) (lifetimeWatcher, error)
+	login      func(ctx context.Context) (*vault.Secret, error)
+	refresh    func(ctx context.Context) error
+
+	// OnRenew, if set, is called with the new token TTL after each renewal.
+	OnRenew func(ttl time.Duration)
+
+	retryDelay time.Duration
+}
+
+// run keeps the token alive until ctx is done. A nil secret, as when the
+// login at startup failed, makes it log in first, so the service recovers
+// once Vault lets it in.
+func (r *vaultRenewer) run(ctx context.Context, secret *vault.Secret) {
+	for {
+		if secret == nil {
+			var err error
+
+			secret, err = r.login(ctx)
+			for err != nil {
+				slog.ErrorContext(ctx, "vault login failed", "error", err)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(r.retryDelay):
+				}
+
+				secret, err = r.login(ctx)
+			}
+
+			err = r.refresh(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "vault secret refresh failed, keeping the last one read", "error", err, "stale_for", vaultSecretStaleFor())
+			}
+		}
+
+		err := r.watch(ctx, secret)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.WarnContext(ctx, "vault token renewal stopped, logging in again", "error", err)
+
+		secret = nil
+	}
+}
+
+// watch renews secret until the watcher gives up or ctx is done.
+func (r *vaultRenewer) watch(ctx context.Context, secret *vault.Secret) error {
+	watcher, err := r.newWatcher(secret)
+	if err != nil {
+		return fmt.Errorf("unable to initialize lifetime watcher: %w", err)
+	}
+
+	go watcher.Start()
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-watcher.DoneCh():
+			return err
+		case renewal := <-watcher.RenewCh():
+			if r.OnRenew != nil && renewal.Secret != nil && renewal.Secret.Auth != nil {
+				r.OnRenew(time.Duration(renewal.Secret.Auth.LeaseDuration) * time.Second)
+			}
+
+			err := r.refresh(ctx)
+			if err != nil {
+				slog.ErrorContext(ctx, "vault secret refresh failed, keeping the last one read", "error", err, "stale_for", vaultSecretStaleFor())
+			}
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	auth "github.com/hashicorp/vault/api/auth/kubernetes"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/viper"
+)
+
+type fakeWatcher struct {
+	done  chan error
+	renew chan *vault.RenewOutput
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{done: make(chan error), renew: make(chan *vault.RenewOutput)}
+}
+
+func (w *fakeWatcher) Start()                             {}
+func (w *fakeWatcher) Stop()                              {}
+func (w *fakeWatcher) DoneCh() <-chan error               { return w.done }
+func (w *fakeWatcher) RenewCh() <-chan *vault.RenewOutput { return w.renew }
+
+func TestVaultRenewer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watchers := make(chan *fakeWatcher, 2)
+	ttls := make(chan time.Duration, 1)
+	refreshed := make(chan struct{}, 2)
+	logins := 0
+
+	r := &vaultRenewer{
+		newWatcher: func(secret *vault.Secret) (lifetimeWatcher, error) {
+			w := newFakeWatcher()
+			watchers <- w
+			return w, nil
+		},
+		login: func(ctx context.Context) (*vault.Secret, error) {
+			logins++
+			if logins == 1 {
+				return nil, errors.New("permission denied")
+			}
+			return &vault.Secret{}, nil
+		},
+		refresh: func(ctx context.Context) error {
+			refreshed <- struct{}{}
+			return nil
+		},
+		OnRenew:    func(ttl time.Duration) { ttls <- ttl },
+		retryDelay: time.Millisecond,
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		r.run(ctx, &vault.Secret{})
+		close(stopped)
+	}()
+
+	w := <-watchers
+	w.renew <- &vault.RenewOutput{Secret: &vault.Secret{Auth: &vault.SecretAuth{LeaseDuration: 3600}}}
+	if ttl := <-ttls; ttl != time.Hour {
+		t.Errorf("\n...expected = %v\n...obtained = %v", time.Hour, ttl)
+	}
+	<-refreshed
+
+	// Once the token can no longer be renewed the renewer logs in again,
+	// retrying failed logins, and watches the new token.
+	w.done <- errors.New("token expired")
+	<-refreshed
+	<-watchers
+	if logins != 2 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 2, logins)
+	}
+
+	cancel()
+	<-stopped
+}
+
+func TestVaultRenewerFailedStartupLogin(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	watchers := make(chan *fakeWatcher, 1)
+	refreshed := make(chan struct{}, 1)
+	logins := 0
+
+	r := &vaultRenewer{
+		newWatcher: func(secret *vault.Secret) (lifetimeWatcher, error) {
+			w := newFakeWatcher()
+			watchers <- w
+			return w, nil
+		},
+		login: func(ctx context.Context) (*vault.Secret, error) {
+			logins++
+			if logins < 3 {
+				return nil, errors.New("connection refused")
+			}
+			return &vault.Secret{}, nil
+		},
+		refresh: func(ctx context.Context) error {
+			refreshed <- struct{}{}
+			return nil
+		},
+		retryDelay: time.Millisecond,
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		r.run(ctx, nil)
+		close(stopped)
+	}()
+
+	// Without a token from startup the renewer logs in, retrying until
+	// Vault lets it in, reads the secret and watches the new token.
+	<-refreshed
+	<-watchers
+	if logins != 3 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", 3, logins)
+	}
+
+	cancel()
+	<-stopped
+}
+
+func TestMergeVaultSecret(t *testing.T) {
+	unavailable := errors.New("vault unavailable")
+
+	tests := []struct {
+		name     string
+		required bool
+		err      error
+		expected error
+	}{
+		{name: "merged", required: false, err: nil, expected: nil},
+		{name: "lenient", required: false, err: unavailable, expected: nil},
+		{name: "strict", required: true, err: unavailable, expected: unavailable},
+	}
+
+	for _, tt := range tests {
+		c := viper.New()
+		c.Set(VAULT_REQUIRED, tt.required)
+
+		err := mergeVaultSecret(context.Background(), c, func(ctx context.Context) error {
+			return tt.err
+		})
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestVaultRenewalFailureKeepsSecret(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer vaultSecretReadAt.Store(0)
+
+	cacheFile := filepath.Join(t.TempDir(), "vault-secret.json")
+	c := viper.New()
+	c.Set(VAULT_CACHE_FILE, cacheFile)
+
+	watcher := newFakeWatcher()
+	refreshed := make(chan error)
+	refreshes := 0
+
+	r := &vaultRenewer{
+		newWatcher: func(secret *vault.Secret) (lifetimeWatcher, error) { return watcher, nil },
+		login:      func(ctx context.Context) (*vault.Secret, error) { return &vault.Secret{}, nil },
+		refresh: func(ctx context.Context) error {
+			refreshes++
+
+			// The first renewal reads the secret; Vault then goes away.
+			err := errors.New("503 Service Unavailable")
+			if refreshes == 1 {
+				err = applyVaultSecret(ctx, c, map[string]any{DB_PASS: "s3cret"}, time.Now().Add(-time.Minute))
+			}
+			refreshed <- err
+			return err
+		},
+		retryDelay: time.Millisecond,
+	}
+	go r.run(ctx, &vault.Secret{})
+
+	for i, expectErr := range []bool{false, true, true} {
+		watcher.renew <- &vault.RenewOutput{}
+		if err := <-refreshed; (err != nil) != expectErr {
+			t.Fatalf("refresh %d: unexpected error %v", i+1, err)
+		}
+	}
+
+	// The service keeps the last secret it read and reports its age.
+	if pass := c.GetString(DB_PASS); pass != "s3cret" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "s3cret", pass)
+	}
+	if age := testutil.ToFloat64(vaultSecretAge()); age < 60 || age > 120 {
+		t.Errorf("unexpected secret age %v", age)
+	}
+
+	info, err := os.Stat(cacheFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("\n...expected = %v\n...obtained = %v", os.FileMode(0o600), mode)
+	}
+
+	// A restart during the outage starts from the cached secret, even when
+	// Vault is required.
+	vaultSecretReadAt.Store(0)
+	restarted := viper.New()
+	restarted.Set(VAULT_CACHE_FILE, cacheFile)
+	restarted.Set(VAULT_REQUIRED, true)
+
+	err = mergeVaultSecret(context.Background(), restarted, func(ctx context.Context) error {
+		return errors.New("503 Service Unavailable")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pass := restarted.GetString(DB_PASS); pass != "s3cret" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "s3cret", pass)
+	}
+	if age := testutil.ToFloat64(vaultSecretAge()); age < 60 {
+		t.Errorf("unexpected secret age %v", age)
+	}
+}
+
+// fakeLogical serves secrets by path, like Vault's logical API.
+type fakeLogical map[string]*vault.Secret
+
+func (f fakeLogical) ReadWithContext(ctx context.Context, path string) (*vault.Secret, error) {
+	return f[path], nil
+}
+
+func TestReadVaultSecret(t *testing.T) {
+	logical := fakeLogical{
+		"kv1/bookstore": {Data: map[string]any{"DB_PASS": "v1-secret"}},
+		"kv2/data/bookstore": {Data: map[string]any{
+			"data":     map[string]any{"DB_PASS": "v2-secret"},
+			"metadata": map[string]any{"version": 3},
+		}},
+		"kv2/data/deleted": {Data: map[string]any{
+			"data":     nil,
+			"metadata": map[string]any{"version": 2, "deletion_time": "2026-01-01T00:00:00Z"},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		version  int
+		mount    string
+		path     string
+		expected string
+		err      bool
+	}{
+		{name: "kv v1", version: 1, mount: "kv1", path: "bookstore", expected: "v1-secret"},
+		{name: "kv v2", version: 2, mount: "kv2", path: "bookstore", expected: "v2-secret"},
+		{name: "kv v2 mount with slashes", version: 2, mount: "/kv2/", path: "bookstore", expected: "v2-secret"},
+		{name: "kv v1 read of a v2 mount", version: 1, mount: "kv2", path: "bookstore", err: true},
+		{name: "kv v2 deleted version", version: 2, mount: "kv2", path: "deleted", err: true},
+		{name: "missing", version: 2, mount: "kv2", path: "other", err: true},
+		{name: "invalid version", version: 3, mount: "kv2", path: "bookstore", err: true},
+	}
+
+	for _, tt := range tests {
+		data, err := readVaultSecret(context.Background(), logical, tt.version, tt.mount, tt.path)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, obtained %v", tt.name, data)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		c := viper.New()
+		if err := c.MergeConfigMap(data); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.GetString(DB_PASS); got != tt.expected {
+			t.Errorf("%s:\n...expected = %v\n...obtained = %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestNewVaultAuthMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]any
+		expected vault.AuthMethod
+		err      bool
+	}{
+		{
+			name:     "kubernetes",
+			settings: map[string]any{VAULT_AUTH_METHOD: "kubernetes", VAULT_ROLE: "bookstore"},
+			expected: &auth.KubernetesAuth{},
+		},
+		{
+			name:     "approle",
+			settings: map[string]any{VAULT_AUTH_METHOD: "AppRole", VAULT_APPROLE_ROLE_ID: "role", VAULT_APPROLE_SECRET_ID: "secret"},
+			expected: &appRoleAuth{roleID: "role", secretID: "secret"},
+		},
+		{
+			name:     "approle without a secret ID",
+			settings: map[string]any{VAULT_AUTH_METHOD: "approle", VAULT_APPROLE_ROLE_ID: "role"},
+			err:      true,
+		},
+		{
+			name:     "unknown",
+			settings: map[string]any{VAULT_AUTH_METHOD: "userpass"},
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		c := viper.New()
+		for k, v := range tt.settings {
+			c.Set(k, v)
+		}
+
+		method, err := newVaultAuthMethod(c)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, obtained %T", tt.name, method)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if reflect.TypeOf(method) != reflect.TypeOf(tt.expected) {
+			t.Errorf("%s:\n...expected = %T\n...obtained = %T", tt.name, tt.expected, method)
+		}
+		if a, ok := tt.expected.(*appRoleAuth); ok && !reflect.DeepEqual(a, method) {
+			t.Errorf("%s:\n...expected = %+v\n...obtained = %+v", tt.name, a, method)
+		}
+	}
+}
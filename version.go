@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildDate = "dev"
+)
+
+// serveVersion reports which build is running.
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	RespondJSON(w, 200, struct {
+		Version   string `json:"version"`
+		Commit    string `json:"commit"`
+		BuildDate string `json:"build_date"`
+	}{version, commit, buildDate})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeVersion(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "842fabb", "2024-05-01T12:00:00Z"
+
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/version", nil)
+
+	http.HandlerFunc(serveVersion).ServeHTTP(rec, req)
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("\n...expected = %v\n...obtained = %v", "application/json", ct)
+	}
+
+	expected := `{"version":"1.2.0","commit":"842fabb","build_date":"2024-05-01T12:00:00Z"}` + "\n"
+	if expected != rec.Body.String() {
+		t.Errorf("\n...expected = %v\n...obtained = %v", expected, rec.Body.String())
+	}
+}